@@ -1,11 +1,13 @@
 package grouter
 
 import (
+	"encoding/binary"
 	"io"
 	"log"
 	"net"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/dustin/gomemcached"
@@ -18,31 +20,339 @@ type Params struct {
 	TargetSpec        string
 	TargetChanSize    int
 	TargetConcurrency int
+	TargetOverload    string // One of TargetOverloadPolicies.
+
+	// Batching of requests for targets that batch (see BatchPolicy).
+	TargetBatchSize     int // 0 means TargetChanSize.
+	TargetBatchBytes    int
+	TargetBatchLinger   time.Duration
+	TargetBatchAdaptive bool
+
+	// Requests time out after RequestTimeout, unless a source
+	// provides its own, positive SourceRequestTimeout.  Zero
+	// durations mean no timeout.
+	RequestTimeout       time.Duration
+	SourceRequestTimeout time.Duration
+
+	// On shutdown, how long to wait for in-flight requests before
+	// forcibly closing conns.
+	ShutdownGrace time.Duration
+
+	// Optional access log of a source's requests (see AccessLog).
+	AccessLog         string
+	AccessLogSample   float64 // Fraction of requests logged, 0 to 1.
+	AccessLogKeys     string  // One of AccessLogKeyModes.
+	AccessLogMaxBytes int64   // Rotates when larger; 0 means never.
+	AccessLogMaxFiles int     // Number of rotated files kept.
+
+	// Process-wide tracking of the most frequent keys and largest
+	// values of each bucket (see HotKeys), from the top-level params.
+	HotKeys           int     // Keys tracked per bucket shard; 0 disables.
+	HotKeyThreshold   float64 // Ops/sec that's logged as hot; 0 means never.
+	BigValueThreshold int     // Value bytes logged as big; 0 means never.
+
+	// Optional export of a source's sampled request traces (see Trace),
+	// to a file or an OTLP/HTTP collector URL.
+	TraceExport string
+	TraceSample float64 // Fraction of requests traced, 0 to 1.
+
+	// Max bytes of an arg of a redis command, such as a value.
+	RedisMaxBulk int
+
+	// Whether flush_all is allowed, from the top-level params, which
+	// the admin can change at runtime (see FlushAllEnable).
+	FlushAll bool
+}
+
+// Returns the deadline for a request that starts at the given time,
+// or the zero time when there's no timeout.
+func (p Params) RequestDeadline(start time.Time) time.Time {
+	timeout := p.RequestTimeout
+	if p.SourceRequestTimeout > 0 {
+		timeout = p.SourceRequestTimeout
+	}
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return start.Add(timeout)
+}
+
+// A grouter-specific response status, used when a request's deadline
+// passed before a target could process it.
+const ETIMEDOUT = gomemcached.Status(0xff01)
+
+// A grouter-specific response status, used when a request was rejected
+// or shed because its target's queue was full (see SwapTarget).
+const EBUSY = gomemcached.Status(0xff02)
+
+// The quiet variants of opcodes, which a memcached server only responds
+// to on an error, used for requests whose client asked for no reply.
+// Targets still respond to every quiet request, including successes,
+// so that its source can count it.
+var QuietOpcodes = map[gomemcached.CommandCode]gomemcached.CommandCode{
+	gomemcached.SET:       gomemcached.SETQ,
+	gomemcached.ADD:       gomemcached.ADDQ,
+	gomemcached.REPLACE:   gomemcached.REPLACEQ,
+	gomemcached.APPEND:    gomemcached.APPENDQ,
+	gomemcached.PREPEND:   gomemcached.PREPENDQ,
+	gomemcached.DELETE:    gomemcached.DELETEQ,
+	gomemcached.INCREMENT: gomemcached.INCREMENTQ,
+	gomemcached.DECREMENT: gomemcached.DECREMENTQ,
+	gomemcached.FLUSH:     gomemcached.FLUSHQ,
+}
+
+var unquietOpcodes = make(map[gomemcached.CommandCode]gomemcached.CommandCode)
+
+func init() {
+	for opcode, quiet := range QuietOpcodes {
+		unquietOpcodes[quiet] = opcode
+	}
+}
+
+// Returns the quiet variant of an opcode, or the opcode itself if it
+// has none.
+func QuietOpcode(opcode gomemcached.CommandCode) gomemcached.CommandCode {
+	if quiet, ok := QuietOpcodes[opcode]; ok {
+		return quiet
+	}
+	return opcode
+}
+
+// Returns the non-quiet variant of a quiet opcode, or the opcode itself
+// if it's not quiet.
+func UnquietOpcode(opcode gomemcached.CommandCode) gomemcached.CommandCode {
+	if unquiet, ok := unquietOpcodes[opcode]; ok {
+		return unquiet
+	}
+	return opcode
+}
+
+func IsQuietOpcode(opcode gomemcached.CommandCode) bool {
+	_, ok := unquietOpcodes[opcode]
+	return ok
+}
+
+// Process-wide, as flush_all affects every client of the targets.
+var flushAllDisabled int32
+
+// Allows or disallows the flush_all command, such as in production,
+// where flushing every cache server is rarely intended.
+func FlushAllEnable(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&flushAllDisabled, 0)
+	} else {
+		atomic.StoreInt32(&flushAllDisabled, 1)
+	}
+}
+
+func FlushAllEnabled() bool {
+	return atomic.LoadInt32(&flushAllDisabled) == 0
 }
 
 type Request struct {
 	Bucket string
-	Req    *gomemcached.MCRequest
-	Res    chan *gomemcached.MCResponse
+
+	// The key, extras and body of a request might be in a pooled
+	// buffer (see BufGet) that the source reuses after the response,
+	// so targets must copy any of them that they keep.
+	Req *gomemcached.MCRequest
+	Res chan *gomemcached.MCResponse
 
 	// The client number allows backend targets to provide resource
 	// affinity, such as processing requests using the same connection
 	// used for a client's previous requests.  This also ensures
 	// correct semantic ordering from the client's perspective.
 	ClientNum uint32
+
+	// Targets skip requests that are past their deadline, responding
+	// with an ETIMEDOUT status instead.  A zero Deadline means the
+	// request never expires.
+	Deadline time.Time
+
+	// The request's trace, which each stage that handles the request
+	// adds a span to, or nil when the request isn't traced.
+	Trace *Trace
+
+	// The options of a meta command that the binary protocol's
+	// requests don't carry, or nil.  Targets that don't support them
+	// ignore them (see RequestMeta).
+	Meta *RequestMeta
+
+	// Set by a target worker to record its response (see Respond).
+	targetStats *TargetStats
+}
+
+// The options of a meta command, such as memcached's invalidation and
+// stale-while-revalidate, which the memory and memcached-ascii targets
+// support.  Other targets ignore them, so a get returns no ItemInfo,
+// and an invalidating delete is a plain delete.
+type RequestMeta struct {
+	// A get returns its item's ItemInfo, in the response's extras.
+	ItemInfo bool
+
+	// I: a delete marks its item as stale, instead of removing it,
+	// and a set whose cas is older than its item's cas stores the
+	// item as stale, instead of failing.
+	Invalidate bool
+
+	// T of an invalidating delete: the stale item's new ttl, or -1.
+	TTL int64
+
+	// R: a get wins the recache of an item whose remaining ttl is less
+	// than Recache seconds, or -1.
+	Recache int64
+}
+
+// The info of an item beyond its flags, which a get with a RequestMeta
+// that asks for it returns in its response's extras, after the flags.
+type ItemInfo struct {
+	TTL        int32  // t: the remaining secs, or -1 if it doesn't expire.
+	LastAccess uint32 // l: secs since the item was last accessed.
+	Fetched    bool   // h: the item was fetched before.
+	Stale      bool   // X: the item was invalidated.
+	Win        bool   // W: the client should recache the item.
+	WinSent    bool   // Z: another client already won the recache.
+}
+
+const itemInfoExtrasLen = 13
+
+// Returns the extras of a get's response with an item's info.
+func ItemInfoExtras(flags uint32, info ItemInfo) []byte {
+	extras := make([]byte, itemInfoExtrasLen)
+	binary.BigEndian.PutUint32(extras, flags)
+	binary.BigEndian.PutUint32(extras[4:], uint32(info.TTL))
+	binary.BigEndian.PutUint32(extras[8:], info.LastAccess)
+	for i, b := range []bool{info.Fetched, info.Stale, info.Win, info.WinSent} {
+		if b {
+			extras[12] |= 1 << uint(i)
+		}
+	}
+	return extras
+}
+
+// Returns the item info in a get's response extras, or false if the
+// target didn't return any.
+func ItemInfoParse(extras []byte) (ItemInfo, bool) {
+	if len(extras) < itemInfoExtrasLen {
+		return ItemInfo{}, false
+	}
+	return ItemInfo{
+		TTL:        int32(binary.BigEndian.Uint32(extras[4:])),
+		LastAccess: binary.BigEndian.Uint32(extras[8:]),
+		Fetched:    extras[12]&1 != 0,
+		Stale:      extras[12]&2 != 0,
+		Win:        extras[12]&4 != 0,
+		WinSent:    extras[12]&8 != 0,
+	}, true
+}
+
+// Returns true if the request has a deadline that's already passed.
+func (r Request) Expired(now time.Time) bool {
+	return !r.Deadline.IsZero() && now.After(r.Deadline)
+}
+
+// Sends a response to a request, first recording it in the stats of
+// the target worker that's handling the request, if any.
+func (r Request) Respond(res *gomemcached.MCResponse) {
+	r.Trace.Span("target.backend", time.Now())
+	if r.targetStats != nil {
+		r.targetStats.record(r, res)
+	}
+	r.Res <- res
+}
+
+// Responds to a request with an ETIMEDOUT status.
+func RespondTimeout(req Request) {
+	req.Respond(&gomemcached.MCResponse{
+		Opcode: req.Req.Opcode,
+		Status: ETIMEDOUT,
+		Opaque: req.Req.Opaque,
+		Key:    req.Req.Key,
+	})
+}
+
+// Sends a batch of requests to a target's channel, unless the earliest
+// of their deadlines passes first, when they're all responded to with
+// an ETIMEDOUT status instead.  So, a source whose target has stopped
+// taking requests, such as when its backend hangs, still replies in
+// time.  Returns false if the requests timed out.
+func SendRequests(c chan []Request, reqs []Request) bool {
+	var deadline time.Time
+	for _, req := range reqs {
+		if !req.Deadline.IsZero() &&
+			(deadline.IsZero() || req.Deadline.Before(deadline)) {
+			deadline = req.Deadline
+		}
+	}
+	if deadline.IsZero() {
+		c <- reqs
+		return true
+	}
+
+	timer := time.NewTimer(deadline.Sub(time.Now()))
+	defer timer.Stop()
+
+	select {
+	case c <- reqs:
+		return true
+	case <-timer.C:
+		for _, req := range reqs {
+			RespondTimeout(req)
+		}
+		return false
+	}
+}
+
+// Returns the latest deadline of a batch of requests, or zero when any
+// of them never expires, for the deadline of a backend round trip.
+func LatestDeadline(reqs []Request) time.Time {
+	var deadline time.Time
+	for _, req := range reqs {
+		if req.Deadline.IsZero() {
+			return time.Time{}
+		}
+		if req.Deadline.After(deadline) {
+			deadline = req.Deadline
+		}
+	}
+	return deadline
+}
+
+// Responds to a request with an EBUSY status.
+func RespondBusy(req Request) {
+	req.Respond(&gomemcached.MCResponse{
+		Opcode: req.Req.Opcode,
+		Status: EBUSY,
+		Opaque: req.Req.Opaque,
+		Key:    req.Req.Key,
+	})
 }
 
 type Target interface {
 	PickChannel(clientNum uint32, bucket string) chan []Request
+
+	// Returns the number of request batches that are queued in front
+	// of each of the target's workers.
+	QueueLens() []int
+
+	// Closes the target's incoming channels, waits for any queued
+	// requests to be processed and responded to, and then closes
+	// backend connections.  Callers must stop sending requests to
+	// the target before calling Close().
+	Close()
 }
 
 type Source interface {
-	Run(s io.ReadWriter, clientNum uint32, target Target, statsChan chan Stats)
+	Run(s io.ReadWriter, clientNum uint32, params Params, target Target,
+		stats *Stats)
 }
 
-// Returns a source func that net.Listen()'s and accepts conns.
-func MakeListenSourceFunc(source Source) func(string, Params, Target, chan Stats) {
-	return func(sourceSpec string, params Params, target Target, statsChan chan Stats) {
+// Returns a source func that net.Listen()'s and accepts conns, until
+// the quit channel is closed.
+func MakeListenSourceFunc(source Source) func(string, Params, Target,
+	*Stats, chan bool) {
+	return func(sourceSpec string, params Params, target Target,
+		stats *Stats, quit chan bool) {
 		sourceParts := strings.Split(sourceSpec, ":")
 		if len(sourceParts) == 3 {
 			listen := strings.Join(sourceParts[1:], ":")
@@ -52,7 +362,7 @@ func MakeListenSourceFunc(source Source) func(string, Params, Target, chan Stats
 			} else {
 				defer ls.Close()
 				log.Printf("listening to: %s", listen)
-				AcceptConns(ls, params.SourceMaxConns, source, target, statsChan)
+				AcceptConns(ls, params, source, target, stats, quit)
 			}
 		} else {
 			log.Fatalf("error: missing listen HOST:PORT; instead, got: %v",
@@ -62,14 +372,18 @@ func MakeListenSourceFunc(source Source) func(string, Params, Target, chan Stats
 }
 
 // Accepts a max number of concurrent net.Conn's, starting a new
-// goroutine for each accepted net.Conn.
-func AcceptConns(ls net.Listener, maxConns int,
-	source Source, target Target, statsChan chan Stats) {
+// goroutine for each accepted net.Conn.  When the quit channel is
+// closed, stops accepting and drains the open conns (see DrainConns).
+func AcceptConns(ls net.Listener, params Params,
+	source Source, target Target, stats *Stats, quit chan bool) {
+	maxConns := params.SourceMaxConns
+	curr_conns := stats.Gauge("curr-conns")
+	tot_conns := stats.Counter("tot-conns")
 	log.Printf("AcceptConns: accepting max conns: %d", maxConns)
 
 	chanAccepted := make(chan io.ReadWriteCloser)
 	chanClosed := make(chan io.ReadWriteCloser)
-	numConns := 0
+	conns := make(map[io.ReadWriteCloser]bool)
 	totConns := uint32(0)
 
 	go func() {
@@ -85,37 +399,111 @@ func AcceptConns(ls net.Listener, maxConns int,
 	}()
 
 	for {
-		if numConns < maxConns {
-			log.Printf("AcceptConns: accepted conns: %d", numConns)
-			select {
-			case c := <-chanAccepted:
-				if c == nil {
-					log.Printf("AcceptConns: error: can't accept more conns")
-					return
-				}
+		// A nil accepted channel blocks, so we stop accepting at max.
+		var accepted chan io.ReadWriteCloser
+		if len(conns) < maxConns {
+			log.Printf("AcceptConns: accepted conns: %d", len(conns))
+			accepted = chanAccepted
+		} else {
+			log.Printf("AcceptConns: reached max conns: %d", len(conns))
+		}
 
-				log.Printf("AcceptConns: conn accepted")
-				numConns++
-				totConns++
-
-				go func(s io.ReadWriteCloser) {
-					source.Run(s, totConns, target, statsChan)
-					chanClosed <- s
-					s.Close()
-				}(c)
-			case <-chanClosed:
-				log.Printf("AcceptConns: conn closed")
-				numConns--
+		select {
+		case c := <-accepted:
+			if c == nil {
+				log.Printf("AcceptConns: error: can't accept more conns")
+				DrainConns(ls, chanAccepted, chanClosed, conns, params.ShutdownGrace)
+				return
 			}
-		} else {
-			log.Printf("AcceptConns: reached max conns: %d", numConns)
-			<-chanClosed
+
+			log.Printf("AcceptConns: conn accepted")
+			conns[c] = true
+			totConns++
+			curr_conns.Add(1)
+			tot_conns.Add(1)
+
+			go func(s io.ReadWriteCloser, clientNum uint32) {
+				source.Run(s, clientNum, params, target, stats)
+				curr_conns.Add(-1)
+				chanClosed <- s
+				s.Close()
+			}(c, totConns)
+		case s := <-chanClosed:
 			log.Printf("AcceptConns: conn closed")
-			numConns--
+			delete(conns, s)
+		case <-quit:
+			log.Printf("AcceptConns: shutting down, open conns: %d", len(conns))
+			DrainConns(ls, chanAccepted, chanClosed, conns, params.ShutdownGrace)
+			return
 		}
 	}
 }
 
+// Max time that DrainConns waits for the goroutines of the conns that
+// it forcibly closed, as one that's waiting on a hung target might not
+// notice that its conn was closed.
+const drainConnsCloseWait = 5 * time.Second
+
+// Closes the listener and stops reads on the open conns, so that each
+// conn finishes its in-flight request and then exits.  Conns that are
+// still open after the grace period are forcibly closed.  Returns
+// after every conn's goroutine has exited, or, at the latest, a while
+// after the conns were forcibly closed.
+func DrainConns(ls net.Listener, chanAccepted chan io.ReadWriteCloser,
+	chanClosed chan io.ReadWriteCloser, conns map[io.ReadWriteCloser]bool,
+	grace time.Duration) {
+	ls.Close()
+	go func() {
+		for c := range chanAccepted {
+			c.Close() // Accepted during shutdown, so never started.
+		}
+	}()
+
+	for c := range conns {
+		if rc, ok := c.(interface {
+			SetReadDeadline(time.Time) error
+		}); ok {
+			rc.SetReadDeadline(time.Now())
+		}
+	}
+
+	graceChan := time.After(grace)
+	var closeChan <-chan time.Time
+	for len(conns) > 0 {
+		select {
+		case s := <-chanClosed:
+			log.Printf("DrainConns: conn closed, open conns: %d", len(conns)-1)
+			delete(conns, s)
+		case <-graceChan:
+			log.Printf("DrainConns: grace period over, closing conns: %d",
+				len(conns))
+			for c := range conns {
+				c.Close()
+			}
+			graceChan = nil
+			closeChan = time.After(drainConnsCloseWait)
+		case <-closeChan:
+			log.Printf("DrainConns: error: giving up on stuck conns: %d",
+				len(conns))
+			go func() {
+				for _ = range chanClosed {
+					// So the stuck conns can still exit.
+				}
+			}()
+			return
+		}
+	}
+}
+
+// Returns the lengths of request channels.
+func ChanLens(chans []chan []Request) []int {
+	rv := make([]int, len(chans))
+	for i, c := range chans {
+		rv[i] = len(c)
+	}
+	return rv
+}
+
 // Provides a capped, exponential-backoff retry loop around a dialer.
 func Reconnect(spec string, dialer func(string) (interface{}, error)) interface{} {
 	sleep := 100 * time.Millisecond
@@ -138,42 +526,6 @@ func Reconnect(spec string, dialer func(string) (interface{}, error)) interface{
 	return nil // Unreachable.
 }
 
-// Batch up requests from the incoming channel to feed to the outgoing channel.
-func BatchRequests(maxBatchSize int, incoming chan []Request, outgoing chan []Request,
-	statsChan chan Stats) {
-	batch := make([]Request, 0, maxBatchSize)
-	tot_batch := int64(0)
-
-	for {
-		if len(batch) > 0 {
-			if len(batch) >= cap(batch) {
-				outgoing <- batch
-				tot_batch += 1
-				batch = make([]Request, 0, maxBatchSize)
-			} else {
-				select {
-				case outgoing <- batch:
-					tot_batch += 1
-					batch = make([]Request, 0, maxBatchSize)
-				case reqs := <-incoming:
-					batch = append(batch, reqs...)
-				}
-			}
-		} else {
-			reqs := <-incoming
-			batch = append(batch, reqs...)
-		}
-
-		if tot_batch%200 == 0 {
-			statsChan <- Stats{
-				Keys: []string{"tot-batch"},
-				Vals: []int64{tot_batch},
-			}
-			tot_batch = int64(0)
-		}
-	}
-}
-
 type Requests struct {
 	reqs   []Request
 	sortBy func(bucket string, key []byte) int
@@ -200,7 +552,9 @@ func (r *Requests) Swap(i, j int) {
 }
 
 // Sorts requests by bucket, and then by caller-supplied func results.
-// The func usually does a vbucketId hash on the key.
+// The func usually does a vbucketId hash on the key.  The sort is
+// stable, so that pipelined requests on the same key, like a set and
+// then a get, keep their order.
 func SortRequests(reqs []Request, sortBy func(string, []byte) int) {
-	sort.Sort(&Requests{reqs: reqs, sortBy: sortBy})
+	sort.Stable(&Requests{reqs: reqs, sortBy: sortBy})
 }
@@ -0,0 +1,40 @@
+package grouter
+
+import (
+	"testing"
+
+	"github.com/dustin/gomemcached"
+)
+
+func TestSortRequestsStable(t *testing.T) {
+	tests := []struct {
+		reqs []string // Of bucket/key/opaque.
+		exp  []uint32 // Opaques, in sorted order.
+	}{
+		{[]string{}, []uint32{}},
+		{[]string{"a/x/0", "a/x/1", "a/x/2"}, []uint32{0, 1, 2}},
+		{[]string{"a/y/0", "a/x/1", "a/y/2", "a/x/3"}, []uint32{1, 3, 0, 2}},
+		{[]string{"b/x/0", "a/y/1", "b/x/2", "a/y/3"}, []uint32{1, 3, 0, 2}},
+	}
+	for i, test := range tests {
+		reqs := make([]Request, len(test.reqs))
+		for j, s := range test.reqs {
+			reqs[j] = Request{
+				Bucket: s[0:1],
+				Req: &gomemcached.MCRequest{
+					Key:    []byte(s[2:3]),
+					Opaque: uint32(s[4] - '0'),
+				},
+			}
+		}
+		SortRequests(reqs, func(bucket string, key []byte) int {
+			return int(key[0])
+		})
+		for j, req := range reqs {
+			if req.Req.Opaque != test.exp[j] {
+				t.Errorf("test %v: expected opaque %v at %v, got %v",
+					i, test.exp[j], j, req.Req.Opaque)
+			}
+		}
+	}
+}
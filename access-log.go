@@ -0,0 +1,240 @@
+package grouter
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// An entry of the access log, written as a line of JSON.
+type AccessLogEntry struct {
+	Time      string `json:"ts"`
+	Client    string `json:"client"`
+	Bucket    string `json:"bucket"`
+	Opcode    string `json:"opcode"`
+	Key       string `json:"key,omitempty"`
+	KeyLen    int    `json:"key_len"`
+	ValueSize int    `json:"value_size"`
+	Status    string `json:"status"`
+	Usecs     int64  `json:"latency_usecs"`
+}
+
+// An access log of sampled requests, written as JSON lines to a file
+// that's rotated by size.  Entries are written by a separate goroutine
+// so that requests never wait on the file; when the goroutine falls
+// behind, or the file can't be reopened after a failed rotation,
+// entries are dropped and counted instead.
+type AccessLog struct {
+	path     string
+	sample   float64
+	keys     string // One of AccessLogKeyModes.
+	maxBytes int64
+	maxFiles int
+
+	m       sync.RWMutex // Protects closed, which is set when entries is closed.
+	closed  bool
+	entries chan *AccessLogEntry
+	done    chan bool
+
+	tot_entries   *StatsCounter
+	tot_dropped   *StatsCounter
+	tot_rotations *StatsCounter
+}
+
+// How keys are written to the access log: as is, as a hash (so that
+// hot keys can still be correlated), or not at all.
+var AccessLogKeyModes = []string{"plain", "hash", "redact"}
+
+// Access logs are shared by path, such as by all the conns of a source.
+var accessLogs = struct {
+	m    sync.Mutex
+	logs map[string]*AccessLog
+}{logs: make(map[string]*AccessLog)}
+
+// Returns the access log for the params' AccessLog path, opening it
+// on first use, or nil when the params have no access log.
+func AccessLogOpen(params Params, stats *Stats) (*AccessLog, error) {
+	if params.AccessLog == "" {
+		return nil, nil
+	}
+
+	accessLogs.m.Lock()
+	defer accessLogs.m.Unlock()
+
+	if a := accessLogs.logs[params.AccessLog]; a != nil {
+		return a, nil
+	}
+
+	f, size, err := accessLogOpenFile(params.AccessLog)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &AccessLog{
+		path:          params.AccessLog,
+		sample:        params.AccessLogSample,
+		keys:          params.AccessLogKeys,
+		maxBytes:      params.AccessLogMaxBytes,
+		maxFiles:      params.AccessLogMaxFiles,
+		entries:       make(chan *AccessLogEntry, 1000),
+		done:          make(chan bool),
+		tot_entries:   stats.Counter("tot-access-log-entries"),
+		tot_dropped:   stats.Counter("tot-access-log-dropped"),
+		tot_rotations: stats.Counter("tot-access-log-rotations"),
+	}
+	go a.run(f, size)
+
+	accessLogs.logs[params.AccessLog] = a
+	return a, nil
+}
+
+// Flushes and closes all the access logs, such as on shutdown, after
+// the sources are done.
+func AccessLogsClose() {
+	accessLogs.m.Lock()
+	defer accessLogs.m.Unlock()
+
+	for path, a := range accessLogs.logs {
+		a.m.Lock()
+		a.closed = true
+		close(a.entries)
+		a.m.Unlock()
+		<-a.done
+		delete(accessLogs.logs, path)
+	}
+}
+
+func accessLogOpenFile(path string) (*os.File, int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not open access log: %v; err: %v",
+			path, err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, fi.Size(), nil
+}
+
+// Returns true if a request should be logged, per the sampling rate.
+func (a *AccessLog) Sampled() bool {
+	return a.sample >= 1.0 || (a.sample > 0 && rand.Float64() < a.sample)
+}
+
+// Queues an entry, filling in its key per the key mode, or drops the
+// entry when the queue is full or the log is closed, such as when a
+// conn that was given up on during shutdown finishes its request.
+func (a *AccessLog) Log(e *AccessLogEntry, key []byte) {
+	e.KeyLen = len(key)
+	switch a.keys {
+	case "plain":
+		e.Key = string(key)
+	case "hash":
+		h := sha1.Sum(key)
+		e.Key = hex.EncodeToString(h[:8])
+	}
+
+	a.m.RLock()
+	if !a.closed {
+		select {
+		case a.entries <- e:
+			a.m.RUnlock()
+			return
+		default:
+		}
+	}
+	a.m.RUnlock()
+	a.tot_dropped.Add(1)
+}
+
+// How long the access log waits after failing to open its file before
+// trying again.
+const accessLogRetryWait = time.Second
+
+// Writes the queued entries.  When the file can't be reopened after a
+// rotation, the entries are dropped until a retry succeeds, at most
+// every accessLogRetryWait.
+func (a *AccessLog) run(f *os.File, size int64) {
+	defer close(a.done)
+
+	var err error
+	var retryAt time.Time
+
+	w := bufio.NewWriter(f)
+	for e := range a.entries {
+		if f == nil {
+			if time.Now().Before(retryAt) {
+				a.tot_dropped.Add(1)
+				continue
+			}
+			f, size, err = accessLogOpenFile(a.path)
+			if err != nil {
+				retryAt = time.Now().Add(accessLogRetryWait)
+				a.tot_dropped.Add(1)
+				continue
+			}
+			log.Printf("access log reopened: %v", a.path)
+			w.Reset(f)
+		}
+
+		b, err := json.Marshal(e)
+		if err != nil {
+			log.Printf("warn: access log could not marshal entry; err: %v", err)
+			continue
+		}
+		b = append(b, '\n')
+
+		if a.maxBytes > 0 && size > 0 && size+int64(len(b)) > a.maxBytes {
+			w.Flush()
+			f.Close()
+			f, size, err = a.rotate()
+			if err != nil {
+				log.Printf("error: access log rotation failed,"+
+					" dropping entries until it's reopened; err: %v", err)
+				f = nil
+				retryAt = time.Now().Add(accessLogRetryWait)
+				a.tot_dropped.Add(1)
+				continue
+			}
+			w.Reset(f)
+			a.tot_rotations.Add(1)
+		}
+
+		w.Write(b)
+		size += int64(len(b))
+		a.tot_entries.Add(1)
+
+		if len(a.entries) <= 0 {
+			w.Flush()
+		}
+	}
+	if f != nil {
+		w.Flush()
+		f.Close()
+	}
+}
+
+// Renames path.N-1 to path.N and so on, and the current file to
+// path.1, dropping the oldest file, and then opens a fresh file.
+func (a *AccessLog) rotate() (*os.File, int64, error) {
+	if a.maxFiles > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", a.path, a.maxFiles))
+		for i := a.maxFiles - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", a.path, i),
+				fmt.Sprintf("%s.%d", a.path, i+1))
+		}
+		os.Rename(a.path, a.path+".1")
+	} else {
+		os.Remove(a.path)
+	}
+	return accessLogOpenFile(a.path)
+}
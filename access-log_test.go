@@ -0,0 +1,74 @@
+package grouter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Waits for a counter of the access log's goroutine to reach n.
+func accessLogTestWait(t *testing.T, what string, c *StatsCounter, n int64) {
+	for i := 0; c.Get() < n; i++ {
+		if i > 200 {
+			t.Fatalf("expected %v %v, got %v", n, what, c.Get())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAccessLogRotateFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grouter")
+	if err != nil {
+		t.Fatalf("tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Every entry after the first rotates the log.
+	logDir := filepath.Join(dir, "logs")
+	os.Mkdir(logDir, 0755)
+	path := filepath.Join(logDir, "access.log")
+	a, err := AccessLogOpen(Params{
+		AccessLog:         path,
+		AccessLogSample:   1.0,
+		AccessLogKeys:     "plain",
+		AccessLogMaxBytes: 1,
+		AccessLogMaxFiles: 1,
+	}, NewStats())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	a.Log(&AccessLogEntry{Opcode: "get"}, []byte("a"))
+	accessLogTestWait(t, "entries", a.tot_entries, 1)
+
+	// The rotation fails, as the log's directory is gone, so the
+	// entry's dropped, but the log keeps going.
+	os.RemoveAll(logDir)
+	a.Log(&AccessLogEntry{Opcode: "get"}, []byte("b"))
+	accessLogTestWait(t, "dropped", a.tot_dropped, 1)
+
+	os.Mkdir(logDir, 0755)
+	time.Sleep(accessLogRetryWait)
+	a.Log(&AccessLogEntry{Opcode: "get"}, []byte("c"))
+	accessLogTestWait(t, "entries", a.tot_entries, 2)
+
+	AccessLogsClose()
+
+	// A conn that was given up on during shutdown might still log its
+	// request, which is dropped.
+	a.Log(&AccessLogEntry{Opcode: "get"}, []byte("d"))
+	if n := a.tot_dropped.Get(); n != 2 {
+		t.Errorf("expected 2 dropped, got %v", n)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !strings.Contains(string(b), `"key":"c"`) {
+		t.Errorf("expected the reopened log to have key c, got %q", b)
+	}
+}
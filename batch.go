@@ -0,0 +1,187 @@
+package grouter
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// How BatchRequests batches requests for a target worker.  A batch is
+// sent as soon as the worker is ready for it, unless the batch is still
+// lingering, waiting for more requests.  A batch has at most MaxSize
+// requests and MaxBytes, except for a single request that's larger,
+// so a client's pipeline of requests might be split across batches.
+// A full batch is sent without lingering, waiting for the worker if
+// needed.
+type BatchPolicy struct {
+	MaxSize  int
+	MaxBytes int           // Of request keys, extras and bodies; 0 means no max.
+	Linger   time.Duration // Max time a batch waits for more requests.
+
+	// When adaptive, a batch lingers for a quarter of the backend's
+	// recent round trips, up to Linger, so that batches grow as the
+	// backend slows down, adding a bounded fraction of latency.
+	Adaptive bool
+
+	rtt int64 // Moving average of the worker's batches, in usecs, atomic.
+}
+
+func NewBatchPolicy(params Params) *BatchPolicy {
+	maxSize := params.TargetBatchSize
+	if maxSize <= 0 {
+		maxSize = params.TargetChanSize
+	}
+	if maxSize <= 0 {
+		maxSize = 1
+	}
+	return &BatchPolicy{
+		MaxSize:  maxSize,
+		MaxBytes: params.TargetBatchBytes,
+		Linger:   params.TargetBatchLinger,
+		Adaptive: params.TargetBatchAdaptive,
+	}
+}
+
+// Called by a target worker with the time it took to process a batch.
+// Only the worker calls Observe(), so there's just one writer.
+func (p *BatchPolicy) Observe(d time.Duration) {
+	usecs := d.Nanoseconds() / 1000
+	rtt := atomic.LoadInt64(&p.rtt)
+	if rtt <= 0 {
+		rtt = usecs
+	} else {
+		rtt = rtt + (usecs-rtt)/8
+	}
+	atomic.StoreInt64(&p.rtt, rtt)
+}
+
+// Returns how long a new batch should linger for more requests.
+func (p *BatchPolicy) LingerTime() time.Duration {
+	if !p.Adaptive {
+		return p.Linger
+	}
+	linger := time.Duration(atomic.LoadInt64(&p.rtt)/4) * time.Microsecond
+	if linger > p.Linger {
+		linger = p.Linger
+	}
+	return linger
+}
+
+func batchRequestBytes(req Request) int {
+	return len(req.Req.Key) + len(req.Req.Extras) + len(req.Req.Body)
+}
+
+// Batch up requests from the incoming channel to feed to the outgoing
+// channel, per the batch policy.  When the incoming channel is closed,
+// sends any remaining batch and closes the outgoing channel.  Batches
+// are counted by why they were sent, and their sizes are recorded in
+// the batch-size and batch-bytes histograms.
+func BatchRequests(policy *BatchPolicy, incoming chan []Request,
+	outgoing chan []Request, stats *Stats) {
+	defer close(outgoing)
+
+	tot_batch := map[string]*StatsCounter{
+		"ready": stats.Counter("tot-batch", "reason", "ready"),
+		"size":  stats.Counter("tot-batch", "reason", "size"),
+		"bytes": stats.Counter("tot-batch", "reason", "bytes"),
+		"close": stats.Counter("tot-batch", "reason", "close"),
+	}
+	batch_size := stats.Histogram("batch-size")
+	batch_bytes := stats.Histogram("batch-bytes")
+
+	batch := make([]Request, 0, policy.MaxSize)
+	bytes := 0
+
+	var linger *time.Timer
+	var lingerC <-chan time.Time // Non-nil while the batch is lingering.
+
+	// Incoming requests that didn't fit in the batch, which are added
+	// to the next batch, before any more incoming requests.
+	var pending []Request
+
+	add := func(reqs []Request) {
+		if len(batch) <= 0 {
+			if d := policy.LingerTime(); d > 0 {
+				linger = time.NewTimer(d)
+				lingerC = linger.C
+			}
+		}
+		for len(reqs) > 0 && len(batch) < policy.MaxSize {
+			n := batchRequestBytes(reqs[0])
+			if policy.MaxBytes > 0 && len(batch) > 0 && bytes+n > policy.MaxBytes {
+				break
+			}
+			batch = append(batch, reqs[0])
+			bytes += n
+			reqs = reqs[1:]
+		}
+		pending = reqs
+	}
+
+	sent := func(reason string) {
+		tot_batch[reason].Add(1)
+		batch_size.Record(int64(len(batch)))
+		batch_bytes.Record(int64(bytes))
+		batch = make([]Request, 0, policy.MaxSize)
+		bytes = 0
+		if linger != nil {
+			linger.Stop()
+			linger, lingerC = nil, nil
+		}
+	}
+
+	for {
+		if len(batch) <= 0 {
+			if len(pending) > 0 {
+				add(pending)
+				continue
+			}
+			reqs, ok := <-incoming
+			if !ok {
+				return
+			}
+			batchRequestsDequeued(reqs)
+			add(reqs)
+		} else if len(batch) >= policy.MaxSize {
+			outgoing <- batch
+			sent("size")
+		} else if len(pending) > 0 ||
+			(policy.MaxBytes > 0 && bytes >= policy.MaxBytes) {
+			outgoing <- batch
+			sent("bytes")
+		} else {
+			// While lingering, the batch isn't offered to the worker.
+			var out chan []Request
+			if lingerC == nil {
+				out = outgoing
+			}
+			select {
+			case <-lingerC:
+				lingerC = nil
+			case out <- batch:
+				sent("ready")
+			case reqs, ok := <-incoming:
+				if !ok {
+					outgoing <- batch
+					sent("close")
+					return
+				}
+				batchRequestsDequeued(reqs)
+				add(reqs)
+			}
+		}
+	}
+}
+
+// Ends the target.queue span of traced requests, so that the time they
+// wait for their batch to be sent is a separate target.batch span.
+func batchRequestsDequeued(reqs []Request) {
+	now := time.Time{}
+	for _, req := range reqs {
+		if req.Trace != nil {
+			if now.IsZero() {
+				now = time.Now()
+			}
+			req.Trace.Span("target.queue", now)
+		}
+	}
+}
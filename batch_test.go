@@ -0,0 +1,86 @@
+package grouter
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/dustin/gomemcached"
+)
+
+func TestBatchRequestsLimits(t *testing.T) {
+	tests := []struct {
+		maxSize  int
+		maxBytes int
+		incoming []int // Sizes of the incoming slices of requests.
+		vals     int   // Value bytes of each request.
+	}{
+		{1, 0, []int{3, 1, 2}, 0},
+		{2, 0, []int{100}, 0},
+		{5, 0, []int{100, 7, 1, 1, 1}, 0},
+		{100, 30, []int{100}, 8},
+		{100, 30, []int{3, 50, 2}, 8},
+		{4, 30, []int{10, 10}, 8},
+		{100, 10, []int{5}, 50}, // Each request is larger than MaxBytes.
+	}
+	for i, test := range tests {
+		policy := &BatchPolicy{MaxSize: test.maxSize, MaxBytes: test.maxBytes}
+		stats := NewStats()
+		incoming := make(chan []Request, len(test.incoming))
+		outgoing := make(chan []Request)
+
+		n := 0
+		for _, size := range test.incoming {
+			reqs := make([]Request, size)
+			for j := range reqs {
+				reqs[j].Req = &gomemcached.MCRequest{
+					Opcode: gomemcached.SET,
+					Key:    []byte(strconv.Itoa(n)),
+					Body:   make([]byte, test.vals),
+				}
+				n++
+			}
+			incoming <- reqs
+		}
+		close(incoming)
+		go BatchRequests(policy, incoming, outgoing, stats)
+
+		next, batches := 0, 0
+		for batch := range outgoing {
+			batches++
+			if len(batch) <= 0 || len(batch) > test.maxSize {
+				t.Errorf("test %v: batch of %v requests, expected 1 to %v",
+					i, len(batch), test.maxSize)
+			}
+			bytes := 0
+			for _, req := range batch {
+				bytes += batchRequestBytes(req)
+				if string(req.Req.Key) != strconv.Itoa(next) {
+					t.Errorf("test %v: expected request %v, got %s",
+						i, next, req.Req.Key)
+				}
+				next++
+			}
+			if test.maxBytes > 0 && len(batch) > 1 && bytes > test.maxBytes {
+				t.Errorf("test %v: batch of %v bytes, expected at most %v",
+					i, bytes, test.maxBytes)
+			}
+		}
+		if next != n {
+			t.Errorf("test %v: expected %v requests, got %v", i, n, next)
+		}
+
+		// Every batch is counted, including the last one, which might
+		// have been sent as the incoming channel was closed.
+		tot := int64(0)
+		for _, reason := range []string{"ready", "size", "bytes", "close"} {
+			tot += stats.Counter("tot-batch", "reason", reason).Get()
+		}
+		if tot != int64(batches) {
+			t.Errorf("test %v: expected tot-batch %v, got %v", i, batches, tot)
+		}
+		if c := stats.Histogram("batch-size").Snapshot().Count; c != int64(batches) {
+			t.Errorf("test %v: expected batch-size count %v, got %v",
+				i, batches, c)
+		}
+	}
+}
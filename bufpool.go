@@ -0,0 +1,65 @@
+package grouter
+
+// Pooled byte buffers, shared by the sources and targets, so that the
+// keys and values of requests don't need fresh allocations.  Buffers
+// come in power of 2 size classes, from 64 bytes up to 1MB; larger
+// buffers are allocated and garbage collected as usual.  Each size
+// class keeps up to bufPoolClassBytes of free buffers, in a buffered
+// channel, so an idle pool holds a bounded amount of memory.
+//
+// A buffer must only be put back once nothing refers to it, such as
+// when a request that uses it has been responded to.  Targets must
+// copy any request keys or values that they keep, as they might be
+// in pooled buffers.
+const bufPoolMinShift = 6
+const bufPoolMaxShift = 20
+const bufPoolClassBytes = 4 * 1024 * 1024
+
+var bufPools = bufPoolsMake()
+
+func bufPoolsMake() []chan []byte {
+	rv := make([]chan []byte, bufPoolMaxShift-bufPoolMinShift+1)
+	for c := range rv {
+		rv[c] = make(chan []byte, bufPoolClassBytes>>uint(bufPoolMinShift+c))
+	}
+	return rv
+}
+
+func bufPoolClass(n int) int {
+	c := 0
+	for (1 << uint(bufPoolMinShift+c)) < n {
+		c++
+	}
+	return c
+}
+
+// Returns a buffer of length n, which might hold old data.
+func BufGet(n int) []byte {
+	if n > 1<<bufPoolMaxShift {
+		return make([]byte, n)
+	}
+	c := bufPoolClass(n)
+	select {
+	case b := <-bufPools[c]:
+		return b[:n]
+	default:
+		return make([]byte, n, 1<<uint(bufPoolMinShift+c))
+	}
+}
+
+// Returns a buffer from BufGet() to its pool.  Other buffers, whose
+// capacity isn't a size class, are left to the garbage collector, as
+// are buffers when their class already has enough free buffers.
+func BufPut(b []byte) {
+	if cap(b) > 1<<bufPoolMaxShift {
+		return
+	}
+	c := bufPoolClass(cap(b))
+	if cap(b) != 1<<uint(bufPoolMinShift+c) {
+		return
+	}
+	select {
+	case bufPools[c] <- b[:0]:
+	default:
+	}
+}
@@ -0,0 +1,52 @@
+package grouter
+
+import (
+	"testing"
+)
+
+func TestBufPoolClass(t *testing.T) {
+	tests := []struct {
+		n     int
+		class int
+	}{
+		{0, 0},
+		{1, 0},
+		{64, 0},
+		{65, 1},
+		{128, 1},
+		{129, 2},
+		{1 << 20, bufPoolMaxShift - bufPoolMinShift},
+	}
+	for _, test := range tests {
+		if c := bufPoolClass(test.n); c != test.class {
+			t.Errorf("bufPoolClass(%v): expected %v, got %v", test.n, test.class, c)
+		}
+	}
+}
+
+func TestBufGetPut(t *testing.T) {
+	tests := []struct {
+		n      int
+		expCap int
+	}{
+		{1, 64},
+		{100, 128},
+		{4096, 4096},
+		{1<<20 + 1, 1<<20 + 1},
+	}
+	for _, test := range tests {
+		b := BufGet(test.n)
+		if len(b) != test.n || cap(b) != test.expCap {
+			t.Errorf("BufGet(%v): expected len %v, cap %v, got len %v, cap %v",
+				test.n, test.n, test.expCap, len(b), cap(b))
+		}
+		BufPut(b)
+	}
+}
+
+func BenchmarkBufGet(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		BufPut(BufGet(100))
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/steveyen/grouter"
+)
+
+// The admin HTTP server's view of a running grouter.
+type Admin struct {
+	Stats   *grouter.Stats
+	Reload  func() error // Reloads the targets.
+	Quit    chan bool    // Closed when grouter is shutting down.
+	Targets map[string]*grouter.SwapTarget
+	HotKeys *grouter.HotKeys // Nil when hot key tracking is disabled.
+
+	m   sync.Mutex // Protects cfg.
+	cfg *Config
+}
+
+func (a *Admin) SetConfig(cfg *Config) {
+	a.m.Lock()
+	a.cfg = cfg
+	a.m.Unlock()
+}
+
+func (a *Admin) Config() *Config {
+	a.m.Lock()
+	defer a.m.Unlock()
+	return a.cfg
+}
+
+// Listens on addr and serves the admin REST endpoints...
+//
+//	GET  /api/stats   - all the current stats and latency percentiles.
+//	GET  /api/sources - spec, target, params and stats of each source.
+//	GET  /api/targets - spec, params and stats of each target.
+//	GET  /api/params  - the effective params, including each endpoint's.
+//	GET  /api/hotkeys - most frequent keys and largest values per bucket;
+//	                    ?n=N limits the entries (default 10; 0 is all).
+//	GET  /api/health  - 200 while grouter is running.
+//	GET  /api/ready   - 200 while serving requests; 503 on shutdown.
+//	POST /api/reload  - reloads the targets, like SIGHUP.
+//	GET  /api/flush_all - whether the flush_all command is allowed.
+//	POST /api/flush_all - ?enabled=true|false allows or disallows it.
+//	GET  /metrics     - the stats in prometheus text format.
+func AdminStart(addr string, a *Admin) error {
+	ls, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/stats", func(w http.ResponseWriter, r *http.Request) {
+		hists := make(map[string]map[string]int64)
+		for k, h := range a.Stats.Histograms() {
+			hists[k] = h.Summary()
+		}
+		adminJSON(w, http.StatusOK, map[string]interface{}{
+			"stats":      a.Stats.Snapshot(),
+			"histograms": hists,
+		})
+	})
+	mux.HandleFunc("/api/sources", func(w http.ResponseWriter, r *http.Request) {
+		cfg := a.Config()
+		stats := AdminStatsByName(a.Stats.Snapshot())
+		rv := make(map[string]interface{})
+		for name, s := range cfg.Sources {
+			rv[name] = map[string]interface{}{
+				"spec":   s.Spec,
+				"target": s.Target,
+				"params": AdminParams(s.Params),
+				"stats":  stats[name],
+			}
+		}
+		adminJSON(w, http.StatusOK, rv)
+	})
+	mux.HandleFunc("/api/targets", func(w http.ResponseWriter, r *http.Request) {
+		cfg := a.Config()
+		stats := AdminStatsByName(a.Stats.Snapshot())
+		rv := make(map[string]interface{})
+		for name, t := range cfg.Targets {
+			info := map[string]interface{}{
+				"spec":   t.Spec,
+				"params": AdminParams(t.Params),
+				"stats":  stats[name],
+			}
+			if swapTarget := a.Targets[name]; swapTarget != nil {
+				info["queues"] = map[string]interface{}{
+					"depths":   swapTarget.QueueLens(),
+					"capacity": swapTarget.QueueCap(),
+				}
+			}
+			rv[name] = info
+		}
+		adminJSON(w, http.StatusOK, rv)
+	})
+	mux.HandleFunc("/api/params", func(w http.ResponseWriter, r *http.Request) {
+		cfg := a.Config()
+		sources := make(map[string]interface{})
+		for name, s := range cfg.Sources {
+			sources[name] = AdminParams(s.Params)
+		}
+		targets := make(map[string]interface{})
+		for name, t := range cfg.Targets {
+			targets[name] = AdminParams(t.Params)
+		}
+		adminJSON(w, http.StatusOK, map[string]interface{}{
+			"params":  AdminParams(cfg.Params),
+			"sources": sources,
+			"targets": targets,
+		})
+	})
+	mux.HandleFunc("/api/hotkeys", func(w http.ResponseWriter, r *http.Request) {
+		if a.HotKeys == nil {
+			adminJSON(w, http.StatusNotFound,
+				map[string]interface{}{"error": "hot-keys tracking is disabled"})
+			return
+		}
+		n := 10
+		if s := r.FormValue("n"); s != "" {
+			var err error
+			if n, err = strconv.Atoi(s); err != nil || n < 0 {
+				adminJSON(w, http.StatusBadRequest,
+					map[string]interface{}{"error": "n should be an int >= 0"})
+				return
+			}
+		}
+		adminJSON(w, http.StatusOK, a.HotKeys.Report(n))
+	})
+	mux.HandleFunc("/api/health", func(w http.ResponseWriter, r *http.Request) {
+		adminJSON(w, http.StatusOK, map[string]interface{}{"status": "ok"})
+	})
+	mux.HandleFunc("/api/ready", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-a.Quit:
+			adminJSON(w, http.StatusServiceUnavailable,
+				map[string]interface{}{"ready": false})
+		default:
+			adminJSON(w, http.StatusOK, map[string]interface{}{"ready": true})
+		}
+	})
+	mux.HandleFunc("/api/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			adminJSON(w, http.StatusMethodNotAllowed,
+				map[string]interface{}{"error": "expected POST"})
+			return
+		}
+		if err := a.Reload(); err != nil {
+			adminJSON(w, http.StatusInternalServerError,
+				map[string]interface{}{"error": err.Error()})
+			return
+		}
+		adminJSON(w, http.StatusOK, map[string]interface{}{"status": "ok"})
+	})
+	mux.HandleFunc("/api/flush_all", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+			if err != nil {
+				adminJSON(w, http.StatusBadRequest,
+					map[string]interface{}{"error": "enabled should be true or false"})
+				return
+			}
+			grouter.FlushAllEnable(enabled)
+			log.Printf("admin: flush_all enabled: %v", enabled)
+		}
+		adminJSON(w, http.StatusOK,
+			map[string]interface{}{"enabled": grouter.FlushAllEnabled()})
+	})
+	mux.HandleFunc("/metrics", MetricsHandler(a))
+
+	log.Printf("admin listening to: %s", addr)
+	go func() {
+		log.Printf("error: admin server stopped; err: %v", http.Serve(ls, mux))
+	}()
+	return nil
+}
+
+// Groups stats by their name prefix, so that "src0/tot-ops" becomes
+// "tot-ops" under "src0".  Stats without a name prefix are skipped.
+func AdminStatsByName(stats map[string]int64) map[string]map[string]int64 {
+	rv := make(map[string]map[string]int64)
+	for k, v := range stats {
+		i := strings.Index(k, "/")
+		if i < 0 {
+			continue
+		}
+		name := k[:i]
+		if rv[name] == nil {
+			rv[name] = make(map[string]int64)
+		}
+		rv[name][k[i+1:]] = v
+	}
+	return rv
+}
+
+// Returns params keyed by their command-line flag names.
+func AdminParams(p grouter.Params) map[string]string {
+	rv := make(map[string]string)
+	paramsFlagSet(&p).VisitAll(func(f *flag.Flag) {
+		rv[f.Name] = f.Value.String()
+	})
+	return rv
+}
+
+func adminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/steveyen/grouter"
+)
+
+// A config describes named sources and targets, and how they're wired
+// together (see config.json).  Every source and target has its own
+// params, which start as a copy of the config's params and are then
+// overridden by the endpoint's own params.  The params use the same
+// names as the command-line flags, which provide the defaults.
+type Config struct {
+	Params  grouter.Params
+	Sources map[string]*SourceConfig
+	Targets map[string]*TargetConfig
+}
+
+type SourceConfig struct {
+	Spec   string
+	Target string // Name of the target that the source sends requests to.
+	Params grouter.Params
+}
+
+type TargetConfig struct {
+	Spec   string
+	Params grouter.Params
+}
+
+// Collects all the problems found in a config, so a user can fix them
+// in one pass instead of one error at a time.
+type ConfigError struct {
+	Path string
+	Errs []string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid config: %v\n  %v", e.Path,
+		strings.Join(e.Errs, "\n  "))
+}
+
+func (e *ConfigError) Add(where string, format string, args ...interface{}) {
+	if where != "" {
+		format = where + ": " + format
+	}
+	e.Errs = append(e.Errs, fmt.Sprintf(format, args...))
+}
+
+var configNameRE = regexp.MustCompile(`^[a-zA-Z0-9_.\-]+$`)
+
+// Reads a JSON config file, where base provides the default params.
+func ReadConfigFile(path string, base grouter.Params) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config: %v; err: %v", path, err)
+	}
+	var data interface{}
+	err = json.Unmarshal(b, &data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse json config: %v; err: %v",
+			path, err)
+	}
+	return ParseConfig(path, data, base)
+}
+
+// Validates and converts parsed JSON into a config.
+func ParseConfig(path string, data interface{},
+	base grouter.Params) (*Config, error) {
+	errs := &ConfigError{Path: path}
+
+	top, ok := data.(map[string]interface{})
+	if !ok {
+		errs.Add("", "expected a JSON object at the top level")
+		return nil, errs
+	}
+	checkKeys(errs, "", top, "params", "sources", "targets")
+
+	cfg := &Config{
+		Params:  base,
+		Sources: make(map[string]*SourceConfig),
+		Targets: make(map[string]*TargetConfig),
+	}
+	if top["params"] != nil {
+		setParams(errs, "params", top["params"], &cfg.Params)
+	}
+	checkParams(errs, "params", cfg.Params)
+
+	targetsObj := configObject(errs, "targets", top["targets"])
+	for _, name := range sortedKeys(targetsObj) {
+		where := "targets." + name
+		obj := configObject(errs, where, targetsObj[name])
+		if obj == nil {
+			continue
+		}
+		checkName(errs, where, name)
+		checkKeys(errs, where, obj, "spec", "params")
+
+		t := &TargetConfig{
+			Spec:   configSpec(errs, where, obj, targets),
+			Params: cfg.Params,
+		}
+		t.Params.TargetSpec = t.Spec
+		if obj["params"] != nil {
+			setParams(errs, where+".params", obj["params"], &t.Params)
+			checkParams(errs, where+".params", t.Params)
+		}
+		cfg.Targets[name] = t
+	}
+
+	sourcesObj := configObject(errs, "sources", top["sources"])
+	for _, name := range sortedKeys(sourcesObj) {
+		where := "sources." + name
+		obj := configObject(errs, where, sourcesObj[name])
+		if obj == nil {
+			continue
+		}
+		checkName(errs, where, name)
+		checkKeys(errs, where, obj, "spec", "target", "params")
+		if cfg.Targets[name] != nil {
+			// Stats are prefixed by source and target names.
+			errs.Add(where, "name is already used by a target")
+		}
+
+		s := &SourceConfig{
+			Spec:   configSpec(errs, where, obj, sources),
+			Params: cfg.Params,
+		}
+		if targetName, ok := obj["target"].(string); !ok {
+			errs.Add(where, "missing \"target\", the name of a target")
+		} else if cfg.Targets[targetName] == nil {
+			errs.Add(where, "unknown target: %q", targetName)
+		} else {
+			s.Target = targetName
+			s.Params.TargetSpec = cfg.Targets[targetName].Spec
+		}
+		s.Params.SourceSpec = s.Spec
+		if obj["params"] != nil {
+			setParams(errs, where+".params", obj["params"], &s.Params)
+			checkParams(errs, where+".params", s.Params)
+		}
+		cfg.Sources[name] = s
+	}
+
+	if len(errs.Errs) > 0 {
+		return nil, errs
+	}
+	return cfg, nil
+}
+
+// Returns a config with a single source and target, named "source"
+// and "target", from the command-line params and optional target file.
+func FlagsConfig(params grouter.Params, targetFile string) (*Config, error) {
+	if targetFile != "" {
+		spec, err := ReadTargetFile(targetFile)
+		if err != nil {
+			return nil, err
+		}
+		params.TargetSpec = spec
+	}
+	return ParseConfig("command-line", map[string]interface{}{
+		"targets": map[string]interface{}{
+			"target": map[string]interface{}{
+				"spec": params.TargetSpec,
+			},
+		},
+		"sources": map[string]interface{}{
+			"source": map[string]interface{}{
+				"spec":   params.SourceSpec,
+				"target": "target",
+			},
+		},
+	}, params)
+}
+
+// Logs a config for debugging/diagnosis.
+func ConfigLog(cfg *Config) {
+	for _, name := range sortedKeys(cfg.Sources) {
+		s := cfg.Sources[name]
+		log.Printf("  source: %v: %v", name, s.Spec)
+		log.Printf("    target: %v", s.Target)
+		paramsLog(s.Params, "source-", "request-timeout", "shutdown-grace",
+			"access-log", "trace-")
+	}
+	for _, name := range sortedKeys(cfg.Targets) {
+		t := cfg.Targets[name]
+		log.Printf("  target: %v: %v", name, t.Spec)
+		paramsLog(t.Params, "target-")
+	}
+}
+
+// Logs the params whose flag names have any of the given prefixes.
+func paramsLog(p grouter.Params, prefixes ...string) {
+	paramsFlagSet(&p).VisitAll(func(f *flag.Flag) {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(f.Name, prefix) {
+				log.Printf("    %v: %v", f.Name, f.Value)
+				return
+			}
+		}
+	})
+}
+
+// Returns a flag set whose flags are bound to the fields of p, leaving
+// the current values of p as they are.
+func paramsFlagSet(p *grouter.Params) *flag.FlagSet {
+	curr := *p
+	fs := flag.NewFlagSet("params", flag.ContinueOnError)
+	ParamsFlags(fs, p) // Also resets p to the defaults.
+	*p = curr
+	return fs
+}
+
+// Overrides the fields of p from a JSON object of params.
+func setParams(errs *ConfigError, where string, v interface{},
+	p *grouter.Params) {
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		errs.Add(where, "expected a JSON object")
+		return
+	}
+	fs := paramsFlagSet(p)
+	for _, name := range sortedKeys(obj) {
+		if name == "source" || name == "target" || fs.Lookup(name) == nil {
+			errs.Add(where, "unknown param: %q", name)
+			continue
+		}
+		var s string
+		switch x := obj[name].(type) {
+		case string:
+			s = x
+		case float64:
+			s = strconv.FormatFloat(x, 'f', -1, 64)
+		case bool:
+			s = strconv.FormatBool(x)
+		default:
+			errs.Add(where, "param %q should be a string, number or boolean",
+				name)
+			continue
+		}
+		if err := fs.Set(name, s); err != nil {
+			errs.Add(where, "invalid value %q for param %q; err: %v",
+				s, name, err)
+		}
+	}
+}
+
+// Checks param values that would make sources or targets misbehave.
+func checkParams(errs *ConfigError, where string, p grouter.Params) {
+	if p.SourceMaxConns <= 0 {
+		errs.Add(where, "source-max-conns should be > 0")
+	}
+	if p.TargetChanSize < 0 {
+		errs.Add(where, "target-chan-size should be >= 0")
+	}
+	if p.TargetConcurrency <= 0 {
+		errs.Add(where, "target-concurrency should be > 0")
+	}
+	if p.TargetBatchSize < 0 || p.TargetBatchBytes < 0 ||
+		p.TargetBatchLinger < 0 {
+		errs.Add(where, "target-batch-size, -bytes and -linger should be >= 0")
+	}
+	if !configOneOf(p.TargetOverload, grouter.TargetOverloadPolicies) {
+		errs.Add(where, "target-overload should be one of: %v",
+			strings.Join(grouter.TargetOverloadPolicies, ", "))
+	}
+	if p.RequestTimeout < 0 || p.SourceRequestTimeout < 0 ||
+		p.ShutdownGrace < 0 {
+		errs.Add(where, "durations should be >= 0")
+	}
+	if p.AccessLogSample < 0 || p.AccessLogSample > 1 {
+		errs.Add(where, "access-log-sample should be between 0 and 1")
+	}
+	if !configOneOf(p.AccessLogKeys, grouter.AccessLogKeyModes) {
+		errs.Add(where, "access-log-keys should be one of: %v",
+			strings.Join(grouter.AccessLogKeyModes, ", "))
+	}
+	if p.AccessLogMaxBytes < 0 || p.AccessLogMaxFiles < 0 {
+		errs.Add(where, "access-log-max-bytes and -max-files should be >= 0")
+	}
+	if p.TraceSample < 0 || p.TraceSample > 1 {
+		errs.Add(where, "trace-sample should be between 0 and 1")
+	}
+	if p.HotKeys < 0 || p.HotKeyThreshold < 0 || p.BigValueThreshold < 0 {
+		errs.Add(where, "hot-keys, hot-key-threshold and"+
+			" big-value-threshold should be >= 0")
+	}
+	if p.RedisMaxBulk <= 0 {
+		errs.Add(where, "redis-max-bulk should be > 0")
+	}
+}
+
+func configOneOf(s string, choices []string) bool {
+	for _, choice := range choices {
+		if s == choice {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the "spec" of an endpoint, checking that it's a known kind.
+func configSpec(errs *ConfigError, where string, obj map[string]interface{},
+	kinds map[string]endPoint) string {
+	spec, ok := obj["spec"].(string)
+	if !ok || spec == "" {
+		errs.Add(where, "missing \"spec\"")
+		return ""
+	}
+	if _, ok := kinds[strings.Split(spec, ":")[0]]; !ok {
+		errs.Add(where, "unknown kind of spec: %q; see -help for examples",
+			spec)
+	}
+	return spec
+}
+
+// Returns a required, non-empty JSON object.
+func configObject(errs *ConfigError, where string,
+	v interface{}) map[string]interface{} {
+	if v == nil {
+		errs.Add(where, "missing")
+		return nil
+	}
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		errs.Add(where, "expected a JSON object")
+		return nil
+	}
+	if len(obj) <= 0 {
+		errs.Add(where, "expected at least 1 entry")
+	}
+	return obj
+}
+
+func checkKeys(errs *ConfigError, where string, obj map[string]interface{},
+	allowed ...string) {
+	for _, k := range sortedKeys(obj) {
+		found := false
+		for _, a := range allowed {
+			found = found || k == a
+		}
+		if !found {
+			errs.Add(where, "unknown field: %q; expected one of: %v",
+				k, strings.Join(allowed, ", "))
+		}
+	}
+}
+
+func checkName(errs *ConfigError, where string, name string) {
+	if !configNameRE.MatchString(name) {
+		errs.Add(where, "names should only use letters, digits, '_', '.' or '-'")
+	}
+}
+
+// Returns the sorted keys of a map with string keys.
+func sortedKeys(m interface{}) []string {
+	var rv []string
+	switch x := m.(type) {
+	case map[string]interface{}:
+		for k := range x {
+			rv = append(rv, k)
+		}
+	case map[string]*SourceConfig:
+		for k := range x {
+			rv = append(rv, k)
+		}
+	case map[string]*TargetConfig:
+		for k := range x {
+			rv = append(rv, k)
+		}
+	}
+	sort.Strings(rv)
+	return rv
+}
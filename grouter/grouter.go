@@ -2,36 +2,48 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
+	"os/signal"
 	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/steveyen/grouter"
 )
 
 type endPoint struct {
-	usage string // Help string.
-	descrip string
-	runSource func(string, grouter.Params, grouter.Target, chan grouter.Stats)
-	startTarget func(string, grouter.Params, chan grouter.Stats) grouter.Target
+	usage          string // Help string.
+	descrip        string
+	runSource      func(string, grouter.Params, grouter.Target, *grouter.Stats, chan bool)
+	startTarget    func(string, grouter.Params, *grouter.Stats) (grouter.Target, error)
 	maxConcurrency int // Some end-points have limited concurrency.
 }
 
 // Available sources of requests.
 var sources = map[string]endPoint{
 	"memcached": endPoint{
-		usage: "memcached:LISTEN_INTERFACE:LISTEN_PORT",
-		descrip: "memcached ascii source",
+		usage:     "memcached:LISTEN_INTERFACE:LISTEN_PORT",
+		descrip:   "memcached ascii source",
 		runSource: grouter.MakeListenSourceFunc(&grouter.AsciiSource{}),
 	},
 	"memcached-ascii": endPoint{
-		usage: "memcached-ascii:LISTEN_INTERFACE:LISTEN_PORT",
-		descrip: "memcached ascii source",
+		usage:     "memcached-ascii:LISTEN_INTERFACE:LISTEN_PORT",
+		descrip:   "memcached ascii source",
 		runSource: grouter.MakeListenSourceFunc(&grouter.AsciiSource{}),
 	},
+	"redis": endPoint{
+		usage:     "redis:LISTEN_INTERFACE:LISTEN_PORT",
+		descrip:   "redis (RESP2) source",
+		runSource: grouter.MakeListenSourceFunc(&grouter.RedisSource{}),
+	},
 	"workload": endPoint{
-		usage: "workload",
-		descrip: "a simple workload generator",
+		usage:     "workload",
+		descrip:   "a simple workload generator",
 		runSource: grouter.WorkLoadRun,
 	},
 }
@@ -39,105 +51,374 @@ var sources = map[string]endPoint{
 // Available targets of requests.
 var targets = map[string]endPoint{
 	"http": endPoint{
-		usage: "http://COUCHBASE_HOST:COUCHBASE_PORT",
-		descrip: "couchbase server as a target",
-        startTarget: grouter.CouchbaseTargetStart,
+		usage:       "http://COUCHBASE_HOST:COUCHBASE_PORT",
+		descrip:     "couchbase server as a target",
+		startTarget: grouter.CouchbaseTargetStart,
 	},
 	"couchbase": endPoint{
-		usage: "couchbase://COUCHBASE_HOST:COUCHBASE_PORT",
-		descrip: "couchbase server as a target",
-        startTarget: grouter.CouchbaseTargetStart,
+		usage:       "couchbase://COUCHBASE_HOST:COUCHBASE_PORT",
+		descrip:     "couchbase server as a target",
+		startTarget: grouter.CouchbaseTargetStart,
 	},
 	"memcached-ascii": endPoint{
-		usage: "memcached-ascii:HOST:PORT",
-		descrip: "memcached (ascii protocol) server as a target",
+		usage:       "memcached-ascii:HOST:PORT",
+		descrip:     "memcached (ascii protocol) server as a target",
 		startTarget: grouter.MemcachedAsciiTargetStart,
 	},
 	"memcached-binary": endPoint{
-		usage: "memcached-binary:HOST:PORT",
-		descrip: "memcached (binary protocol) server as a target",
+		usage:       "memcached-binary:HOST:PORT",
+		descrip:     "memcached (binary protocol) server as a target",
 		startTarget: grouter.MemcachedBinaryTargetStart,
 	},
 	"memory": endPoint{
-		usage: "memory",
-		descrip: "simple in-memory hashtable target",
-		startTarget: grouter.MemoryStorageStart,
+		usage:          "memory",
+		descrip:        "simple in-memory hashtable target",
+		startTarget:    grouter.MemoryStorageStart,
 		maxConcurrency: 1,
 	},
 }
 
-func main() {
-	sourceSpec := flag.String("source", "memcached-ascii::11300",
-        "source of requests\n" +
-        "    as SOURCE_KIND[:MORE_PARAMS]\n" +
-        "    examples..." + endPointExamples(sources))
-	sourceMaxConns := flag.Int("source-max-conns", 100,
+// Registers the flags that correspond to params fields, so that the
+// command-line and the params sections of a config file share the
+// same names, defaults and parsing.
+func ParamsFlags(fs *flag.FlagSet, p *grouter.Params) {
+	fs.StringVar(&p.SourceSpec, "source", "memcached-ascii::11300",
+		"source of requests\n"+
+			"    as SOURCE_KIND[:MORE_PARAMS]\n"+
+			"    examples..."+endPointExamples(sources))
+	fs.IntVar(&p.SourceMaxConns, "source-max-conns", 100,
 		"max conns allowed via source")
 
-	targetSpec := flag.String("target", "memory",
-        "target of requests\n" +
-        "    as TARGET_KIND[:MORE_PARAMS]\n" +
-        "    examples..." + endPointExamples(targets))
-	targetChanSize := flag.Int("target-chan-size", 5,
+	fs.StringVar(&p.TargetSpec, "target", "memory",
+		"target of requests\n"+
+			"    as TARGET_KIND[:MORE_PARAMS]\n"+
+			"    examples..."+endPointExamples(targets))
+	fs.IntVar(&p.TargetChanSize, "target-chan-size", 5,
 		"target chan size to control queuing")
-	targetConcurrency := flag.Int("target-concurrency", 4,
+	fs.IntVar(&p.TargetConcurrency, "target-concurrency", 4,
 		"# of concurrent workers in front of target")
+	fs.StringVar(&p.TargetOverload, "target-overload", "block",
+		"when a target's queue is full: "+
+			strings.Join(grouter.TargetOverloadPolicies, ", ")+";\n"+
+			"    reject and shed-oldest respond with SERVER_ERROR busy")
+	fs.IntVar(&p.TargetBatchSize, "target-batch-size", 0,
+		"max requests per batch to a target; 0 means -target-chan-size")
+	fs.IntVar(&p.TargetBatchBytes, "target-batch-bytes", 0,
+		"max bytes of keys and values per batch to a target, except for a\n"+
+			"    larger request, which is sent alone; 0 means no max")
+	fs.DurationVar(&p.TargetBatchLinger, "target-batch-linger", 0,
+		"max time a batch waits for more requests before it's sent")
+	fs.BoolVar(&p.TargetBatchAdaptive, "target-batch-adaptive", false,
+		"when true, batches linger for a quarter of the target's recent\n"+
+			"    round trip time, up to -target-batch-linger")
+
+	fs.DurationVar(&p.RequestTimeout, "request-timeout", 5*time.Second,
+		"default time before a request times out; 0 means no timeout")
+	fs.DurationVar(&p.SourceRequestTimeout, "source-request-timeout", 0,
+		"when > 0, overrides -request-timeout for requests from source")
+	fs.DurationVar(&p.ShutdownGrace, "shutdown-grace", 10*time.Second,
+		"on SIGTERM, time to wait for in-flight requests before closing conns")
+
+	fs.StringVar(&p.AccessLog, "access-log", "",
+		"optional file for a JSON lines access log of source requests")
+	fs.Float64Var(&p.AccessLogSample, "access-log-sample", 1.0,
+		"fraction of requests to access log, from 0 to 1")
+	fs.StringVar(&p.AccessLogKeys, "access-log-keys", "plain",
+		"how keys are access logged: "+
+			strings.Join(grouter.AccessLogKeyModes, ", "))
+	fs.Int64Var(&p.AccessLogMaxBytes, "access-log-max-bytes", 100*1024*1024,
+		"size at which the access log is rotated; 0 means never")
+	fs.IntVar(&p.AccessLogMaxFiles, "access-log-max-files", 5,
+		"# of rotated access log files to keep")
+
+	fs.IntVar(&p.HotKeys, "hot-keys", 100,
+		"# of most frequent keys and largest values tracked per bucket shard;\n"+
+			"    0 disables hot key tracking")
+	fs.Float64Var(&p.HotKeyThreshold, "hot-key-threshold", 10000,
+		"ops/sec of a key that's logged as a hot key; 0 means never")
+	fs.IntVar(&p.BigValueThreshold, "big-value-threshold", 512*1024,
+		"bytes of a value that's logged as a big value; 0 means never")
+
+	fs.StringVar(&p.TraceExport, "trace-export", "",
+		"optional file, or OTLP/HTTP collector URL like\n"+
+			"    http://localhost:4318/v1/traces, for traces of source requests")
+	fs.Float64Var(&p.TraceSample, "trace-sample", 0.01,
+		"fraction of requests to trace, from 0 to 1")
+
+	fs.IntVar(&p.RedisMaxBulk, "redis-max-bulk", 1024*1024,
+		"max bytes of an arg of a redis command, such as a value")
+
+	fs.BoolVar(&p.FlushAll, "flush-all", true,
+		"allow the flush_all command, which flushes every server behind\n"+
+			"    a target; the admin /api/flush_all endpoint can change it")
+}
+
+func main() {
+	var params grouter.Params
+	ParamsFlags(flag.CommandLine, &params)
+
+	targetFile := flag.String("target-file", "",
+		"optional file holding the target spec, overriding -target;\n"+
+			"    the file is re-read on SIGHUP to reload the target")
+	configFile := flag.String("config", "",
+		"optional JSON config file of named sources and targets,\n"+
+			"    overriding -source, -target and -target-file;\n"+
+			"    the targets are re-read on SIGHUP to reload them")
+	checkConfig := flag.Bool("check-config", false,
+		"validate the config and params, then exit")
+	adminAddr := flag.String("admin-addr", "",
+		"optional HOST:PORT for the admin HTTP server, like :8011,\n"+
+			"    which serves stats, params, health and reload endpoints")
 
 	flag.Parse()
 
-	params := grouter.Params{
-		SourceSpec:        *sourceSpec,
-		SourceMaxConns:    *sourceMaxConns,
-		TargetSpec:        *targetSpec,
-		TargetChanSize:    *targetChanSize,
-		TargetConcurrency: *targetConcurrency,
+	loadConfig := func() (*Config, error) {
+		if *configFile != "" {
+			return ReadConfigFile(*configFile, params)
+		}
+		return FlagsConfig(params, *targetFile)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("error: %v", err)
 	}
 
 	log.Printf("grouter")
-	log.Printf("  source: %v", params.SourceSpec)
-	log.Printf("    source-max-conns: %v", params.SourceMaxConns)
-	log.Printf("  target: %v", params.TargetSpec)
-	log.Printf("    target-chan-size: %v", params.TargetChanSize)
-	log.Printf("    target-concurrency: %v", params.TargetConcurrency)
+	if *configFile != "" {
+		log.Printf("  config: %v", *configFile)
+	} else if *targetFile != "" {
+		log.Printf("  target-file: %v", *targetFile)
+	}
+	ConfigLog(cfg)
+
+	if *checkConfig {
+		log.Printf("config ok")
+		return
+	}
 
-	MainStart(params)
+	MainStart(cfg, loadConfig, *adminAddr)
 }
 
-func MainStart(params grouter.Params) {
-	sourceKind := strings.Split(params.SourceSpec, ":")[0]
-	if sourceDef, ok := sources[sourceKind]; ok {
-		targetKind := strings.Split(params.TargetSpec, ":")[0]
-		if targetDef, ok := targets[targetKind]; ok {
-			if (targetDef.maxConcurrency > 0 &&
-				targetDef.maxConcurrency < params.TargetConcurrency) {
-				params.TargetConcurrency = targetDef.maxConcurrency
-				log.Printf("    target-concurrency clipped to: %v;" +
-					" due to limitations of target kind: %v",
-					params.TargetConcurrency, targetKind)
-			}
-
-			statsChan := grouter.StartStatsReporter(
-				params.SourceMaxConns + params.TargetConcurrency)
-
-			target := targetDef.startTarget(params.TargetSpec, params, statsChan)
-
-			sourceDef.runSource(params.SourceSpec, params, target, statsChan)
-		} else {
-			log.Fatalf("error: unknown target kind: %s", params.TargetSpec)
+func MainStart(cfg *Config, loadConfig func() (*Config, error),
+	adminAddr string) {
+	stats := grouter.NewStats()
+	grouter.StartStatsReporter(stats)
+	hotKeys := grouter.HotKeysStart(cfg.Params, stats, 10*time.Second)
+	grouter.FlushAllEnable(cfg.Params.FlushAll)
+
+	// Sources send to swap targets, so that we can reload the real
+	// targets without disturbing the sources.
+	swapTargets := make(map[string]*grouter.SwapTarget)
+	targetStats := make(map[string]*grouter.Stats)
+	for name, targetCfg := range cfg.Targets {
+		targetStats[name] = stats.Prefix(name + "/")
+		target, err := StartTarget(targetCfg, targetStats[name])
+		if err != nil {
+			log.Fatalf("error: could not start target: %v; err: %v", name, err)
 		}
-	} else {
-		log.Fatalf("error: unknown source kind: %s", params.SourceSpec)
+		swapTargets[name] = grouter.SwapTargetStart(target, targetCfg.Params,
+			targetStats[name])
+	}
+
+	quit := QuitOnSignal(syscall.SIGTERM, os.Interrupt)
+
+	admin := &Admin{Stats: stats, Quit: quit, Targets: swapTargets,
+		HotKeys: hotKeys}
+	admin.SetConfig(cfg)
+
+	reloadM := sync.Mutex{} // Serializes SIGHUP and admin reloads.
+	admin.Reload = func() error {
+		reloadM.Lock()
+		defer reloadM.Unlock()
+		cfg, err := ReloadTargets(admin.Config(), swapTargets,
+			loadConfig, targetStats)
+		admin.SetConfig(cfg)
+		return err
+	}
+
+	OnSignal(func() {
+		if err := admin.Reload(); err != nil {
+			log.Printf("error: %v", err)
+		}
+	}, syscall.SIGHUP)
+
+	if adminAddr != "" {
+		if err := AdminStart(adminAddr, admin); err != nil {
+			log.Fatalf("error: could not start admin: %v; err: %v",
+				adminAddr, err)
+		}
+	}
+
+	// Open the access logs and trace exports up front, so that bad
+	// paths fail fast.
+	for name, sourceCfg := range cfg.Sources {
+		_, err := grouter.AccessLogOpen(sourceCfg.Params, stats.Prefix(name+"/"))
+		if err == nil {
+			_, err = grouter.TraceExporterOpen(sourceCfg.Params,
+				stats.Prefix(name+"/"))
+		}
+		if err != nil {
+			log.Fatalf("error: source: %v; err: %v", name, err)
+		}
+	}
+
+	running := sync.WaitGroup{}
+	for name, sourceCfg := range cfg.Sources {
+		running.Add(1)
+		go func(name string, sourceCfg *SourceConfig) {
+			defer running.Done()
+
+			sourceKind := strings.Split(sourceCfg.Spec, ":")[0]
+			sources[sourceKind].runSource(sourceCfg.Spec, sourceCfg.Params,
+				swapTargets[sourceCfg.Target],
+				stats.Prefix(name+"/"), quit)
+			log.Printf("source done: %v", name)
+		}(name, sourceCfg)
+	}
+	running.Wait()
+	grouter.AccessLogsClose()
+	grouter.TraceExportersClose()
+
+	// The sources are done sending requests, except for any stuck conns
+	// that they gave up on, whose later requests the swap targets
+	// reject, so the targets can now drain their queues and close
+	// backend conns, unless a target is stuck, such as on a hung backend
+	// without request deadlines.
+	closed := make(chan bool)
+	go func() {
+		for name, swapTarget := range swapTargets {
+			log.Printf("closing target: %v", name)
+			swapTarget.Close()
+		}
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		log.Printf("done")
+	case <-time.After(cfg.Params.ShutdownGrace):
+		log.Printf("error: giving up on closing targets")
 	}
 }
 
+// Starts the target described by a target config.
+func StartTarget(targetCfg *TargetConfig,
+	stats *grouter.Stats) (grouter.Target, error) {
+	params := targetCfg.Params
+	targetKind := strings.Split(targetCfg.Spec, ":")[0]
+	targetDef, ok := targets[targetKind]
+	if !ok {
+		return nil, fmt.Errorf("unknown target kind: %s", targetCfg.Spec)
+	}
+	if targetDef.maxConcurrency > 0 &&
+		targetDef.maxConcurrency < params.TargetConcurrency {
+		params.TargetConcurrency = targetDef.maxConcurrency
+		log.Printf("    target-concurrency clipped to: %v;"+
+			" due to limitations of target kind: %v",
+			params.TargetConcurrency, targetKind)
+	}
+	return targetDef.startTarget(targetCfg.Spec, params, stats)
+}
+
+// Re-reads the config and swaps in new targets for the running
+// targets.  A target that fails to start keeps its current target.
+// Sources and added or removed targets need a restart.  Returns the
+// effective config, which is curr with the reloaded targets.
+func ReloadTargets(curr *Config, swapTargets map[string]*grouter.SwapTarget,
+	loadConfig func() (*Config, error),
+	targetStats map[string]*grouter.Stats) (*Config, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return curr, fmt.Errorf("reload failed, keeping current targets;"+
+			" err: %v", err)
+	}
+
+	next := *curr
+	next.Targets = make(map[string]*TargetConfig)
+	var errs []string
+
+	for name, swapTarget := range swapTargets {
+		next.Targets[name] = curr.Targets[name]
+		targetCfg, ok := cfg.Targets[name]
+		if !ok {
+			log.Printf("warn: reload skipped target: %v;"+
+				" removed targets need a restart", name)
+			continue
+		}
+		log.Printf("reloading target: %v: %v", name, targetCfg.Spec)
+		target, err := StartTarget(targetCfg, targetStats[name])
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("reload failed,"+
+				" keeping current target: %v; err: %v", name, err))
+			continue
+		}
+		swapTarget.Swap(target, targetCfg.Params)
+		next.Targets[name] = targetCfg
+		log.Printf("reloaded target: %v", name)
+	}
+	for name := range cfg.Targets {
+		if swapTargets[name] == nil {
+			log.Printf("warn: reload skipped target: %v;"+
+				" added targets need a restart", name)
+		}
+	}
+
+	if len(errs) > 0 {
+		return &next, fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+	return &next, nil
+}
+
+// Returns the first line of a target file that's not blank or a
+// '#' comment, which should be a target spec.
+func ReadTargetFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("could not read target file: %v; err: %v", path, err)
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			return line, nil
+		}
+	}
+	return "", fmt.Errorf("missing target spec in target file: %v", path)
+}
+
+// Calls f each time any of the signals arrive.
+func OnSignal(f func(), sig ...os.Signal) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, sig...)
+
+	go func() {
+		for s := range sigs {
+			log.Printf("received signal: %v", s)
+			f()
+		}
+	}()
+}
+
+// Returns a quit channel that's closed when any of the signals arrive.
+func QuitOnSignal(sig ...os.Signal) chan bool {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, sig...)
+
+	quit := make(chan bool)
+	go func() {
+		log.Printf("received signal: %v; shutting down", <-sigs)
+		close(quit)
+	}()
+	return quit
+}
+
 func endPointExamples(m map[string]endPoint) (rv string) {
 	mk := make([]string, len(m))
 	i := 0
-    for k, _ := range m {
+	for k, _ := range m {
 		mk[i] = k
 		i++
-    }
-    sort.Strings(mk)
+	}
+	sort.Strings(mk)
 	rv = ""
 	for _, s := range mk {
 		rv = rv + "\n      " + m[s].usage
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/steveyen/grouter"
+)
+
+// A metric family in the prometheus text exposition format, such as
+// "grouter_source_ascii_ops_total", which has a sample per label set.
+type metricFamily struct {
+	name    string
+	kind    string // "counter", "gauge" or "summary".
+	help    string
+	samples []metricSample
+}
+
+type metricSample struct {
+	suffix string // Such as "_sum" or "_count" for summaries.
+	labels []string
+	val    float64
+}
+
+// Serves the stats in the prometheus text exposition format, following
+// the stats naming conventions...
+//
+//	tot-xxx                 - counter grouter_xxx_total.
+//	tot-xxx and xxx-usecs   - summary grouter_xxx_seconds, where the
+//	                          tot-xxx-usecs stat provides the _sum and
+//	                          its histogram provides the quantiles.
+//	other histograms        - summary grouter_xxx, such as batch-size.
+//	everything else         - gauge grouter_xxx.
+//
+// The source or target name that prefixes a stat key becomes a
+// "source" or "target" label, and the labels of a key (see StatsKey),
+// such as bucket and opcode, become prometheus labels.  The queue
+// depths of each target's workers are reported as gauges, too.
+func MetricsHandler(a *Admin) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := a.Config()
+		families := make(map[string]*metricFamily)
+
+		stats := a.Stats.Snapshot()
+		hists := a.Stats.Histograms()
+		for k, v := range stats {
+			name, ls := metricsKey(cfg, k)
+			if strings.HasSuffix(name, "-usecs") {
+				continue
+			}
+
+			if !strings.HasPrefix(name, "tot-") {
+				metricsAdd(families, "grouter_"+metricsName(name), "gauge",
+					"Current value of the "+name+" stat.",
+					metricSample{"", ls, float64(v)})
+				continue
+			}
+
+			base := metricsName(name[len("tot-"):])
+			if usecs, ok := stats[grouter.StatsUsecsKey(k)]; ok {
+				family := "grouter_" + base + "_seconds"
+				metricsAdd(families, family, "summary",
+					"Latency of the "+name+" stat.",
+					metricSample{"_sum", ls, float64(usecs) / 1000000.0},
+					metricSample{"_count", ls, float64(v)})
+				if h := hists[grouter.StatsUsecsKey(k)]; h != nil {
+					for _, p := range grouter.HistPercentiles {
+						metricsAdd(families, family, "summary", "",
+							metricSample{"", append(append([]string(nil), ls...),
+								"quantile", fmt.Sprintf("%.6g", p/100.0)),
+								float64(h.Percentile(p)) / 1000000.0})
+					}
+				}
+				continue
+			}
+			metricsAdd(families, "grouter_"+base+"_total", "counter",
+				"Total of the "+name+" stat.",
+				metricSample{"", ls, float64(v)})
+		}
+
+		// Histograms of values other than latencies, like batch-size.
+		for k, h := range hists {
+			name, ls := metricsKey(cfg, k)
+			if strings.HasSuffix(name, "-usecs") {
+				continue
+			}
+			family := "grouter_" + metricsName(name)
+			metricsAdd(families, family, "summary",
+				"Distribution of the "+name+" stat.",
+				metricSample{"_sum", ls, float64(h.Sum)},
+				metricSample{"_count", ls, float64(h.Count)})
+			for _, p := range grouter.HistPercentiles {
+				metricsAdd(families, family, "summary", "",
+					metricSample{"", append(append([]string(nil), ls...),
+						"quantile", fmt.Sprintf("%.6g", p/100.0)),
+						float64(h.Percentile(p))})
+			}
+		}
+
+		for name, target := range a.Targets {
+			for i, n := range target.QueueLens() {
+				metricsAdd(families, "grouter_target_queue_depth", "gauge",
+					"Request batches queued in front of a target worker.",
+					metricSample{"", []string{"target", name,
+						"worker", fmt.Sprintf("%d", i)}, float64(n)})
+			}
+			metricsAdd(families, "grouter_target_queue_capacity", "gauge",
+				"Request batches that fit in the queue of a target worker.",
+				metricSample{"", []string{"target", name},
+					float64(target.QueueCap())})
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		MetricsWrite(w, families)
+	}
+}
+
+func metricsAdd(families map[string]*metricFamily, name string,
+	kind string, help string, samples ...metricSample) {
+	f := families[name]
+	if f == nil {
+		f = &metricFamily{name: name, kind: kind, help: help}
+		families[name] = f
+	}
+	f.samples = append(f.samples, samples...)
+}
+
+// Returns the name of a stat key and its labels, including the labels
+// for its name prefix.
+func metricsKey(cfg *Config, k string) (string, []string) {
+	prefix, name, labels := grouter.StatsSplitKey(k)
+	ls := metricsPrefixLabels(cfg, prefix)
+	if labels != "" {
+		for _, pair := range strings.Split(labels, ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) == 2 {
+				ls = append(ls, metricsName(kv[0]), kv[1])
+			}
+		}
+	}
+	return name, ls
+}
+
+// Returns the labels for a stat key's name prefix, such as "src0/".
+func metricsPrefixLabels(cfg *Config, prefix string) []string {
+	name := strings.TrimSuffix(prefix, "/")
+	if name == "" {
+		return nil
+	}
+	if cfg != nil {
+		if cfg.Sources[name] != nil {
+			return []string{"source", name}
+		}
+		if cfg.Targets[name] != nil {
+			return []string{"target", name}
+		}
+	}
+	return []string{"name", name}
+}
+
+// Writes metric families sorted by name, and their samples sorted by
+// labels, so that scrapes are stable.
+func MetricsWrite(w io.Writer, families map[string]*metricFamily) {
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := families[name]
+		lines := make([]string, 0, len(f.samples))
+		for _, s := range f.samples {
+			lines = append(lines, fmt.Sprintf("%s%s%s %v",
+				f.name, s.suffix, metricsLabels(s.labels), s.val))
+		}
+		sort.Strings(lines)
+
+		fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+	}
+}
+
+func metricsLabels(labels []string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+"=\""+
+			metricsLabelReplacer.Replace(labels[i+1])+"\"")
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var metricsLabelReplacer = strings.NewReplacer(
+	"\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+// Converts a stat name, like "source-ascii-ops", into a valid
+// prometheus metric or label name, like "source_ascii_ops".
+func metricsName(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			c >= '0' && c <= '9' && i > 0 || c == '_') {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
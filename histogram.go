@@ -0,0 +1,178 @@
+package grouter
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Number of linear sub-buckets per power of 2, so values are bucketed
+// with a relative error of at most 1/histSubBuckets (~6%).
+const histSubBuckets = 16
+
+// Enough buckets for every non-negative int64.
+const histNumBuckets = histSubBuckets * 60
+
+// The percentiles that are reported for histograms.
+var HistPercentiles = []float64{50, 90, 99, 99.9}
+
+// A log-linear histogram of non-negative values, such as latencies in
+// microseconds.  Values below histSubBuckets get their own buckets;
+// larger values are bucketed by their power of 2, and then linearly
+// within that power of 2.  Histograms are not concurrency safe, so
+// they're used for snapshots of a StatsHistogram.
+type Histogram struct {
+	Counts []int64 // Grown on demand, indexed by histBucket().
+	Count  int64
+	Sum    int64
+	Max    int64
+}
+
+func NewHistogram() *Histogram {
+	return &Histogram{}
+}
+
+func histBucket(v int64) int {
+	if v < histSubBuckets {
+		return int(v)
+	}
+	exp := uint(0)
+	for (v >> exp) >= 2*histSubBuckets {
+		exp++
+	}
+	return histSubBuckets + int(exp)*histSubBuckets +
+		int(v>>exp) - histSubBuckets
+}
+
+// Returns the largest value that falls into a bucket.
+func histBucketMax(i int) int64 {
+	if i < histSubBuckets {
+		return int64(i)
+	}
+	exp := uint((i - histSubBuckets) / histSubBuckets)
+	sub := int64((i-histSubBuckets)%histSubBuckets + histSubBuckets)
+	return ((sub + 1) << exp) - 1
+}
+
+func (h *Histogram) Record(v int64) {
+	if v < 0 {
+		v = 0
+	}
+	i := histBucket(v)
+	for len(h.Counts) <= i {
+		h.Counts = append(h.Counts, 0)
+	}
+	h.Counts[i]++
+	h.Count++
+	h.Sum += v
+	if h.Max < v {
+		h.Max = v
+	}
+}
+
+// Returns the values that were recorded into this histogram since it
+// was a copy of prev, such as for the latencies of a report interval.
+// The max of the result is only as precise as its highest bucket.
+func (h *Histogram) Sub(prev *Histogram) *Histogram {
+	rv := h.Copy()
+	if prev == nil {
+		return rv
+	}
+	for i, c := range prev.Counts {
+		if i < len(rv.Counts) {
+			rv.Counts[i] -= c
+		}
+	}
+	rv.Count -= prev.Count
+	rv.Sum -= prev.Sum
+	rv.Max = 0
+	for i := len(rv.Counts) - 1; i >= 0; i-- {
+		if rv.Counts[i] > 0 {
+			rv.Max = histBucketMax(i)
+			if rv.Max > h.Max {
+				rv.Max = h.Max
+			}
+			break
+		}
+	}
+	return rv
+}
+
+func (h *Histogram) Copy() *Histogram {
+	rv := *h
+	rv.Counts = append([]int64(nil), h.Counts...)
+	return &rv
+}
+
+// Returns the value at a percentile, between 0 and 100, as the largest
+// value of the bucket the percentile falls into, capped by the max.
+func (h *Histogram) Percentile(p float64) int64 {
+	if h.Count <= 0 {
+		return 0
+	}
+	rank := int64(p / 100.0 * float64(h.Count))
+	if rank >= h.Count {
+		rank = h.Count - 1
+	}
+	seen := int64(0)
+	for i, c := range h.Counts {
+		seen += c
+		if seen > rank {
+			v := histBucketMax(i)
+			if v > h.Max {
+				v = h.Max
+			}
+			return v
+		}
+	}
+	return h.Max
+}
+
+// Returns the count, percentiles and max of a histogram, keyed by
+// names like "p50" and "p99.9".
+func (h *Histogram) Summary() map[string]int64 {
+	rv := map[string]int64{"count": h.Count, "max": h.Max}
+	for _, p := range HistPercentiles {
+		rv[fmt.Sprintf("p%v", p)] = h.Percentile(p)
+	}
+	return rv
+}
+
+// A concurrency safe histogram in a stats registry, which is recorded
+// into with atomics.
+type StatsHistogram struct {
+	sum    int64
+	max    int64
+	counts [histNumBuckets]int64
+}
+
+func (h *StatsHistogram) Record(v int64) {
+	if v < 0 {
+		v = 0
+	}
+	atomic.AddInt64(&h.counts[histBucket(v)], 1)
+	atomic.AddInt64(&h.sum, v)
+	for {
+		max := atomic.LoadInt64(&h.max)
+		if v <= max || atomic.CompareAndSwapInt64(&h.max, max, v) {
+			return
+		}
+	}
+}
+
+// Returns a copy of the histogram.  As concurrent records might be
+// only partly copied, the count is the sum of the copied buckets.
+func (h *StatsHistogram) Snapshot() *Histogram {
+	rv := NewHistogram()
+	for i := range h.counts {
+		if c := atomic.LoadInt64(&h.counts[i]); c > 0 {
+			for len(rv.Counts) <= i {
+				rv.Counts = append(rv.Counts, 0)
+			}
+			rv.Counts[i] = c
+			rv.Count += c
+		}
+	}
+	rv.Sum = atomic.LoadInt64(&h.sum)
+	rv.Max = atomic.LoadInt64(&h.max)
+	return rv
+}
@@ -0,0 +1,130 @@
+package grouter
+
+import (
+	"math"
+	"testing"
+)
+
+func TestHistBucket(t *testing.T) {
+	tests := []struct {
+		v      int64
+		bucket int
+		max    int64 // The largest value of the bucket.
+	}{
+		{0, 0, 0},
+		{1, 1, 1},
+		{15, 15, 15},
+		{16, 16, 16},
+		{31, 31, 31},
+		{32, 32, 33},
+		{33, 32, 33},
+		{34, 33, 35},
+		{63, 47, 63},
+		{64, 48, 67},
+		{1000, 111, 1023},
+		{math.MaxInt64, histNumBuckets - 1, math.MaxInt64},
+	}
+	for _, test := range tests {
+		i := histBucket(test.v)
+		if i != test.bucket {
+			t.Errorf("histBucket(%v): expected %v, got %v", test.v, test.bucket, i)
+		}
+		if max := histBucketMax(i); max != test.max {
+			t.Errorf("histBucketMax(%v): expected %v, got %v", i, test.max, max)
+		}
+	}
+}
+
+// Every bucket's max is in the bucket, the next value is in the next
+// bucket, and the max is within the relative error of the bucket's
+// smallest value.
+func TestHistBucketMax(t *testing.T) {
+	min := int64(0)
+	for i := 0; i < histNumBuckets-1; i++ {
+		max := histBucketMax(i)
+		if histBucket(max) != i {
+			t.Errorf("bucket %v: max %v is in bucket %v", i, max, histBucket(max))
+		}
+		if histBucket(max+1) != i+1 {
+			t.Errorf("bucket %v: max+1 %v is in bucket %v", i, max+1, histBucket(max+1))
+		}
+		if float64(max-min) > float64(min)/histSubBuckets {
+			t.Errorf("bucket %v: [%v, %v] is too wide", i, min, max)
+		}
+		min = max + 1
+	}
+}
+
+func TestHistogramPercentile(t *testing.T) {
+	tests := []struct {
+		values []int64
+		p      float64
+		exp    int64
+	}{
+		{nil, 50, 0},
+		{[]int64{7}, 50, 7},
+		{[]int64{7}, 99.9, 7},
+		{[]int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 50, 6},
+		{[]int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 90, 10},
+		{[]int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, 0, 1},
+		{[]int64{1, 1, 1, 1000}, 99, 1000},
+		{[]int64{1, 1, 1, 1000}, 50, 1},
+		{[]int64{-5}, 50, 0},
+		// The bucket of 1000 is [992, 1023], capped by the max.
+		{[]int64{1000, 1001}, 50, 1001},
+	}
+	for i, test := range tests {
+		h := NewHistogram()
+		for _, v := range test.values {
+			h.Record(v)
+		}
+		if v := h.Percentile(test.p); v != test.exp {
+			t.Errorf("test %v: Percentile(%v): expected %v, got %v",
+				i, test.p, test.exp, v)
+		}
+	}
+}
+
+func TestHistogramSub(t *testing.T) {
+	h := NewHistogram()
+	for _, v := range []int64{1, 2, 1000} {
+		h.Record(v)
+	}
+	prev := h.Copy()
+	for _, v := range []int64{3, 40} {
+		h.Record(v)
+	}
+
+	d := h.Sub(prev)
+	if d.Count != 2 || d.Sum != 43 {
+		t.Errorf("expected count 2, sum 43, got %v, %v", d.Count, d.Sum)
+	}
+	// The max is that of the highest bucket, as 1000 was before prev.
+	if d.Max != histBucketMax(histBucket(40)) {
+		t.Errorf("expected max %v, got %v", histBucketMax(histBucket(40)), d.Max)
+	}
+	if p := d.Percentile(0); p != 3 {
+		t.Errorf("expected p0 3, got %v", p)
+	}
+	if p := d.Percentile(50); p != histBucketMax(histBucket(40)) {
+		t.Errorf("expected p50 %v, got %v", histBucketMax(histBucket(40)), p)
+	}
+	if d := h.Sub(nil); d.Count != h.Count || d.Max != h.Max {
+		t.Errorf("expected a copy, got %#v", d)
+	}
+}
+
+func TestStatsHistogramSnapshot(t *testing.T) {
+	var sh StatsHistogram
+	for _, v := range []int64{5, 5, 100, -1} {
+		sh.Record(v)
+	}
+	h := sh.Snapshot()
+	if h.Count != 4 || h.Sum != 110 || h.Max != 100 {
+		t.Errorf("expected count 4, sum 110, max 100, got %v, %v, %v",
+			h.Count, h.Sum, h.Max)
+	}
+	if h.Counts[5] != 2 || h.Counts[0] != 1 {
+		t.Errorf("unexpected counts: %v", h.Counts)
+	}
+}
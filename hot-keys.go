@@ -0,0 +1,344 @@
+package grouter
+
+import (
+	"container/heap"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Tracks the most frequently accessed keys and the largest values of
+// each bucket in bounded memory, using the space-saving algorithm for
+// keys: when the top-N table is full, the least frequent key is
+// replaced by the new key, which inherits its count as an error bound.
+// So a key's count is an overestimate by at most its err, and any key
+// that's more frequent than 1/N of the ops is guaranteed to be tracked.
+//
+// Keys whose ops/sec cross the hot key threshold, and values that are
+// larger than the big value threshold, are logged.
+//
+// So that conns don't contend on a bucket's lock for every request, a
+// bucket's keys are hashed into shards, each with its own lock and its
+// own top-N tables, so the guarantee is per shard: any key that's more
+// frequent than 1/N of its shard's ops is tracked.
+type HotKeys struct {
+	size              int
+	hotKeyThreshold   float64 // Ops per second.
+	bigValueThreshold int     // Bytes.
+
+	m       sync.RWMutex // Protects buckets, not the buckets' contents.
+	buckets map[string]*hotKeysBucket
+
+	tot_hot_key_alerts   *StatsCounter
+	tot_big_value_alerts *StatsCounter
+	stats                *Stats
+}
+
+const hotKeysShards = 16
+
+type hotKeysBucket struct {
+	shards  [hotKeysShards]hotKeysShard
+	maxRate *StatsGauge
+}
+
+type hotKeysShard struct {
+	m      sync.Mutex
+	keys   hotKeyHeap // Min-heap by count.
+	values hotKeyHeap // Min-heap by size.
+
+	prevCounts map[string]int64 // As of the previous check.
+	hot        map[string]bool  // Keys that are above the threshold.
+}
+
+// Returns the shard of a key, by its FNV-1a hash.
+func (b *hotKeysBucket) shard(key []byte) *hotKeysShard {
+	h := uint32(2166136261)
+	for _, c := range key {
+		h ^= uint32(c)
+		h *= 16777619
+	}
+	return &b.shards[h%hotKeysShards]
+}
+
+type hotKey struct {
+	Key   string
+	Count int64 // For keys, the ops; for values, the max size.
+	Err   int64 // For keys, the overestimate of the count.
+	index int
+}
+
+// A min-heap of hot keys that's also indexed by key.
+type hotKeyHeap struct {
+	entries []*hotKey
+	byKey   map[string]*hotKey
+}
+
+func (h *hotKeyHeap) Len() int {
+	return len(h.entries)
+}
+
+func (h *hotKeyHeap) Less(i, j int) bool {
+	return h.entries[i].Count < h.entries[j].Count
+}
+
+func (h *hotKeyHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	h.entries[i].index = i
+	h.entries[j].index = j
+}
+
+func (h *hotKeyHeap) Push(x interface{}) {
+	e := x.(*hotKey)
+	e.index = len(h.entries)
+	h.entries = append(h.entries, e)
+	h.byKey[e.Key] = e
+}
+
+func (h *hotKeyHeap) Pop() interface{} {
+	e := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	delete(h.byKey, e.Key)
+	return e
+}
+
+// The process-wide hot keys tracker, or nil when it's disabled.
+var hotKeys *HotKeys
+
+// Starts the process-wide hot keys tracker, which checks every
+// interval for keys that have crossed the hot key threshold.
+func HotKeysStart(params Params, stats *Stats, interval time.Duration) *HotKeys {
+	if params.HotKeys <= 0 {
+		return nil
+	}
+	hotKeys = &HotKeys{
+		size:                 params.HotKeys,
+		hotKeyThreshold:      params.HotKeyThreshold,
+		bigValueThreshold:    params.BigValueThreshold,
+		buckets:              make(map[string]*hotKeysBucket),
+		tot_hot_key_alerts:   stats.Counter("tot-hot-key-alerts"),
+		tot_big_value_alerts: stats.Counter("tot-big-value-alerts"),
+		stats:                stats,
+	}
+	go func(h *HotKeys) {
+		for _ = range time.Tick(interval) {
+			h.Check(interval)
+		}
+	}(hotKeys)
+	return hotKeys
+}
+
+// Records an access of a key, and the size of its value, if any, in
+// the process-wide hot keys tracker.
+func HotKeysRecord(bucket string, key []byte, valueSize int) {
+	if hotKeys != nil {
+		hotKeys.Record(bucket, key, valueSize)
+	}
+}
+
+func (h *HotKeys) bucket(name string) *hotKeysBucket {
+	h.m.RLock()
+	b := h.buckets[name]
+	h.m.RUnlock()
+	if b == nil {
+		h.m.Lock()
+		if b = h.buckets[name]; b == nil {
+			b = &hotKeysBucket{
+				maxRate: h.stats.Gauge("hot-key-max-ops-per-sec", "bucket", name),
+			}
+			for i := range b.shards {
+				b.shards[i] = hotKeysShard{
+					keys:       hotKeyHeap{byKey: make(map[string]*hotKey)},
+					values:     hotKeyHeap{byKey: make(map[string]*hotKey)},
+					prevCounts: make(map[string]int64),
+					hot:        make(map[string]bool),
+				}
+			}
+			h.buckets[name] = b
+		}
+		h.m.Unlock()
+	}
+	return b
+}
+
+func (h *HotKeys) Record(bucketName string, key []byte, valueSize int) {
+	b := h.bucket(bucketName).shard(key)
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if e := b.keys.byKey[string(key)]; e != nil {
+		e.Count++
+		heap.Fix(&b.keys, e.index)
+	} else if b.keys.Len() < h.size {
+		heap.Push(&b.keys, &hotKey{Key: string(key), Count: 1})
+	} else {
+		e = b.keys.entries[0] // The least frequent key.
+		delete(b.keys.byKey, e.Key)
+		delete(b.prevCounts, e.Key)
+		delete(b.hot, e.Key)
+		e.Key = string(key)
+		e.Err = e.Count
+		e.Count++
+		b.keys.byKey[e.Key] = e
+		// The inherited count isn't the new key's ops, so its rate at
+		// the next check is only of its ops since now.
+		b.prevCounts[e.Key] = e.Err
+		heap.Fix(&b.keys, 0)
+	}
+
+	if valueSize <= 0 {
+		return
+	}
+	size := int64(valueSize)
+	if e := b.values.byKey[string(key)]; e != nil {
+		if e.Count >= size {
+			return
+		}
+		e.Count = size
+		heap.Fix(&b.values, e.index)
+	} else if b.values.Len() < h.size {
+		heap.Push(&b.values, &hotKey{Key: string(key), Count: size})
+	} else if b.values.entries[0].Count < size {
+		e = b.values.entries[0]
+		delete(b.values.byKey, e.Key)
+		e.Key = string(key)
+		e.Count = size
+		b.values.byKey[e.Key] = e
+		heap.Fix(&b.values, 0)
+	} else {
+		return
+	}
+	if h.bigValueThreshold > 0 && valueSize > h.bigValueThreshold {
+		h.tot_big_value_alerts.Add(1)
+		log.Printf("warn: big value, bucket: %v, key: %q, size: %v",
+			bucketName, key, valueSize)
+	}
+}
+
+// Logs the keys whose ops/sec crossed the hot key threshold since the
+// previous check, which was interval ago.
+func (h *HotKeys) Check(interval time.Duration) {
+	h.m.RLock()
+	buckets := make(map[string]*hotKeysBucket, len(h.buckets))
+	for name, b := range h.buckets {
+		buckets[name] = b
+	}
+	h.m.RUnlock()
+
+	for name, bucket := range buckets {
+		maxRate := 0.0
+		for i := range bucket.shards {
+			rate := h.checkShard(name, &bucket.shards[i], interval)
+			if maxRate < rate {
+				maxRate = rate
+			}
+		}
+		bucket.maxRate.Set(int64(maxRate))
+	}
+}
+
+// Logs the hot keys of a shard, returning the max ops/sec of its keys.
+func (h *HotKeys) checkShard(name string, b *hotKeysShard,
+	interval time.Duration) float64 {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	maxRate := 0.0
+	for _, e := range b.keys.entries {
+		rate := float64(e.Count-b.prevCounts[e.Key]) / interval.Seconds()
+		b.prevCounts[e.Key] = e.Count
+		if maxRate < rate {
+			maxRate = rate
+		}
+		if h.hotKeyThreshold > 0 && rate >= h.hotKeyThreshold {
+			if !b.hot[e.Key] {
+				b.hot[e.Key] = true
+				h.tot_hot_key_alerts.Add(1)
+				log.Printf("warn: hot key, bucket: %v, key: %q,"+
+					" ops/sec: %.1f", name, e.Key, rate)
+			}
+		} else if b.hot[e.Key] {
+			delete(b.hot, e.Key)
+			log.Printf("hot key cooled, bucket: %v, key: %q,"+
+				" ops/sec: %.1f", name, e.Key, rate)
+		}
+	}
+	return maxRate
+}
+
+// The tracked keys and values of a bucket, ordered from the most
+// frequent keys and the largest values.
+type HotKeysReport struct {
+	Keys   []HotKeyReport `json:"keys"`
+	Values []HotKeyReport `json:"values"`
+}
+
+type HotKeyReport struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count,omitempty"`
+	Err   int64  `json:"err,omitempty"`
+	Size  int64  `json:"size,omitempty"`
+	Hot   bool   `json:"hot,omitempty"`
+}
+
+// Returns the top n keys and values of every bucket, by bucket name.
+func (h *HotKeys) Report(n int) map[string]*HotKeysReport {
+	h.m.RLock()
+	defer h.m.RUnlock()
+
+	rv := make(map[string]*HotKeysReport)
+	for name, bucket := range h.buckets {
+		var keys, values []hotKey
+		hot := map[string]bool{}
+		for i := range bucket.shards {
+			b := &bucket.shards[i]
+			b.m.Lock()
+			for _, e := range b.keys.entries {
+				keys = append(keys, *e)
+			}
+			for _, e := range b.values.entries {
+				values = append(values, *e)
+			}
+			for k := range b.hot {
+				hot[k] = true
+			}
+			b.m.Unlock()
+		}
+
+		r := &HotKeysReport{}
+		for _, e := range hotKeysSorted(keys, n) {
+			r.Keys = append(r.Keys, HotKeyReport{
+				Key: e.Key, Count: e.Count, Err: e.Err, Hot: hot[e.Key],
+			})
+		}
+		for _, e := range hotKeysSorted(values, n) {
+			r.Values = append(r.Values, HotKeyReport{Key: e.Key, Size: e.Count})
+		}
+		rv[name] = r
+	}
+	return rv
+}
+
+// Sorts copies of entries by descending count, returning the top n.
+func hotKeysSorted(rv []hotKey, n int) []hotKey {
+	sort.Sort(hotKeysByCount(rv))
+	if n > 0 && len(rv) > n {
+		rv = rv[:n]
+	}
+	return rv
+}
+
+type hotKeysByCount []hotKey
+
+func (s hotKeysByCount) Len() int {
+	return len(s)
+}
+
+func (s hotKeysByCount) Less(i, j int) bool {
+	return s[i].Count > s[j].Count
+}
+
+func (s hotKeysByCount) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
@@ -0,0 +1,638 @@
+package grouter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+// Handles memcached's meta commands, mg, ms, md, ma, mn and me, whose
+// flags are mapped onto the binary protocol's requests, such as an mg
+// with a T flag onto a GAT.  Flags that need per-item state that the
+// binary protocol doesn't carry, such as invalidation (I), recache (R),
+// and an item's remaining ttl (t), hit (h) and last access (l), are
+// sent along as a RequestMeta, which the memory and memcached-ascii
+// targets support.  With other targets, t is returned as -1, h and l
+// are left out, and an md with I is a plain delete.
+
+var (
+	reply_meta_hd = []byte("HD")
+	reply_meta_va = []byte("VA ")
+	reply_meta_en = []byte("EN")
+	reply_meta_nf = []byte("NF")
+	reply_meta_ns = []byte("NS")
+	reply_meta_ex = []byte("EX")
+	reply_meta_me = []byte("ME ")
+	reply_meta_mn = []byte("MN\r\n")
+
+	reply_meta_bad_format = "bad command line format\r\n"
+	reply_meta_bad_token  = "bad token in command line format\r\n"
+	reply_meta_bad_flag   = "invalid flag\r\n"
+)
+
+// The flags of a meta command, such as "v", "T30" or "Oabc", which are
+// copied out of the command line, as a reply is written after the
+// lines of later pipelined commands are read.
+type AsciiMeta struct {
+	Key     []byte // The key as the client sent it, maybe base64 encoded.
+	Ret     []byte // The flags' letters, in order, for the return flags.
+	Opaque  []byte // O: echoed back in the reply.
+	Base64  bool   // b: the key is base64 encoded.
+	Quiet   bool   // q: the reply is suppressed when it's uninteresting.
+	Cas     uint64 // C: compare cas.
+	TTL     int64  // T: the ttl to set, or -1.
+	Vivify  int64  // N: the ttl of an item created on a miss, or -1.
+	Flags   uint32 // F: the client flags to set.
+	Mode    byte   // M: such as E (add) for ms, or D (decr) for ma.
+	Delta   uint64 // D: the delta of ma, 1 by default.
+	Initial uint64 // J: the initial value of ma's vivify, 0 by default.
+	Recache int64  // R: mg wins the recache below this ttl, or -1.
+
+	Invalidate bool // I: md marks the item stale, or ms stores it stale.
+}
+
+// Parses the flags of a meta command for a key, where allowed has the
+// letters of the flags that the command supports.  Returns the client
+// error message when the flags are invalid.
+func AsciiMetaParse(key []byte, flags [][]byte, allowed string) (*AsciiMeta, string) {
+	meta := &AsciiMeta{
+		Key:     append([]byte(nil), key...),
+		TTL:     -1,
+		Vivify:  -1,
+		Delta:   1,
+		Recache: -1,
+	}
+	for _, flag := range flags {
+		if len(flag) <= 0 || bytes.IndexByte([]byte(allowed), flag[0]) < 0 {
+			return nil, reply_meta_bad_flag
+		}
+		token := flag[1:]
+		ok := true
+		var n uint64
+		switch flag[0] {
+		case 'b':
+			meta.Base64 = true
+		case 'q':
+			meta.Quiet = true
+		case 'I':
+			meta.Invalidate = true
+		case 'O':
+			if len(token) > 32 {
+				return nil, "opaque token too long\r\n"
+			}
+			meta.Opaque = append([]byte(nil), token...)
+		case 'C':
+			meta.Cas, ok = AsciiParseUint(token, 64)
+		case 'T':
+			n, ok = AsciiParseUint(token, 32)
+			meta.TTL = int64(n)
+		case 'N':
+			n, ok = AsciiParseUint(token, 32)
+			meta.Vivify = int64(n)
+		case 'F':
+			n, ok = AsciiParseUint(token, 32)
+			meta.Flags = uint32(n)
+		case 'D':
+			meta.Delta, ok = AsciiParseUint(token, 64)
+		case 'J':
+			meta.Initial, ok = AsciiParseUint(token, 64)
+		case 'R':
+			n, ok = AsciiParseUint(token, 32)
+			meta.Recache = int64(n)
+		case 'M':
+			ok = len(token) == 1
+			if ok {
+				meta.Mode = token[0]
+			}
+		}
+		if !ok {
+			return nil, reply_meta_bad_token
+		}
+		meta.Ret = append(meta.Ret, flag[0])
+	}
+	if len(meta.Key) <= 0 || len(meta.Key) > 250 {
+		return nil, reply_meta_bad_format
+	}
+	return meta, ""
+}
+
+// Returns true if the client asked for a flag, such as 'v'.
+func (meta *AsciiMeta) Has(flag byte) bool {
+	return bytes.IndexByte(meta.Ret, flag) >= 0
+}
+
+// Returns the options that a meta command sends to the target, or nil
+// when it needs none.  A get always sends them, as memcached returns a
+// stale item's X, W and Z flags whether or not the client asked.
+func (meta *AsciiMeta) RequestMeta(get bool) *RequestMeta {
+	if !get && !meta.Invalidate {
+		return nil
+	}
+	return &RequestMeta{
+		ItemInfo:   get,
+		Invalidate: meta.Invalidate,
+		TTL:        meta.TTL,
+		Recache:    meta.Recache,
+	}
+}
+
+// Returns the key, decoded when the client sent it base64 encoded.
+func (meta *AsciiMeta) DecodedKey() ([]byte, bool) {
+	if !meta.Base64 {
+		return meta.Key, true
+	}
+	key := make([]byte, base64.StdEncoding.DecodedLen(len(meta.Key)))
+	n, err := base64.StdEncoding.Decode(key, meta.Key)
+	if err != nil || n <= 0 {
+		return nil, false
+	}
+	return key[:n], true
+}
+
+// Returns a request that's sent to the target for a meta command,
+// whose reply is called for every status, as meta commands reply to
+// misses and failures with their own codes (see AsciiMetaStatusReply).
+func AsciiMetaRequest(mcReq *gomemcached.MCRequest, buf []byte,
+	meta *RequestMeta, reply func(source *AsciiSource, bw *bufio.Writer,
+		areq *AsciiRequest) bool) *AsciiRequest {
+	return &AsciiRequest{
+		Req:    mcReq,
+		Buf:    buf,
+		Meta:   meta,
+		Reply:  reply,
+		opcode: OpcodeName(mcReq.Opcode),
+	}
+}
+
+// Returns the meta code of a response's non-success status, such as NS
+// for an add of an existing key, or nil when the status has the same
+// reply as the classic commands, such as a SERVER_ERROR.
+func AsciiMetaStatusReply(req *gomemcached.MCRequest,
+	status gomemcached.Status) []byte {
+	switch status {
+	case gomemcached.KEY_ENOENT:
+		switch UnquietOpcode(req.Opcode) {
+		case gomemcached.GET, gomemcached.GAT:
+			return reply_meta_en
+		case gomemcached.ADD, gomemcached.REPLACE,
+			gomemcached.APPEND, gomemcached.PREPEND:
+			if req.Cas == 0 {
+				return reply_meta_ns
+			}
+		}
+		return reply_meta_nf
+	case gomemcached.KEY_EEXISTS:
+		if req.Cas != 0 {
+			return reply_meta_ex
+		}
+		return reply_meta_ns
+	case gomemcached.NOT_STORED:
+		return reply_meta_ns
+	}
+	return nil
+}
+
+// Writes a meta reply's code, such as HD, with the return flags that
+// the client asked for, in the order that it asked for them, followed
+// by the stale-while-revalidate flags, W, X and Z, of the item's info.
+// Only the key and opaque are returned with a miss or failure, whose
+// res is nil.
+func asciiMetaWrite(bw *bufio.Writer, code []byte, meta *AsciiMeta,
+	res *gomemcached.MCResponse) {
+	var scratch [20]byte
+	var info ItemInfo
+	hasInfo := false
+	if res != nil {
+		info, hasInfo = ItemInfoParse(res.Extras)
+	}
+	bw.Write(code)
+	for _, flag := range meta.Ret {
+		switch {
+		case flag == 'O':
+			bw.WriteString(" O")
+			bw.Write(meta.Opaque)
+		case flag == 'k':
+			bw.WriteString(" k")
+			bw.Write(meta.Key)
+			if meta.Base64 {
+				bw.WriteString(" b")
+			}
+		case flag == 'c' && res != nil:
+			bw.WriteString(" c")
+			bw.Write(strconv.AppendUint(scratch[:0], res.Cas, 10))
+		case flag == 'f' && res != nil:
+			var flg uint32
+			if len(res.Extras) >= 4 {
+				flg = binary.BigEndian.Uint32(res.Extras)
+			}
+			bw.WriteString(" f")
+			bw.Write(strconv.AppendUint(scratch[:0], uint64(flg), 10))
+		case flag == 's' && res != nil:
+			bw.WriteString(" s")
+			bw.Write(strconv.AppendUint(scratch[:0], uint64(len(res.Body)), 10))
+		case flag == 't' && res != nil:
+			// A target without item info is taken as having no ttl.
+			ttl := int64(-1)
+			if hasInfo {
+				ttl = int64(info.TTL)
+			}
+			bw.WriteString(" t")
+			bw.Write(strconv.AppendInt(scratch[:0], ttl, 10))
+		case flag == 'h' && hasInfo:
+			if info.Fetched {
+				bw.WriteString(" h1")
+			} else {
+				bw.WriteString(" h0")
+			}
+		case flag == 'l' && hasInfo:
+			bw.WriteString(" l")
+			bw.Write(strconv.AppendUint(scratch[:0], uint64(info.LastAccess), 10))
+		}
+	}
+	if info.Win {
+		bw.WriteString(" W")
+	}
+	if info.Stale {
+		bw.WriteString(" X")
+	}
+	if info.WinSent {
+		bw.WriteString(" Z")
+	}
+	bw.Write(crnl)
+}
+
+// Writes the reply to a meta command's non-success response, where a
+// quiet miss, such as the EN of a quiet mg, isn't written.
+func asciiMetaReplyStatus(bw *bufio.Writer, areq *AsciiRequest,
+	meta *AsciiMeta, quietMiss bool) {
+	code := AsciiMetaStatusReply(areq.Req, areq.Response.Status)
+	if code == nil {
+		bw.Write(AsciiStatusReply(areq.Req, areq.Response.Status))
+		return
+	}
+	if meta.Quiet && quietMiss &&
+		(bytes.Equal(code, reply_meta_en) || bytes.Equal(code, reply_meta_nf)) {
+		return
+	}
+	asciiMetaWrite(bw, code, meta, nil)
+}
+
+// Handles mg <key> <flags>*, which is a get, or a gat with a T flag.
+// With an N flag, a miss creates an empty item, by a follow-up add,
+// whose creator is told to recache the item by a W flag.  The h and l
+// flags are accepted, but only returned by targets with item info.
+func AsciiCmdMetaGet(source *AsciiSource, cmd *AsciiCmd, req [][]byte,
+	br *bufio.Reader) *AsciiRequest {
+	if len(req) < 2 {
+		return AsciiClientErrorRequest(reply_meta_bad_format)
+	}
+	meta, msg := AsciiMetaParse(req[1], req[2:], "bcfhklOqRstvTN")
+	if meta == nil {
+		return AsciiClientErrorRequest(msg)
+	}
+	key, ok := meta.DecodedKey()
+	if !ok {
+		return AsciiClientErrorRequest(reply_meta_bad_format)
+	}
+
+	opcode := gomemcached.GET
+	nextras := 0
+	if meta.TTL >= 0 {
+		opcode = gomemcached.GAT
+		nextras = 4
+	}
+	buf := BufGet(nextras + len(key))
+	var extras []byte
+	if nextras > 0 {
+		extras = buf[:nextras]
+		binary.BigEndian.PutUint32(extras, uint32(meta.TTL))
+	}
+	copy(buf[nextras:], key)
+
+	return AsciiMetaRequest(&gomemcached.MCRequest{
+		Opcode: opcode,
+		Key:    buf[nextras:],
+		Extras: extras,
+	}, buf, meta.RequestMeta(true), func(source *AsciiSource,
+		bw *bufio.Writer, areq *AsciiRequest) bool {
+		res := areq.Response
+		if res.Status == gomemcached.KEY_ENOENT && meta.Vivify >= 0 {
+			res = source.metaVivify(areq.Req.Key, meta)
+		}
+		if res.Status != gomemcached.SUCCESS {
+			areq := *areq
+			areq.Response = res
+			asciiMetaReplyStatus(bw, &areq, meta, true)
+			return true
+		}
+		if meta.Has('v') {
+			var scratch [20]byte
+			bw.Write(reply_meta_va)
+			bw.Write(strconv.AppendUint(scratch[:0], uint64(len(res.Body)), 10))
+			asciiMetaWrite(bw, nil, meta, res)
+			bw.Write(res.Body)
+			bw.Write(crnl)
+		} else {
+			asciiMetaWrite(bw, reply_meta_hd, meta, res)
+		}
+		return true
+	})
+}
+
+// Creates the empty item of an mg's vivify on miss, returning a hit
+// with a W flag if this conn created it.  Otherwise, another client
+// created the key since the miss, so it's fetched again.
+func (self *AsciiSource) metaVivify(key []byte,
+	meta *AsciiMeta) *gomemcached.MCResponse {
+	// Unlike the request's pooled key, a copy stays valid even if the
+	// follow-up times out and its target still refers to it.
+	key = append([]byte(nil), key...)
+
+	extras := make([]byte, 8)
+	binary.BigEndian.PutUint32(extras[4:], uint32(meta.Vivify))
+	res := self.roundTrip(&gomemcached.MCRequest{
+		Opcode: gomemcached.ADD,
+		Key:    key,
+		Extras: extras,
+	}, nil)
+	switch res.Status {
+	case gomemcached.SUCCESS:
+		info := ItemInfo{TTL: int32(meta.Vivify), Win: true}
+		if meta.Vivify == 0 {
+			info.TTL = -1
+		}
+		return &gomemcached.MCResponse{
+			Opcode: gomemcached.GET,
+			Status: gomemcached.SUCCESS,
+			Cas:    res.Cas,
+			Extras: ItemInfoExtras(0, info),
+			Key:    key,
+		}
+	case gomemcached.KEY_EEXISTS, gomemcached.NOT_STORED:
+		return self.roundTrip(&gomemcached.MCRequest{
+			Opcode: gomemcached.GET,
+			Key:    key,
+		}, meta.RequestMeta(true))
+	}
+	return res
+}
+
+// Sends a follow-up request to the target while replying, such as the
+// add of an mg's vivify on miss, and waits for its response.
+func (self *AsciiSource) roundTrip(mcReq *gomemcached.MCRequest,
+	meta *RequestMeta) *gomemcached.MCResponse {
+	req := Request{
+		Bucket:    "default",
+		Req:       mcReq,
+		Meta:      meta,
+		Res:       make(chan *gomemcached.MCResponse, 1),
+		ClientNum: self.clientNum,
+		Deadline:  self.params.RequestDeadline(time.Now()),
+	}
+	SendRequests(self.target.PickChannel(self.clientNum, "default"),
+		[]Request{req})
+	return AsciiSourceWait(req)
+}
+
+// Handles ms <key> <datalen> <flags>*, whose M flag picks the mode: S
+// (set, the default), E (add), A (append), P (prepend) or R (replace).
+func AsciiCmdMetaSet(source *AsciiSource, cmd *AsciiCmd, req [][]byte,
+	br *bufio.Reader) *AsciiRequest {
+	if len(req) < 3 {
+		return AsciiClientErrorRequest(reply_meta_bad_format)
+	}
+	nval64, ok := AsciiParseUint(req[2], 31)
+	if !ok {
+		return AsciiClientErrorRequest(reply_meta_bad_format)
+	}
+	nval := int(nval64)
+
+	// The flags are checked after the value is read, so that a bad
+	// command's value isn't mistaken for the next command.
+	meta, msg := AsciiMetaParse(req[1], req[3:], "bcCFIkOqTM")
+	var key []byte
+	if meta != nil {
+		if key, ok = meta.DecodedKey(); !ok {
+			meta, msg = nil, reply_meta_bad_format
+		}
+	}
+
+	nkey := len(key)
+	buf := BufGet(8 + nkey + nval + 2)
+	val := buf[8+nkey:]
+	nbuf, e := io.ReadFull(br, val)
+	if e != nil {
+		log.Printf("AsciiSource error: %s", e)
+		return nil
+	}
+	if nbuf != nval+2 {
+		log.Printf("AsciiSource nbuf error: %s", e)
+		return nil
+	}
+	if !bytes.Equal(val[nval:], crnl) {
+		BufPut(buf)
+		return AsciiClientErrorRequest("bad data chunk\r\n")
+	}
+
+	opcode := gomemcached.SET
+	if meta != nil {
+		switch meta.Mode {
+		case 0, 'S', 's':
+		case 'E', 'e':
+			opcode = gomemcached.ADD
+		case 'A', 'a':
+			opcode = gomemcached.APPEND
+		case 'P', 'p':
+			opcode = gomemcached.PREPEND
+		case 'R', 'r':
+			opcode = gomemcached.REPLACE
+		default:
+			meta, msg = nil, "invalid mode for ms STORE\r\n"
+		}
+	}
+	if meta == nil {
+		BufPut(buf)
+		return AsciiClientErrorRequest(msg)
+	}
+
+	extras := buf[:8]
+	binary.BigEndian.PutUint32(extras, meta.Flags)
+	binary.BigEndian.PutUint32(extras[4:], 0)
+	if meta.TTL >= 0 {
+		binary.BigEndian.PutUint32(extras[4:], uint32(meta.TTL))
+	}
+	copy(buf[8:], key)
+
+	return AsciiMetaRequest(&gomemcached.MCRequest{
+		Opcode: opcode,
+		Cas:    meta.Cas,
+		Key:    buf[8 : 8+nkey],
+		Extras: extras,
+		Body:   val[:nval],
+	}, buf, meta.RequestMeta(false), func(source *AsciiSource, bw *bufio.Writer,
+		areq *AsciiRequest) bool {
+		if areq.Response.Status != gomemcached.SUCCESS {
+			asciiMetaReplyStatus(bw, areq, meta, false)
+		} else if !meta.Quiet {
+			asciiMetaWrite(bw, reply_meta_hd, meta, areq.Response)
+		}
+		return true
+	})
+}
+
+// Handles md <key> <flags>*, where an I flag marks the item as stale,
+// with a T flag's new ttl, instead of deleting it.
+func AsciiCmdMetaDelete(source *AsciiSource, cmd *AsciiCmd, req [][]byte,
+	br *bufio.Reader) *AsciiRequest {
+	if len(req) < 2 {
+		return AsciiClientErrorRequest(reply_meta_bad_format)
+	}
+	meta, msg := AsciiMetaParse(req[1], req[2:], "bCIkOqT")
+	if meta == nil {
+		return AsciiClientErrorRequest(msg)
+	}
+	key, ok := meta.DecodedKey()
+	if !ok {
+		return AsciiClientErrorRequest(reply_meta_bad_format)
+	}
+
+	buf := AsciiSourceKey(key)
+	return AsciiMetaRequest(&gomemcached.MCRequest{
+		Opcode: gomemcached.DELETE,
+		Cas:    meta.Cas,
+		Key:    buf,
+	}, buf, meta.RequestMeta(false), func(source *AsciiSource, bw *bufio.Writer,
+		areq *AsciiRequest) bool {
+		if areq.Response.Status != gomemcached.SUCCESS {
+			asciiMetaReplyStatus(bw, areq, meta, true)
+		} else if !meta.Quiet {
+			asciiMetaWrite(bw, reply_meta_hd, meta, nil)
+		}
+		return true
+	})
+}
+
+// Handles ma <key> <flags>*, whose M flag picks the mode: I (incr, the
+// default) or D (decr).  With an N flag, a miss creates the item with
+// the J flag's initial value, like the binary protocol's incr and decr.
+func AsciiCmdMetaArith(source *AsciiSource, cmd *AsciiCmd, req [][]byte,
+	br *bufio.Reader) *AsciiRequest {
+	if len(req) < 2 {
+		return AsciiClientErrorRequest(reply_meta_bad_format)
+	}
+	meta, msg := AsciiMetaParse(req[1], req[2:], "bcCNJDMqOvk")
+	if meta == nil {
+		return AsciiClientErrorRequest(msg)
+	}
+	key, ok := meta.DecodedKey()
+	if !ok {
+		return AsciiClientErrorRequest(reply_meta_bad_format)
+	}
+	opcode := gomemcached.INCREMENT
+	switch meta.Mode {
+	case 0, 'I', 'i', '+':
+	case 'D', 'd', '-':
+		opcode = gomemcached.DECREMENT
+	default:
+		return AsciiClientErrorRequest("invalid mode for ma MODE\r\n")
+	}
+
+	nkey := len(key)
+	buf := BufGet(20 + nkey)
+	extras := buf[:20]
+	binary.BigEndian.PutUint64(extras, meta.Delta)
+	binary.BigEndian.PutUint64(extras[8:], meta.Initial)
+	binary.BigEndian.PutUint32(extras[16:], 0xffffffff)
+	if meta.Vivify >= 0 {
+		binary.BigEndian.PutUint32(extras[16:], uint32(meta.Vivify))
+	}
+	copy(buf[20:], key)
+
+	return AsciiMetaRequest(&gomemcached.MCRequest{
+		Opcode: opcode,
+		Cas:    meta.Cas,
+		Key:    buf[20:],
+		Extras: extras,
+	}, buf, nil, func(source *AsciiSource, bw *bufio.Writer,
+		areq *AsciiRequest) bool {
+		res := areq.Response
+		if res.Status != gomemcached.SUCCESS {
+			asciiMetaReplyStatus(bw, areq, meta, true)
+			return true
+		}
+		if len(res.Body) != 8 {
+			bw.Write(reply_server_error)
+			return true
+		}
+		if meta.Has('v') {
+			var scratch [20]byte
+			val := strconv.AppendUint(scratch[:0],
+				binary.BigEndian.Uint64(res.Body), 10)
+			bw.Write(reply_meta_va)
+			bw.WriteString(strconv.Itoa(len(val)))
+			asciiMetaWrite(bw, nil, meta, res)
+			bw.Write(val)
+			bw.Write(crnl)
+		} else if !meta.Quiet {
+			asciiMetaWrite(bw, reply_meta_hd, meta, res)
+		}
+		return true
+	})
+}
+
+// Handles me <key> [b], memcached's debug command, whose reply only has
+// the item info that a get returns, as targets don't have the rest.
+func AsciiCmdMetaDebug(source *AsciiSource, cmd *AsciiCmd, req [][]byte,
+	br *bufio.Reader) *AsciiRequest {
+	if len(req) < 2 {
+		return AsciiClientErrorRequest(reply_meta_bad_format)
+	}
+	meta, msg := AsciiMetaParse(req[1], req[2:], "b")
+	if meta == nil {
+		return AsciiClientErrorRequest(msg)
+	}
+	key, ok := meta.DecodedKey()
+	if !ok {
+		return AsciiClientErrorRequest(reply_meta_bad_format)
+	}
+
+	buf := AsciiSourceKey(key)
+	return AsciiMetaRequest(&gomemcached.MCRequest{
+		Opcode: cmd.Opcode,
+		Key:    buf,
+	}, buf, nil, func(source *AsciiSource, bw *bufio.Writer,
+		areq *AsciiRequest) bool {
+		res := areq.Response
+		if res.Status != gomemcached.SUCCESS {
+			asciiMetaReplyStatus(bw, areq, meta, false)
+			return true
+		}
+		var scratch [20]byte
+		bw.Write(reply_meta_me)
+		bw.Write(meta.Key)
+		bw.WriteString(" cas=")
+		bw.Write(strconv.AppendUint(scratch[:0], res.Cas, 10))
+		bw.WriteString(" size=")
+		bw.Write(strconv.AppendUint(scratch[:0], uint64(len(res.Body)), 10))
+		bw.Write(crnl)
+		return true
+	})
+}
+
+// Handles mn, which a client sends after quiet meta commands, to know
+// that their replies, if any, have all been read once MN is read.
+func AsciiCmdMetaNoop(source *AsciiSource, cmd *AsciiCmd, req [][]byte,
+	br *bufio.Reader) *AsciiRequest {
+	return AsciiLocalRequest(func(source *AsciiSource, bw *bufio.Writer,
+		areq *AsciiRequest) bool {
+		bw.Write(reply_meta_mn)
+		return true
+	})
+}
@@ -0,0 +1,197 @@
+package grouter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/dustin/gomemcached"
+)
+
+func TestAsciiMetaParse(t *testing.T) {
+	tests := []struct {
+		key     string
+		flags   string
+		allowed string
+		exp     *AsciiMeta // Nil when the flags are invalid.
+		msg     string
+	}{
+		{"k", "", "v", &AsciiMeta{Key: []byte("k")}, ""},
+		{"k", "v t h l", "vthl",
+			&AsciiMeta{Key: []byte("k"), Ret: []byte("vthl")}, ""},
+		{"k", "T30 N60 F7 C9", "TNFC", &AsciiMeta{Key: []byte("k"),
+			Ret: []byte("TNFC"), TTL: 30, Vivify: 60, Flags: 7, Cas: 9}, ""},
+		{"k", "I T5", "IT", &AsciiMeta{Key: []byte("k"), Ret: []byte("IT"),
+			TTL: 5, Invalidate: true}, ""},
+		{"k", "R30", "R",
+			&AsciiMeta{Key: []byte("k"), Ret: []byte("R"), Recache: 30}, ""},
+		{"k", "ME D5 J7", "MDJ", &AsciiMeta{Key: []byte("k"),
+			Ret: []byte("MDJ"), Mode: 'E', Delta: 5, Initial: 7}, ""},
+		{"k", "q Oabc b", "qOb", &AsciiMeta{Key: []byte("k"),
+			Ret: []byte("qOb"), Quiet: true, Opaque: []byte("abc"),
+			Base64: true}, ""},
+		{"k", "x", "v", nil, reply_meta_bad_flag},
+		{"k", "I", "v", nil, reply_meta_bad_flag},
+		{"k", "Tx", "T", nil, reply_meta_bad_token},
+		{"k", "R", "R", nil, reply_meta_bad_token},
+		{"k", "T4294967296", "T", nil, reply_meta_bad_token},
+		{"k", "MEE", "M", nil, reply_meta_bad_token},
+		{"k", "O" + string(bytes.Repeat([]byte("x"), 33)), "O", nil,
+			"opaque token too long\r\n"},
+		{"", "v", "v", nil, reply_meta_bad_format},
+		{string(bytes.Repeat([]byte("k"), 251)), "", "", nil,
+			reply_meta_bad_format},
+	}
+	for i, test := range tests {
+		meta, msg := AsciiMetaParse([]byte(test.key),
+			AsciiFields([]byte(test.flags), nil), test.allowed)
+		if msg != test.msg {
+			t.Errorf("test %v: expected msg %q, got %q", i, test.msg, msg)
+		}
+		if test.exp == nil {
+			if meta != nil {
+				t.Errorf("test %v: expected nil, got %+v", i, meta)
+			}
+			continue
+		}
+		if meta == nil {
+			t.Errorf("test %v: expected %+v, got nil", i, test.exp)
+			continue
+		}
+		exp := *test.exp
+		if exp.TTL == 0 && !bytes.Contains(exp.Ret, []byte("T")) {
+			exp.TTL = -1
+		}
+		if exp.Vivify == 0 && !bytes.Contains(exp.Ret, []byte("N")) {
+			exp.Vivify = -1
+		}
+		if exp.Delta == 0 && !bytes.Contains(exp.Ret, []byte("D")) {
+			exp.Delta = 1
+		}
+		if exp.Recache == 0 && !bytes.Contains(exp.Ret, []byte("R")) {
+			exp.Recache = -1
+		}
+		if string(meta.Key) != string(exp.Key) ||
+			string(meta.Ret) != string(exp.Ret) ||
+			string(meta.Opaque) != string(exp.Opaque) ||
+			meta.Base64 != exp.Base64 || meta.Quiet != exp.Quiet ||
+			meta.Cas != exp.Cas || meta.TTL != exp.TTL ||
+			meta.Vivify != exp.Vivify || meta.Flags != exp.Flags ||
+			meta.Mode != exp.Mode || meta.Delta != exp.Delta ||
+			meta.Initial != exp.Initial || meta.Recache != exp.Recache ||
+			meta.Invalidate != exp.Invalidate {
+			t.Errorf("test %v: expected %+v, got %+v", i, exp, *meta)
+		}
+	}
+}
+
+func TestAsciiMetaRequestMeta(t *testing.T) {
+	tests := []struct {
+		flags string
+		get   bool
+		exp   *RequestMeta
+	}{
+		{"", false, nil},
+		{"T30", false, nil},
+		{"", true, &RequestMeta{ItemInfo: true, TTL: -1, Recache: -1}},
+		{"R30", true, &RequestMeta{ItemInfo: true, TTL: -1, Recache: 30}},
+		{"I T5", false, &RequestMeta{Invalidate: true, TTL: 5, Recache: -1}},
+	}
+	for i, test := range tests {
+		meta, _ := AsciiMetaParse([]byte("k"),
+			AsciiFields([]byte(test.flags), nil), "ITR")
+		rm := meta.RequestMeta(test.get)
+		if (rm == nil) != (test.exp == nil) ||
+			(rm != nil && *rm != *test.exp) {
+			t.Errorf("test %v: expected %+v, got %+v", i, test.exp, rm)
+		}
+	}
+}
+
+func TestItemInfoExtras(t *testing.T) {
+	tests := []ItemInfo{
+		ItemInfo{TTL: -1},
+		ItemInfo{TTL: 0, LastAccess: 7, Fetched: true},
+		ItemInfo{TTL: 30, Stale: true, Win: true},
+		ItemInfo{TTL: 1 << 30, Stale: true, WinSent: true},
+	}
+	for _, info := range tests {
+		extras := ItemInfoExtras(42, info)
+		if flags := binary.BigEndian.Uint32(extras); flags != 42 {
+			t.Errorf("%+v: expected flags 42, got %v", info, flags)
+		}
+		if got, ok := ItemInfoParse(extras); !ok || got != info {
+			t.Errorf("expected %+v, got %+v, %v", info, got, ok)
+		}
+	}
+	if _, ok := ItemInfoParse(make([]byte, 4)); ok {
+		t.Errorf("expected no item info in flags only extras")
+	}
+}
+
+func TestAsciiMetaWrite(t *testing.T) {
+	hit := &gomemcached.MCResponse{
+		Cas:    5,
+		Extras: ItemInfoExtras(3, ItemInfo{TTL: 30, LastAccess: 2, Fetched: true}),
+		Body:   []byte("hello"),
+	}
+	stale := &gomemcached.MCResponse{
+		Extras: ItemInfoExtras(0, ItemInfo{TTL: -1, Stale: true, Win: true}),
+	}
+	noInfo := &gomemcached.MCResponse{Cas: 5, Extras: make([]byte, 4)}
+
+	tests := []struct {
+		flags string
+		res   *gomemcached.MCResponse
+		exp   string
+	}{
+		{"", hit, "HD\r\n"},
+		{"c f s t h l", hit, "HD c5 f3 s5 t30 h1 l2\r\n"},
+		{"Oxy k", hit, "HD Oxy kk\r\n"},
+		{"t", stale, "HD t-1 W X\r\n"},
+		{"t h l", noInfo, "HD t-1\r\n"},
+		{"c t", nil, "HD\r\n"},
+		{"k Oxy", nil, "HD kk Oxy\r\n"},
+	}
+	for i, test := range tests {
+		meta, msg := AsciiMetaParse([]byte("k"),
+			AsciiFields([]byte(test.flags), nil), "cfstOkhl")
+		if meta == nil {
+			t.Fatalf("test %v: %v", i, msg)
+		}
+		var buf bytes.Buffer
+		bw := bufio.NewWriter(&buf)
+		asciiMetaWrite(bw, reply_meta_hd, meta, test.res)
+		bw.Flush()
+		if buf.String() != test.exp {
+			t.Errorf("test %v: expected %q, got %q", i, test.exp, buf.String())
+		}
+	}
+}
+
+func TestAsciiMetaStatusReply(t *testing.T) {
+	tests := []struct {
+		opcode gomemcached.CommandCode
+		cas    uint64
+		status gomemcached.Status
+		exp    []byte
+	}{
+		{gomemcached.GET, 0, gomemcached.KEY_ENOENT, reply_meta_en},
+		{gomemcached.GAT, 0, gomemcached.KEY_ENOENT, reply_meta_en},
+		{gomemcached.DELETE, 0, gomemcached.KEY_ENOENT, reply_meta_nf},
+		{gomemcached.ADD, 0, gomemcached.KEY_ENOENT, reply_meta_ns},
+		{gomemcached.APPEND, 1, gomemcached.KEY_ENOENT, reply_meta_nf},
+		{gomemcached.SET, 1, gomemcached.KEY_ENOENT, reply_meta_nf},
+		{gomemcached.SET, 1, gomemcached.KEY_EEXISTS, reply_meta_ex},
+		{gomemcached.ADD, 0, gomemcached.KEY_EEXISTS, reply_meta_ns},
+		{gomemcached.APPEND, 0, gomemcached.NOT_STORED, reply_meta_ns},
+		{gomemcached.GET, 0, ETIMEDOUT, nil},
+	}
+	for i, test := range tests {
+		req := &gomemcached.MCRequest{Opcode: test.opcode, Cas: test.cas}
+		if code := AsciiMetaStatusReply(req, test.status); !bytes.Equal(code, test.exp) {
+			t.Errorf("test %v: expected %q, got %q", i, test.exp, code)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package grouter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Handles the memcached "stats" command and its "settings", "conns"
+// and grouter-specific "proxy" sub-commands.  The stats come from the
+// stats reporter, so they cover all the sources and targets of the
+// process, like a memcached server's stats cover all its conns.
+func AsciiCmdStats(source *AsciiSource, cmd *AsciiCmd, req [][]byte,
+	br *bufio.Reader) *AsciiRequest {
+	if len(req) > 2 {
+		return AsciiClientErrorRequest("expected at most 1 param for stats command\r\n")
+	}
+	sub := ""
+	if len(req) == 2 {
+		sub = string(req[1])
+	}
+	if sub != "" && sub != "settings" && sub != "conns" && sub != "proxy" {
+		return AsciiClientErrorRequest("unknown stats sub-command - " + sub + "\r\n")
+	}
+
+	return AsciiLocalRequest(func(source *AsciiSource, bw *bufio.Writer,
+		areq *AsciiRequest) bool {
+		switch sub {
+		case "":
+			AsciiStatsGeneral(bw, source.stats.Snapshot())
+		case "settings":
+			AsciiStatsSettings(bw, source.params)
+		case "conns":
+			AsciiStatsConns(bw)
+		case "proxy":
+			AsciiStatsProxy(bw, source.stats.Snapshot(),
+				source.stats.Histograms())
+		}
+		bw.Write(reply_end)
+		return true
+	})
+}
+
+func asciiStat(bw *bufio.Writer, name string, val interface{}) {
+	fmt.Fprintf(bw, "STAT %s %v\r\n", name, val)
+}
+
+// Writes the standard memcached stats, summing stats across all the
+// sources, such as curr_connections, and with cmd_xxx counts for each
+// opcode seen by the ascii sources.
+func AsciiStatsGeneral(bw *bufio.Writer, stats map[string]int64) {
+	now := time.Now()
+	sums := make(map[string]int64)
+	cmds := make(map[string]int64)
+	for k, v := range stats {
+		_, name, labels := StatsSplitKey(k)
+		sums[name] += v
+		if name == "tot-source-ascii-ops" {
+			l := StatsLabels(labels)
+			if l["opcode"] != "" && l["opcode"] != "unknown" {
+				cmds[l["opcode"]] += v
+			}
+			if l["opcode"] == "get" {
+				sums["get_"+l["status"]] += v
+			}
+		}
+	}
+
+	asciiStat(bw, "pid", os.Getpid())
+	asciiStat(bw, "uptime", int64(now.Sub(StatsStartTime).Seconds()))
+	asciiStat(bw, "time", now.Unix())
+	asciiStat(bw, "version", Version)
+	asciiStat(bw, "curr_connections", sums["curr-conns"])
+	asciiStat(bw, "total_connections", sums["tot-conns"])
+	for _, opcode := range sortedStatsKeys(cmds) {
+		asciiStat(bw, "cmd_"+opcode, cmds[opcode])
+	}
+	asciiStat(bw, "get_hits", sums["get_hit"])
+	asciiStat(bw, "get_misses", sums["get_miss"])
+	asciiStat(bw, "bytes_read", sums["tot-source-ascii-bytes-read"])
+	asciiStat(bw, "bytes_written", sums["tot-source-ascii-bytes-written"])
+}
+
+// Writes the params of the source conn, using memcached's names where
+// memcached has an equivalent setting.
+func AsciiStatsSettings(bw *bufio.Writer, params Params) {
+	asciiStat(bw, "maxconns", params.SourceMaxConns)
+	asciiStat(bw, "source_spec", params.SourceSpec)
+	asciiStat(bw, "target_spec", params.TargetSpec)
+	asciiStat(bw, "target_chan_size", params.TargetChanSize)
+	asciiStat(bw, "target_concurrency", params.TargetConcurrency)
+	asciiStat(bw, "target_overload", params.TargetOverload)
+	asciiStat(bw, "target_batch_size", params.TargetBatchSize)
+	asciiStat(bw, "target_batch_bytes", params.TargetBatchBytes)
+	asciiStat(bw, "target_batch_linger", params.TargetBatchLinger)
+	asciiStat(bw, "target_batch_adaptive", params.TargetBatchAdaptive)
+	asciiStat(bw, "request_timeout", params.RequestTimeout)
+	asciiStat(bw, "source_request_timeout", params.SourceRequestTimeout)
+	asciiStat(bw, "shutdown_grace", params.ShutdownGrace)
+	asciiStat(bw, "flush_enabled", FlushAllEnabled())
+}
+
+// Writes the address and idle time of each open ascii source conn.
+func AsciiStatsConns(bw *bufio.Writer) {
+	now := time.Now()
+	for _, c := range AsciiConnsList() {
+		id := fmt.Sprintf("%d", c.Id)
+		asciiStat(bw, id+":addr", c.Addr)
+		asciiStat(bw, id+":secs_since_last_cmd",
+			int64(now.Sub(c.LastCmd()).Seconds()))
+		asciiStat(bw, id+":secs_since_connected",
+			int64(now.Sub(c.Started).Seconds()))
+	}
+}
+
+// Writes every stat by its full key, such as "target/tot-batch", and
+// the percentiles and max of every latency histogram, in microseconds.
+func AsciiStatsProxy(bw *bufio.Writer, stats map[string]int64,
+	hists map[string]*Histogram) {
+	for _, k := range sortedStatsKeys(stats) {
+		asciiStat(bw, k, stats[k])
+	}
+	for _, k := range sortedStatsKeys(hists) {
+		summary := hists[k].Summary()
+		for _, name := range sortedStatsKeys(summary) {
+			asciiStat(bw, k+":"+name, summary[name])
+		}
+	}
+}
+
+func sortedStatsKeys(m interface{}) []string {
+	var rv []string
+	switch x := m.(type) {
+	case map[string]int64:
+		for k := range x {
+			rv = append(rv, k)
+		}
+	case map[string]*Histogram:
+		for k := range x {
+			rv = append(rv, k)
+		}
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// An open ascii source conn, for "stats conns", where it's identified
+// by its Id, which is process-wide, unlike its ClientNum, which is
+// numbered per source.
+type AsciiConn struct {
+	Id        uint64
+	ClientNum uint32
+	Addr      string
+	Started   time.Time
+	lastCmd   int64 // Unix nanoseconds, accessed atomically.
+}
+
+func (c *AsciiConn) Touch(now time.Time) {
+	atomic.StoreInt64(&c.lastCmd, now.UnixNano())
+}
+
+func (c *AsciiConn) LastCmd() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastCmd))
+}
+
+var asciiConns = struct {
+	m      sync.Mutex
+	conns  map[*AsciiConn]bool
+	lastId uint64
+}{conns: make(map[*AsciiConn]bool)}
+
+func AsciiConnsAdd(s io.ReadWriter, clientNum uint32) *AsciiConn {
+	now := time.Now()
+	c := &AsciiConn{ClientNum: clientNum, Addr: "unknown", Started: now}
+	if nc, ok := s.(net.Conn); ok {
+		c.Addr = nc.RemoteAddr().Network() + ":" + nc.RemoteAddr().String()
+	}
+	c.Touch(now)
+
+	asciiConns.m.Lock()
+	asciiConns.lastId++
+	c.Id = asciiConns.lastId
+	asciiConns.conns[c] = true
+	asciiConns.m.Unlock()
+	return c
+}
+
+func AsciiConnsRemove(c *AsciiConn) {
+	asciiConns.m.Lock()
+	delete(asciiConns.conns, c)
+	asciiConns.m.Unlock()
+}
+
+// Returns the open ascii source conns, ordered by id.
+func AsciiConnsList() []*AsciiConn {
+	asciiConns.m.Lock()
+	rv := make([]*AsciiConn, 0, len(asciiConns.conns))
+	for c := range asciiConns.conns {
+		rv = append(rv, c)
+	}
+	asciiConns.m.Unlock()
+
+	sort.Sort(asciiConnsById(rv))
+	return rv
+}
+
+type asciiConnsById []*AsciiConn
+
+func (s asciiConnsById) Len() int {
+	return len(s)
+}
+
+func (s asciiConnsById) Less(i, j int) bool {
+	return s[i].Id < s[j].Id
+}
+
+func (s asciiConnsById) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// Counts the bytes read and written through a conn.
+type statsReadWriter struct {
+	rw      io.ReadWriter
+	read    int64
+	written int64
+}
+
+func (s *statsReadWriter) Read(p []byte) (int, error) {
+	n, err := s.rw.Read(p)
+	s.read += int64(n)
+	return n, err
+}
+
+func (s *statsReadWriter) Write(p []byte) (int, error) {
+	n, err := s.rw.Write(p)
+	s.written += int64(n)
+	return n, err
+}
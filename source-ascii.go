@@ -7,32 +7,110 @@ import (
 	"io"
 	"log"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/dustin/gomemcached"
 )
 
+const Version = "0.0.0"
+
 var (
 	crnl    = []byte("\r\n")
 	space   = []byte(" ")
-	version = []byte("VERSION grouter 0.0.0\r\n")
+	version = []byte("VERSION grouter " + Version + "\r\n")
+
+	reply_value         = []byte("VALUE ")
+	reply_end           = []byte("END\r\n")
+	reply_ok            = []byte("OK\r\n")
+	reply_stored        = []byte("STORED\r\n")
+	reply_not_stored    = []byte("NOT_STORED\r\n")
+	reply_exists        = []byte("EXISTS\r\n")
+	reply_deleted       = []byte("DELETED\r\n")
+	reply_touched       = []byte("TOUCHED\r\n")
+	reply_not_found     = []byte("NOT_FOUND\r\n")
+	reply_server_error  = []byte("SERVER_ERROR\r\n")
+	reply_out_of_memory = []byte("SERVER_ERROR out of memory\r\n")
+	reply_tmpfail       = []byte("SERVER_ERROR temporary failure\r\n")
+	reply_not_my_vb     = []byte("SERVER_ERROR not my vbucket\r\n")
+	reply_unsupported   = []byte("SERVER_ERROR not supported by target\r\n")
+	reply_timeout       = []byte("SERVER_ERROR timeout\r\n")
+	reply_busy          = []byte("SERVER_ERROR busy\r\n")
+	reply_too_large     = []byte("CLIENT_ERROR value too large\r\n")
+	reply_non_numeric   = []byte("CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+
+	noreply = []byte("noreply")
 )
 
 type AsciiSource struct {
 	// A source that handles memcached ascii protocol requests.
+
+	// Per-connection fields, set by Run().
+	params    Params
+	stats     *Stats
+	conn      *AsciiConn
+	accessLog *AccessLog
+	tracer    *TraceExporter
+	target    Target
+	clientNum uint32
+
+	// Cached, to avoid registry lookups on every request.
+	ops map[[2]string]*asciiOpStats
+}
+
+// Stats of a source's ops for a bucket, opcode and status.
+type asciiOpStats struct {
+	op           *StatsOp
+	bytesRead    *StatsCounter
+	bytesWritten *StatsCounter
 }
 
-func (self AsciiSource) Run(s io.ReadWriter, clientNum uint32, target Target,
-	statsChan chan Stats) {
-	tot_source_ascii_ops_nsecs := int64(0)
-	tot_source_ascii_ops := 0
+// Max commands, and max bytes of their keys and values, that a conn
+// reads ahead of its replies when a client pipelines commands.
+const asciiPipelineMax = 100
+const asciiPipelineMaxBytes = 1024 * 1024
+
+func (self AsciiSource) Run(s io.ReadWriter, clientNum uint32, params Params,
+	target Target, stats *Stats) {
+	rw := &statsReadWriter{rw: s}
+	conn := AsciiConnsAdd(s, clientNum)
+	defer AsciiConnsRemove(conn)
+
+	self.params = params
+	self.stats = stats
+	self.conn = conn
+	self.target = target
+	self.clientNum = clientNum
+	self.ops = make(map[[2]string]*asciiOpStats)
+
+	accessLog, err := AccessLogOpen(params, stats)
+	if err != nil {
+		log.Printf("error: %v", err)
+	}
+	self.accessLog = accessLog
+
+	tracer, err := TraceExporterOpen(params, stats)
+	if err != nil {
+		log.Printf("error: %v", err)
+	}
+	self.tracer = tracer
 
-	br := bufio.NewReader(s)
-	bw := bufio.NewWriter(s)
-	res := make(chan *gomemcached.MCResponse)
+	br := bufio.NewReader(rw)
+	bw := bufio.NewWriter(rw)
+
+	fields := make([][]byte, 0, 8) // Reused for every command line.
+
+	// The commands that have been read but not yet replied to.  While
+	// a client's pipelined commands are already buffered, they're read
+	// ahead and sent to the target together, as one batch, and their
+	// replies are written in order, with one flush.
+	pipeline := make([]*AsciiRequest, 0, asciiPipelineMax)
+	pipelineBytes := 0
 
 	for {
+		// The bytes read by a command are those that it consumes from
+		// br; the bytes that its reply writes to bw are counted later.
+		bytes_read := rw.read - int64(br.Buffered())
+
 		buf, isPrefix, e := br.ReadLine()
 		if e != nil {
 			log.Printf("AsciiSource error: %s", e)
@@ -43,223 +121,753 @@ func (self AsciiSource) Run(s io.ReadWriter, clientNum uint32, target Target,
 			return
 		}
 
-		req := strings.Split(strings.TrimSpace(string(buf)), " ")
+		start := time.Now()
+		conn.Touch(start)
 
-		reqs_start := time.Now()
-		if asciiCmd, ok := asciiCmds[req[0]]; ok {
-			if !asciiCmd.Handler(&self, target, res, asciiCmd, req, br, bw, clientNum) {
+		fields = AsciiFields(buf, fields[:0])
+		req := fields
+		var asciiCmd *AsciiCmd
+		if len(req) > 0 {
+			asciiCmd = asciiCmds[string(req[0])]
+		}
+
+		var areq *AsciiRequest
+		if asciiCmd != nil {
+			areq = asciiCmd.Parse(&self, asciiCmd, req, br)
+			if areq == nil {
 				return
 			}
+			if areq.opcode == "" {
+				areq.opcode = OpcodeName(asciiCmd.Opcode)
+			}
 		} else {
-			AsciiClientError(bw, "unknown command - "+req[0]+"\r\n")
+			name := ""
+			if len(req) > 0 {
+				name = string(req[0])
+			}
+			areq = AsciiClientErrorRequest("unknown command - " + name + "\r\n")
+			areq.opcode = "unknown"
+		}
+		areq.start = start
+		areq.bytesRead = rw.read - int64(br.Buffered()) - bytes_read
+		areq.trace = tracer.Start(start)
+
+		pipeline = append(pipeline, areq)
+		pipelineBytes += len(areq.Buf)
+
+		// Commands that the source handles itself, like stats and
+		// quit, aren't read ahead of, so that they see the effects of
+		// the commands before them.
+		if areq.Req != nil &&
+			len(pipeline) < asciiPipelineMax &&
+			pipelineBytes < asciiPipelineMaxBytes &&
+			asciiLineBuffered(br) {
+			continue
+		}
+
+		ok := self.reply(pipeline, target, clientNum, rw, bw)
+		for i := range pipeline {
+			pipeline[i] = nil
 		}
-		reqs_end := time.Now()
-
-		tot_source_ascii_ops_nsecs += reqs_end.Sub(reqs_start).Nanoseconds()
-		tot_source_ascii_ops += 1
-
-		if tot_source_ascii_ops%100 == 0 {
-			statsChan <- Stats{
-				Keys: []string{
-					"tot-source-ascii-ops",
-					"tot-source-ascii-ops-usecs",
-				},
-				Vals: []int64{
-					int64(tot_source_ascii_ops),
-					int64(tot_source_ascii_ops_nsecs / 1000),
-				},
+		pipeline = pipeline[:0]
+		pipelineBytes = 0
+		if !ok {
+			return
+		}
+	}
+}
+
+// Returns true if br already holds a whole command line, so that
+// reading it won't block.  A command's value might not be buffered
+// yet, but a client that pipelines a command also sends its value.
+func asciiLineBuffered(br *bufio.Reader) bool {
+	n := br.Buffered()
+	if n <= 0 {
+		return false
+	}
+	b, _ := br.Peek(n)
+	return bytes.IndexByte(b, '\n') >= 0
+}
+
+// Sends the pipeline's requests to the target, as one batch, then
+// waits for their responses and writes the replies, in order, and
+// flushes them.  Returns false when the conn should be closed.
+func (self *AsciiSource) reply(pipeline []*AsciiRequest, target Target,
+	clientNum uint32, rw *statsReadWriter, bw *bufio.Writer) bool {
+	reqs := make([]Request, 0, len(pipeline))
+	now := time.Now()
+	for _, areq := range pipeline {
+		if areq.Req == nil {
+			continue
+		}
+		// A fresh, buffered res chan per request means a target
+		// never blocks on a response that arrives after we've
+		// given up on a timed out request.
+		areq.request = Request{
+			Bucket:    "default",
+			Req:       areq.Req,
+			Res:       make(chan *gomemcached.MCResponse, 1),
+			ClientNum: clientNum,
+			Deadline:  self.params.RequestDeadline(areq.start),
+			Trace:     areq.trace,
+			Meta:      areq.Meta,
+		}
+		if areq.trace != nil {
+			areq.trace.Attr("bucket", areq.request.Bucket)
+			areq.trace.Attr("client", self.conn.Addr)
+			areq.trace.Span("source.parse", now)
+		}
+		reqs = append(reqs, areq.request)
+	}
+	if len(reqs) > 0 {
+		SendRequests(target.PickChannel(clientNum, "default"), reqs)
+	}
+
+	ok := true
+	for _, areq := range pipeline {
+		if areq.Req != nil {
+			self.wait(areq)
+		}
+
+		bytes_written := rw.written + int64(bw.Buffered())
+		if ok && !areq.NoReply {
+			ok = areq.Reply(self, bw, areq)
+		}
+		end := time.Now()
+
+		if areq.Req != nil {
+			AsciiSourceRelease(areq.Buf, areq.Response)
+		}
+
+		if areq.trace != nil {
+			areq.trace.Span("source.write", end)
+			areq.trace.Attr("opcode", areq.opcode)
+			areq.trace.Attr("status", areq.status)
+			self.tracer.End(areq.trace, end)
+		}
+
+		o := self.ops[[2]string{areq.opcode, areq.status}]
+		if o == nil {
+			labels := []string{
+				"bucket", "default", "opcode", areq.opcode, "status", areq.status,
+			}
+			o = &asciiOpStats{
+				op:           self.stats.Op("tot-source-ascii-ops", labels...),
+				bytesRead:    self.stats.Counter("tot-source-ascii-bytes-read", labels...),
+				bytesWritten: self.stats.Counter("tot-source-ascii-bytes-written", labels...),
 			}
-			tot_source_ascii_ops_nsecs = 0
-			tot_source_ascii_ops = 0
+			self.ops[[2]string{areq.opcode, areq.status}] = o
 		}
+		o.op.Record(end.Sub(areq.start))
+		o.bytesRead.Add(areq.bytesRead)
+		o.bytesWritten.Add(rw.written + int64(bw.Buffered()) - bytes_written)
+	}
+	bw.Flush()
+	return ok
+}
+
+// Waits for the response of a request that was sent to the target, up
+// to the request's deadline, and records its status.
+func (self *AsciiSource) wait(areq *AsciiRequest) {
+	mcReq := areq.Req
+	response := AsciiSourceWait(areq.request)
+	areq.Response = response
+	areq.status = StatusName(mcReq.Opcode, response.Status)
+	HotKeysRecord(areq.request.Bucket, mcReq.Key,
+		len(mcReq.Body)+len(response.Body))
+
+	if self.accessLog != nil && self.accessLog.Sampled() {
+		self.accessLog.Log(&AccessLogEntry{
+			Time:      areq.start.UTC().Format(time.RFC3339Nano),
+			Client:    self.conn.Addr,
+			Bucket:    areq.request.Bucket,
+			Opcode:    areq.opcode,
+			ValueSize: len(mcReq.Body) + len(response.Body),
+			Status:    areq.status,
+			Usecs:     time.Since(areq.start).Nanoseconds() / 1000,
+		}, mcReq.Key)
 	}
 }
 
 type AsciiCmd struct {
-	Opcode  gomemcached.CommandCode
-	Handler func(source *AsciiSource,
-		target Target, res chan *gomemcached.MCResponse,
-		cmd *AsciiCmd, req []string, br *bufio.Reader, bw *bufio.Writer,
-		clientNum uint32) bool
+	Opcode gomemcached.CommandCode
+
+	// Parses a command line, and reads any value that follows it, into
+	// a request.  Returns nil when the conn should be closed.
+	Parse func(source *AsciiSource, cmd *AsciiCmd, req [][]byte,
+		br *bufio.Reader) *AsciiRequest
+}
+
+// A parsed command, which is either sent to the target as Req, or is
+// handled by the source itself when Req is nil, such as stats or a
+// command with a client error.
+type AsciiRequest struct {
+	Req  *gomemcached.MCRequest
+	Buf  []byte       // The pooled buffer of Req's key, extras and body.
+	Meta *RequestMeta // The options of a meta command, if any.
+
+	// When the client asked for no reply, Req has a quiet opcode and
+	// Reply isn't called, but the response's status is still counted.
+	NoReply bool
+
+	// Writes the command's reply, after its Response has arrived, if
+	// it was sent to the target.  Returns false to close the conn.
+	Reply    func(source *AsciiSource, bw *bufio.Writer, areq *AsciiRequest) bool
+	Response *gomemcached.MCResponse
+
+	request   Request
+	opcode    string
+	status    string
+	start     time.Time
+	bytesRead int64
+	trace     *Trace
+}
+
+// Returns a request that's handled by the source itself, by reply.
+func AsciiLocalRequest(reply func(source *AsciiSource,
+	bw *bufio.Writer, areq *AsciiRequest) bool) *AsciiRequest {
+	return &AsciiRequest{Reply: reply, status: "ok"}
+}
+
+// Returns a request that's replied to with a CLIENT_ERROR.
+func AsciiClientErrorRequest(msg string) *AsciiRequest {
+	return &AsciiRequest{
+		Reply: func(source *AsciiSource, bw *bufio.Writer,
+			areq *AsciiRequest) bool {
+			return AsciiClientError(bw, msg)
+		},
+		status: "error",
+	}
+}
+
+// Returns a request that's sent to the target, whose key, extras and
+// body are in the pooled buffer, buf.  The reply is only called for a
+// successful response, as the replies to the other statuses are the
+// same for every command (see AsciiStatusReply).  For a noreply
+// command, the request's opcode is changed to its quiet variant.
+func AsciiTargetRequest(mcReq *gomemcached.MCRequest, buf []byte,
+	noReply bool, reply func(source *AsciiSource, bw *bufio.Writer,
+		areq *AsciiRequest) bool) *AsciiRequest {
+	if noReply {
+		mcReq.Opcode = QuietOpcode(mcReq.Opcode)
+	}
+	return &AsciiRequest{
+		Req:     mcReq,
+		Buf:     buf,
+		NoReply: noReply,
+		Reply: func(source *AsciiSource, bw *bufio.Writer,
+			areq *AsciiRequest) bool {
+			if areq.Response.Status != gomemcached.SUCCESS {
+				bw.Write(AsciiStatusReply(areq.Req, areq.Response.Status))
+				return true
+			}
+			return reply(source, bw, areq)
+		},
+	}
 }
 
 var asciiCmds = map[string]*AsciiCmd{
 	"quit": &AsciiCmd{
 		gomemcached.QUIT,
-		func(source *AsciiSource,
-			target Target, res chan *gomemcached.MCResponse,
-			cmd *AsciiCmd, req []string, br *bufio.Reader, bw *bufio.Writer,
-			clientNum uint32) bool {
-			return false
+		func(source *AsciiSource, cmd *AsciiCmd, req [][]byte,
+			br *bufio.Reader) *AsciiRequest {
+			return AsciiLocalRequest(func(source *AsciiSource,
+				bw *bufio.Writer, areq *AsciiRequest) bool {
+				return false
+			})
 		},
 	},
 	"version": &AsciiCmd{
 		gomemcached.VERSION,
-		func(source *AsciiSource,
-			target Target, res chan *gomemcached.MCResponse,
-			cmd *AsciiCmd, req []string, br *bufio.Reader, bw *bufio.Writer,
-			clientNum uint32) bool {
-			bw.Write([]byte(version))
-			bw.Flush()
-			return true
-		},
-	},
-	"get": &AsciiCmd{
-		gomemcached.GET,
-		func(source *AsciiSource,
-			target Target, res chan *gomemcached.MCResponse,
-			cmd *AsciiCmd, req []string, br *bufio.Reader, bw *bufio.Writer,
-			clientNum uint32) bool {
-			if len(req) != 2 {
-				return AsciiClientError(bw, "expected 1 param for get command\r\n")
-			}
-			key := req[1]
-			if len(key) <= 0 {
-				return AsciiClientError(bw, "missing key\r\n")
-			}
-			reqs := make([]Request, 1)
-			reqs[0] = Request{
-				"default",
-				&gomemcached.MCRequest{
-					Opcode: cmd.Opcode,
-					Key:    []byte(key),
-				},
-				res,
-				clientNum,
-			}
-			targetChan := target.PickChannel(clientNum, "default")
-			targetChan <- reqs
-			response := <-res
-			if response.Status == gomemcached.SUCCESS {
-				flg := uint64(binary.BigEndian.Uint32(response.Extras))
-
-				bw.Write([]byte("VALUE "))
-				bw.Write(response.Key)
-				bw.Write(space)
-				bw.Write([]byte(strconv.FormatUint(flg, 10)))
-				bw.Write(space)
-				bw.Write([]byte(strconv.FormatUint(uint64(len(response.Body)), 10)))
-				bw.Write(crnl)
-				bw.Write(response.Body)
-				bw.Write(crnl)
-			}
-			bw.Write([]byte("END\r\n"))
-			bw.Flush()
-			return true
+		func(source *AsciiSource, cmd *AsciiCmd, req [][]byte,
+			br *bufio.Reader) *AsciiRequest {
+			return AsciiLocalRequest(func(source *AsciiSource,
+				bw *bufio.Writer, areq *AsciiRequest) bool {
+				bw.Write(version)
+				return true
+			})
 		},
 	},
+	"get":  &AsciiCmd{gomemcached.GET, AsciiCmdGet},
+	"gets": &AsciiCmd{gomemcached.GET, AsciiCmdGet},
+	"gat":  &AsciiCmd{gomemcached.GAT, AsciiCmdGat},
+	"gats": &AsciiCmd{gomemcached.GAT, AsciiCmdGat},
 	"delete": &AsciiCmd{
 		gomemcached.DELETE,
-		func(source *AsciiSource,
-			target Target, res chan *gomemcached.MCResponse,
-			cmd *AsciiCmd, req []string, br *bufio.Reader, bw *bufio.Writer,
-			clientNum uint32) bool {
+		func(source *AsciiSource, cmd *AsciiCmd, req [][]byte,
+			br *bufio.Reader) *AsciiRequest {
+			req, noReply := AsciiNoReply(req)
 			if len(req) != 2 {
-				return AsciiClientError(bw, "expected 1 param for delete command\r\n")
-			}
-			key := req[1]
-			if len(key) <= 0 {
-				return AsciiClientError(bw, "missing key\r\n")
-			}
-			reqs := make([]Request, 1)
-			reqs[0] = Request{
-				"default",
-				&gomemcached.MCRequest{
-					Opcode: cmd.Opcode,
-					Key:    []byte(key),
-				},
-				res,
-				clientNum,
-			}
-			targetChan := target.PickChannel(clientNum, "default")
-			targetChan <- reqs
-			response := <-res
-			if response.Status == gomemcached.SUCCESS {
-				bw.Write([]byte("DELETED\r\n"))
-			} else {
-				bw.Write([]byte("NOT_FOUND\r\n"))
+				return AsciiClientErrorRequest("expected 1 param for delete command\r\n")
 			}
-			bw.Flush()
-			return true
+			key := AsciiSourceKey(req[1])
+			return AsciiTargetRequest(&gomemcached.MCRequest{
+				Opcode: cmd.Opcode,
+				Key:    key,
+			}, key, noReply, AsciiReplyDelete)
 		},
 	},
+	"stats":   &AsciiCmd{gomemcached.STAT, AsciiCmdStats},
 	"set":     &AsciiCmd{gomemcached.SET, AsciiCmdMutation},
 	"add":     &AsciiCmd{gomemcached.ADD, AsciiCmdMutation},
 	"replace": &AsciiCmd{gomemcached.REPLACE, AsciiCmdMutation},
 	"prepend": &AsciiCmd{gomemcached.PREPEND, AsciiCmdMutation},
 	"append":  &AsciiCmd{gomemcached.APPEND, AsciiCmdMutation},
+	"cas":     &AsciiCmd{gomemcached.SET, AsciiCmdMutation},
+	"incr":    &AsciiCmd{gomemcached.INCREMENT, AsciiCmdArith},
+	"decr":    &AsciiCmd{gomemcached.DECREMENT, AsciiCmdArith},
+	"touch":   &AsciiCmd{gomemcached.TOUCH, AsciiCmdTouch},
+
+	"flush_all": &AsciiCmd{gomemcached.FLUSH, AsciiCmdFlushAll},
+
+	// The meta commands (see source-ascii-meta.go).
+	"mg": &AsciiCmd{gomemcached.GET, AsciiCmdMetaGet},
+	"ms": &AsciiCmd{gomemcached.SET, AsciiCmdMetaSet},
+	"md": &AsciiCmd{gomemcached.DELETE, AsciiCmdMetaDelete},
+	"ma": &AsciiCmd{gomemcached.INCREMENT, AsciiCmdMetaArith},
+	"mn": &AsciiCmd{gomemcached.NOOP, AsciiCmdMetaNoop},
+	"me": &AsciiCmd{gomemcached.GET, AsciiCmdMetaDebug},
+
+	// As grouter has no log levels, verbosity is just acknowledged.
+	"verbosity": &AsciiCmd{
+		gomemcached.VERBOSITY,
+		func(source *AsciiSource, cmd *AsciiCmd, req [][]byte,
+			br *bufio.Reader) *AsciiRequest {
+			req, noReply := AsciiNoReply(req)
+			if len(req) != 2 {
+				return AsciiClientErrorRequest("expected 1 param for verbosity command\r\n")
+			}
+			areq := AsciiLocalRequest(func(source *AsciiSource,
+				bw *bufio.Writer, areq *AsciiRequest) bool {
+				bw.Write(reply_ok)
+				return true
+			})
+			areq.NoReply = noReply
+			return areq
+		},
+	},
 }
 
-func AsciiCmdMutation(source *AsciiSource,
-	target Target, res chan *gomemcached.MCResponse,
-	cmd *AsciiCmd, req []string, br *bufio.Reader, bw *bufio.Writer,
-	clientNum uint32) bool {
-	if len(req) != 5 {
-		return AsciiClientError(bw, "expected 4 params for set command\r\n")
+// Strips a trailing noreply from a command's fields.
+func AsciiNoReply(req [][]byte) ([][]byte, bool) {
+	if len(req) > 2 && bytes.Equal(req[len(req)-1], noreply) {
+		return req[:len(req)-1], true
 	}
-	key := req[1]
-	if len(key) <= 0 {
-		return AsciiClientError(bw, "missing key\r\n")
+	return req, false
+}
+
+// Returns the reply to a response's non-success status, following
+// memcached, such as a NOT_STORED for an add of an existing key, or an
+// END for a get of a missing key.  Other statuses, such as the EINVAL
+// of a target whose backend conn failed, are a plain SERVER_ERROR.
+func AsciiStatusReply(req *gomemcached.MCRequest,
+	status gomemcached.Status) []byte {
+	opcode := UnquietOpcode(req.Opcode)
+	switch status {
+	case gomemcached.KEY_ENOENT:
+		switch opcode {
+		case gomemcached.GET, gomemcached.GAT:
+			return reply_end
+		case gomemcached.SET:
+			if req.Cas == 0 {
+				return reply_not_stored
+			}
+		case gomemcached.ADD, gomemcached.REPLACE,
+			gomemcached.APPEND, gomemcached.PREPEND:
+			return reply_not_stored
+		}
+		return reply_not_found
+	case gomemcached.KEY_EEXISTS:
+		if opcode == gomemcached.SET && req.Cas != 0 {
+			return reply_exists
+		}
+		return reply_not_stored
+	case gomemcached.NOT_STORED:
+		return reply_not_stored
+	case gomemcached.E2BIG:
+		return reply_too_large
+	case gomemcached.DELTA_BADVAL:
+		return reply_non_numeric
+	case gomemcached.ENOMEM:
+		return reply_out_of_memory
+	case gomemcached.TMPFAIL:
+		return reply_tmpfail
+	case gomemcached.NOT_MY_VBUCKET:
+		return reply_not_my_vb
+	case gomemcached.UNKNOWN_COMMAND:
+		return reply_unsupported
+	case ETIMEDOUT:
+		return reply_timeout
+	case EBUSY:
+		return reply_busy
 	}
-	flg, e := strconv.ParseUint(req[2], 10, 0)
-	if e != nil {
-		return AsciiClientError(bw, "could not parse flag\r\n")
+	return reply_server_error
+}
+
+func AsciiReplyGet(source *AsciiSource, bw *bufio.Writer,
+	areq *AsciiRequest) bool {
+	asciiReplyValue(bw, areq.Response, false)
+	return true
+}
+
+// The reply of gets and gats, whose VALUE lines have the value's cas.
+func AsciiReplyGets(source *AsciiSource, bw *bufio.Writer,
+	areq *AsciiRequest) bool {
+	asciiReplyValue(bw, areq.Response, true)
+	return true
+}
+
+func asciiReplyValue(bw *bufio.Writer, response *gomemcached.MCResponse,
+	withCas bool) {
+	flg := uint64(binary.BigEndian.Uint32(response.Extras))
+
+	var scratch [20]byte
+	bw.Write(reply_value)
+	bw.Write(response.Key)
+	bw.Write(space)
+	bw.Write(strconv.AppendUint(scratch[:0], flg, 10))
+	bw.Write(space)
+	bw.Write(strconv.AppendUint(scratch[:0], uint64(len(response.Body)), 10))
+	if withCas {
+		bw.Write(space)
+		bw.Write(strconv.AppendUint(scratch[:0], response.Cas, 10))
 	}
-	exp, e := strconv.ParseUint(req[3], 10, 0)
-	if e != nil {
-		return AsciiClientError(bw, "could not parse expiration\r\n")
+	bw.Write(crnl)
+	bw.Write(response.Body)
+	bw.Write(crnl)
+	bw.Write(reply_end)
+}
+
+func AsciiReplyDelete(source *AsciiSource, bw *bufio.Writer,
+	areq *AsciiRequest) bool {
+	bw.Write(reply_deleted)
+	return true
+}
+
+func AsciiReplyMutation(source *AsciiSource, bw *bufio.Writer,
+	areq *AsciiRequest) bool {
+	bw.Write(reply_stored)
+	return true
+}
+
+func AsciiReplyArith(source *AsciiSource, bw *bufio.Writer,
+	areq *AsciiRequest) bool {
+	if len(areq.Response.Body) != 8 {
+		bw.Write(reply_server_error)
+		return true
+	}
+	var scratch [20]byte
+	bw.Write(strconv.AppendUint(scratch[:0],
+		binary.BigEndian.Uint64(areq.Response.Body), 10))
+	bw.Write(crnl)
+	return true
+}
+
+func AsciiReplyOK(source *AsciiSource, bw *bufio.Writer,
+	areq *AsciiRequest) bool {
+	bw.Write(reply_ok)
+	return true
+}
+
+func AsciiReplyTouch(source *AsciiSource, bw *bufio.Writer,
+	areq *AsciiRequest) bool {
+	bw.Write(reply_touched)
+	return true
+}
+
+// Handles get and gets, which differ in whether their reply has cas.
+func AsciiCmdGet(source *AsciiSource, cmd *AsciiCmd, req [][]byte,
+	br *bufio.Reader) *AsciiRequest {
+	if len(req) != 2 {
+		return AsciiClientErrorRequest("expected 1 param for " +
+			string(req[0]) + " command\r\n")
+	}
+	reply := AsciiReplyGet
+	if string(req[0]) == "gets" {
+		reply = AsciiReplyGets
 	}
-	nval, e := strconv.Atoi(req[4])
-	if e != nil || nval < 0 {
-		return AsciiClientError(bw, "could not parse value length\r\n")
+	key := AsciiSourceKey(req[1])
+	return AsciiTargetRequest(&gomemcached.MCRequest{
+		Opcode: cmd.Opcode,
+		Key:    key,
+	}, key, false, reply)
+}
+
+// Handles gat and gats, which get an item and touch its expiration.
+func AsciiCmdGat(source *AsciiSource, cmd *AsciiCmd, req [][]byte,
+	br *bufio.Reader) *AsciiRequest {
+	if len(req) != 3 {
+		return AsciiClientErrorRequest("expected 2 params for " +
+			string(req[0]) + " command\r\n")
+	}
+	exp, ok := AsciiParseUint(req[1], 32)
+	if !ok {
+		return AsciiClientErrorRequest("could not parse expiration\r\n")
+	}
+	reply := AsciiReplyGet
+	if string(req[0]) == "gats" {
+		reply = AsciiReplyGets
+	}
+
+	nkey := len(req[2])
+	buf := BufGet(4 + nkey)
+	extras := buf[:4]
+	binary.BigEndian.PutUint32(extras, uint32(exp))
+	key := buf[4:]
+	copy(key, req[2])
+
+	return AsciiTargetRequest(&gomemcached.MCRequest{
+		Opcode: cmd.Opcode,
+		Key:    key,
+		Extras: extras,
+	}, buf, false, reply)
+}
+
+// Handles the storage commands, where cas has an extra cas param.
+func AsciiCmdMutation(source *AsciiSource, cmd *AsciiCmd, req [][]byte,
+	br *bufio.Reader) *AsciiRequest {
+	req, noReply := AsciiNoReply(req)
+	isCas := string(req[0]) == "cas"
+	if isCas && len(req) != 6 {
+		return AsciiClientErrorRequest("expected 5 params for cas command\r\n")
+	}
+	if !isCas && len(req) != 5 {
+		return AsciiClientErrorRequest("expected 4 params for " +
+			string(req[0]) + " command\r\n")
+	}
+	var cas uint64
+	if isCas {
+		var ok bool
+		if cas, ok = AsciiParseUint(req[5], 64); !ok {
+			return AsciiClientErrorRequest("could not parse cas\r\n")
+		}
+	}
+	flg, ok := AsciiParseUint(req[2], 32)
+	if !ok {
+		return AsciiClientErrorRequest("could not parse flag\r\n")
 	}
-	buf := make([]byte, nval+2)
-	nbuf, e := io.ReadFull(br, buf)
+	exp, ok := AsciiParseUint(req[3], 32)
+	if !ok {
+		return AsciiClientErrorRequest("could not parse expiration\r\n")
+	}
+	nval64, ok := AsciiParseUint(req[4], 31)
+	if !ok {
+		return AsciiClientErrorRequest("could not parse value length\r\n")
+	}
+	nval := int(nval64)
+
+	// The extras, key and value share a pooled buffer, where the key
+	// is copied before reading the value, which reuses br's buffer.
+	nkey := len(req[1])
+	buf := BufGet(8 + nkey + nval + 2)
+	extras := buf[:8]
+	key := buf[8 : 8+nkey]
+	copy(key, req[1])
+	binary.BigEndian.PutUint32(extras, uint32(flg))
+	binary.BigEndian.PutUint32(extras[4:], uint32(exp))
+
+	val := buf[8+nkey:]
+	nbuf, e := io.ReadFull(br, val)
 	if e != nil {
 		log.Printf("AsciiSource error: %s", e)
-		return false
+		return nil
 	}
 	if nbuf != nval+2 {
 		log.Printf("AsciiSource nbuf error: %s", e)
-		return false
+		return nil
 	}
-	if !bytes.Equal(buf[nbuf-2:], crnl) {
-		return AsciiClientError(bw, "was expecting CRNL value termination\r\n")
+	if !bytes.Equal(val[nval:], crnl) {
+		BufPut(buf)
+		return AsciiClientErrorRequest("was expecting CRNL value termination\r\n")
 	}
-	val := buf[:nval]
 
-	extras := make([]byte, 8)
-	binary.BigEndian.PutUint32(extras, uint32(flg))
-	binary.BigEndian.PutUint32(extras[4:], uint32(exp))
+	return AsciiTargetRequest(&gomemcached.MCRequest{
+		Opcode: cmd.Opcode,
+		Cas:    cas,
+		Key:    key,
+		Extras: extras,
+		Body:   val[:nval],
+	}, buf, noReply, AsciiReplyMutation)
+}
 
-	reqs := make([]Request, 1)
-	reqs[0] = Request{
-		"default",
-		&gomemcached.MCRequest{
-			Opcode: cmd.Opcode,
-			Key:    []byte(key),
-			Extras: extras,
-			Body:   val,
-		},
-		res,
-		clientNum,
-	}
-	targetChan := target.PickChannel(clientNum, "default")
-	targetChan <- reqs
-	response := <-res
-	if response.Status == gomemcached.SUCCESS {
-		bw.Write([]byte("STORED\r\n"))
-		bw.Flush()
-		return true
+// Handles flush_all [delay] [noreply], which every server behind the
+// target flushes, unless flush_all is disabled (see FlushAllEnable).
+func AsciiCmdFlushAll(source *AsciiSource, cmd *AsciiCmd, req [][]byte,
+	br *bufio.Reader) *AsciiRequest {
+	noReply := false
+	if len(req) > 1 && bytes.Equal(req[len(req)-1], noreply) {
+		req, noReply = req[:len(req)-1], true
+	}
+	if len(req) > 2 {
+		return AsciiClientErrorRequest("expected at most 1 param for flush_all command\r\n")
+	}
+	var delay uint64
+	if len(req) == 2 {
+		var ok bool
+		if delay, ok = AsciiParseUint(req[1], 32); !ok {
+			return AsciiClientErrorRequest("could not parse delay\r\n")
+		}
+	}
+	if !FlushAllEnabled() {
+		// A noreply client won't read the error, so it's not sent.
+		areq := AsciiClientErrorRequest("flush_all not allowed\r\n")
+		areq.NoReply = noReply
+		return areq
+	}
+
+	buf := BufGet(4)
+	binary.BigEndian.PutUint32(buf, uint32(delay))
+	return AsciiTargetRequest(&gomemcached.MCRequest{
+		Opcode: cmd.Opcode,
+		Extras: buf,
+	}, buf, noReply, AsciiReplyOK)
+}
+
+// Handles incr and decr, whose requests have extras of the delta, an
+// initial value and an expiration, where an expiration of 0xffffffff
+// means a missing key isn't created, as ascii incr and decr don't.
+func AsciiCmdArith(source *AsciiSource, cmd *AsciiCmd, req [][]byte,
+	br *bufio.Reader) *AsciiRequest {
+	req, noReply := AsciiNoReply(req)
+	if len(req) != 3 {
+		return AsciiClientErrorRequest("expected 2 params for " +
+			string(req[0]) + " command\r\n")
+	}
+	delta, ok := AsciiParseUint(req[2], 64)
+	if !ok {
+		return AsciiClientErrorRequest("invalid numeric delta argument\r\n")
+	}
+
+	nkey := len(req[1])
+	buf := BufGet(20 + nkey)
+	extras := buf[:20]
+	binary.BigEndian.PutUint64(extras, delta)
+	binary.BigEndian.PutUint64(extras[8:], 0)
+	binary.BigEndian.PutUint32(extras[16:], 0xffffffff)
+	key := buf[20:]
+	copy(key, req[1])
+
+	return AsciiTargetRequest(&gomemcached.MCRequest{
+		Opcode: cmd.Opcode,
+		Key:    key,
+		Extras: extras,
+	}, buf, noReply, AsciiReplyArith)
+}
+
+func AsciiCmdTouch(source *AsciiSource, cmd *AsciiCmd, req [][]byte,
+	br *bufio.Reader) *AsciiRequest {
+	req, noReply := AsciiNoReply(req)
+	if len(req) != 3 {
+		return AsciiClientErrorRequest("expected 2 params for touch command\r\n")
+	}
+	exp, ok := AsciiParseUint(req[2], 32)
+	if !ok {
+		return AsciiClientErrorRequest("could not parse expiration\r\n")
+	}
+
+	nkey := len(req[1])
+	buf := BufGet(4 + nkey)
+	extras := buf[:4]
+	binary.BigEndian.PutUint32(extras, uint32(exp))
+	key := buf[4:]
+	copy(key, req[1])
+
+	return AsciiTargetRequest(&gomemcached.MCRequest{
+		Opcode: cmd.Opcode,
+		Key:    key,
+		Extras: extras,
+	}, buf, noReply, AsciiReplyTouch)
+}
+
+// Returns a copy of a key in a pooled buffer, as the key's bytes are
+// only valid until the next read of the conn.
+func AsciiSourceKey(b []byte) []byte {
+	key := BufGet(len(b))
+	copy(key, b)
+	return key
+}
+
+// Returns the pooled buffer of a request to the pool, unless the
+// request timed out, as its target might still be using the buffer.
+func AsciiSourceRelease(buf []byte, response *gomemcached.MCResponse) {
+	if response.Status != ETIMEDOUT {
+		BufPut(buf)
+	}
+}
+
+// Splits a command line into its space separated fields, appending
+// them to fields, which can be reused across lines to avoid garbage.
+// The fields refer to the bytes of the line.
+func AsciiFields(line []byte, fields [][]byte) [][]byte {
+	start := -1
+	for i, c := range line {
+		if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+			if start >= 0 {
+				fields = append(fields, line[start:i])
+				start = -1
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		fields = append(fields, line[start:])
+	}
+	return fields
+}
+
+// Parses a decimal unsigned integer that fits in the given bits,
+// without converting the bytes to a string.
+func AsciiParseUint(b []byte, bits uint) (uint64, bool) {
+	if len(b) <= 0 || len(b) > 20 {
+		return 0, false
+	}
+	var n uint64
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		d := uint64(c - '0')
+		if n > (1<<64-1-d)/10 {
+			return 0, false
+		}
+		n = n*10 + d
+	}
+	if bits < 64 && n >= 1<<bits {
+		return 0, false
+	}
+	return n, true
+}
+
+func AsciiSourceWait(req Request) *gomemcached.MCResponse {
+	if req.Deadline.IsZero() {
+		return <-req.Res
+	}
+
+	timer := time.NewTimer(req.Deadline.Sub(time.Now()))
+	defer timer.Stop()
+
+	select {
+	case response := <-req.Res:
+		return response
+	case <-timer.C:
+		return &gomemcached.MCResponse{
+			Opcode: req.Req.Opcode,
+			Status: ETIMEDOUT,
+			Opaque: req.Req.Opaque,
+			Key:    req.Req.Key,
+		}
 	}
-	bw.Write([]byte("SERVER_ERROR\r\n"))
-	bw.Flush()
-	return true
 }
 
 func AsciiClientError(bw *bufio.Writer, msg string) bool {
 	bw.Write([]byte("CLIENT_ERROR "))
 	bw.Write([]byte(msg))
-	bw.Flush()
+	return true
+}
+
+func AsciiServerError(bw *bufio.Writer, msg string) bool {
+	bw.Write([]byte("SERVER_ERROR "))
+	bw.Write([]byte(msg))
 	return true
 }
@@ -0,0 +1,172 @@
+package grouter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/dustin/gomemcached"
+)
+
+func TestAsciiStatusReply(t *testing.T) {
+	tests := []struct {
+		opcode gomemcached.CommandCode
+		cas    uint64
+		status gomemcached.Status
+		exp    string
+	}{
+		{gomemcached.GET, 0, gomemcached.KEY_ENOENT, "END\r\n"},
+		{gomemcached.GAT, 0, gomemcached.KEY_ENOENT, "END\r\n"},
+		{gomemcached.SET, 0, gomemcached.KEY_ENOENT, "NOT_STORED\r\n"},
+		{gomemcached.SET, 1, gomemcached.KEY_ENOENT, "NOT_FOUND\r\n"},
+		{gomemcached.SETQ, 1, gomemcached.KEY_ENOENT, "NOT_FOUND\r\n"},
+		{gomemcached.ADD, 0, gomemcached.KEY_ENOENT, "NOT_STORED\r\n"},
+		{gomemcached.REPLACE, 0, gomemcached.KEY_ENOENT, "NOT_STORED\r\n"},
+		{gomemcached.APPENDQ, 0, gomemcached.KEY_ENOENT, "NOT_STORED\r\n"},
+		{gomemcached.DELETE, 0, gomemcached.KEY_ENOENT, "NOT_FOUND\r\n"},
+		{gomemcached.INCREMENT, 0, gomemcached.KEY_ENOENT, "NOT_FOUND\r\n"},
+		{gomemcached.TOUCH, 0, gomemcached.KEY_ENOENT, "NOT_FOUND\r\n"},
+		{gomemcached.SET, 1, gomemcached.KEY_EEXISTS, "EXISTS\r\n"},
+		{gomemcached.SET, 0, gomemcached.KEY_EEXISTS, "NOT_STORED\r\n"},
+		{gomemcached.ADD, 0, gomemcached.KEY_EEXISTS, "NOT_STORED\r\n"},
+		{gomemcached.ADDQ, 0, gomemcached.KEY_EEXISTS, "NOT_STORED\r\n"},
+		{gomemcached.DELETE, 1, gomemcached.KEY_EEXISTS, "NOT_STORED\r\n"},
+		{gomemcached.APPEND, 0, gomemcached.NOT_STORED, "NOT_STORED\r\n"},
+		{gomemcached.SET, 0, gomemcached.E2BIG,
+			"CLIENT_ERROR value too large\r\n"},
+		{gomemcached.INCREMENT, 0, gomemcached.DELTA_BADVAL,
+			"CLIENT_ERROR cannot increment or decrement non-numeric value\r\n"},
+		{gomemcached.SET, 0, gomemcached.ENOMEM,
+			"SERVER_ERROR out of memory\r\n"},
+		{gomemcached.GET, 0, gomemcached.TMPFAIL,
+			"SERVER_ERROR temporary failure\r\n"},
+		{gomemcached.GET, 0, gomemcached.NOT_MY_VBUCKET,
+			"SERVER_ERROR not my vbucket\r\n"},
+		{gomemcached.TOUCH, 0, gomemcached.UNKNOWN_COMMAND,
+			"SERVER_ERROR not supported by target\r\n"},
+		{gomemcached.GET, 0, ETIMEDOUT, "SERVER_ERROR timeout\r\n"},
+		{gomemcached.SET, 0, EBUSY, "SERVER_ERROR busy\r\n"},
+		{gomemcached.GET, 0, gomemcached.EINVAL, "SERVER_ERROR\r\n"},
+	}
+	for _, test := range tests {
+		req := &gomemcached.MCRequest{Opcode: test.opcode, Cas: test.cas}
+		if reply := string(AsciiStatusReply(req, test.status)); reply != test.exp {
+			t.Errorf("%v, cas %v, %v: expected %q, got %q",
+				test.opcode, test.cas, test.status, test.exp, reply)
+		}
+	}
+}
+
+func TestAsciiStatsConns(t *testing.T) {
+	// The first conns of two sources have the same client number.
+	c0 := AsciiConnsAdd(&asciiTestConn{}, 1)
+	c1 := AsciiConnsAdd(&asciiTestConn{}, 1)
+	defer AsciiConnsRemove(c0)
+	defer AsciiConnsRemove(c1)
+
+	var buf bytes.Buffer
+	bw := bufio.NewWriter(&buf)
+	AsciiStatsConns(bw)
+	bw.Flush()
+
+	for _, c := range []*AsciiConn{c0, c1} {
+		addr := fmt.Sprintf("STAT %d:addr ", c.Id)
+		if n := strings.Count(buf.String(), addr); n != 1 {
+			t.Errorf("expected one addr of conn %v, got %v in %q",
+				c.Id, n, buf.String())
+		}
+	}
+	if c0.Id == c1.Id {
+		t.Errorf("expected different ids, got %v", c0.Id)
+	}
+}
+
+// A conn whose client sends its commands up front, and keeps the
+// replies in w, or ignores them when w is nil.
+type asciiTestConn struct {
+	r *bytes.Reader
+	w *bytes.Buffer
+}
+
+func (c *asciiTestConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *asciiTestConn) Write(p []byte) (int, error) {
+	if c.w != nil {
+		return c.w.Write(p)
+	}
+	return len(p), nil
+}
+
+func TestAsciiSourceFlushAllDisabled(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	FlushAllEnable(false)
+	defer FlushAllEnable(true)
+
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"flush_all\r\n", "CLIENT_ERROR flush_all not allowed\r\n"},
+		{"flush_all 10\r\n", "CLIENT_ERROR flush_all not allowed\r\n"},
+		{"flush_all noreply\r\nversion\r\n", string(version)},
+		{"flush_all 10 noreply\r\nversion\r\n", string(version)},
+	}
+	for _, test := range tests {
+		stats := NewStats()
+		params := Params{TargetChanSize: 10}
+		target, _ := MemoryStorageStart("memory", params, stats)
+		conn := &asciiTestConn{
+			r: bytes.NewReader([]byte(test.in)),
+			w: &bytes.Buffer{},
+		}
+		AsciiSource{}.Run(conn, 0, params, target, stats)
+		target.Close()
+		if conn.w.String() != test.out {
+			t.Errorf("%q: expected %q, got %q", test.in, test.out, conn.w.String())
+		}
+	}
+}
+
+// Runs the ascii source on a conn that sends setup once and then cmd
+// b.N times, against a memory target.
+func benchmarkAsciiSource(b *testing.B, setup, cmd string) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	stats := NewStats()
+	params := Params{TargetChanSize: 10}
+	target, err := MemoryStorageStart("memory", params, stats)
+	if err != nil {
+		b.Fatalf("MemoryStorageStart: %v", err)
+	}
+	defer target.Close()
+
+	conn := &asciiTestConn{
+		r: bytes.NewReader([]byte(setup + strings.Repeat(cmd, b.N))),
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	AsciiSource{}.Run(conn, 0, params, target, stats)
+}
+
+func BenchmarkAsciiSourceGet(b *testing.B) {
+	benchmarkAsciiSource(b, "set a 0 0 5\r\nhello\r\n", "get a\r\n")
+}
+
+func BenchmarkAsciiSourceGetMiss(b *testing.B) {
+	benchmarkAsciiSource(b, "", "get a\r\n")
+}
+
+func BenchmarkAsciiSourceSet(b *testing.B) {
+	benchmarkAsciiSource(b, "", "set a 0 0 5\r\nhello\r\n")
+}
@@ -0,0 +1,709 @@
+package grouter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+// A source that handles a subset of the redis protocol (RESP2), whose
+// commands map onto memcached requests, such as GET, SET and INCR, so
+// that redis clients can use memcached or couchbase targets.  Values
+// are plain strings, and counters are unsigned, like memcached's.
+
+var (
+	redis_ok       = []byte("+OK\r\n")
+	redis_pong     = []byte("+PONG\r\n")
+	redis_nil      = []byte("$-1\r\n")
+	redis_ttl_miss = []byte(":-2\r\n")
+	redis_syntax   = "ERR syntax error"
+	redis_not_int  = "ERR value is not an integer or out of range"
+)
+
+// Max args of a command, like redis.  The max bytes of an arg is the
+// RedisMaxBulk param.
+const redisMaxArgs = 1024 * 1024
+
+// As a client's claimed lengths aren't trusted, the args of a command
+// are preallocated up to redisArgsPrealloc, and bulks larger than
+// redisBulkChunk are read a chunk at a time, so memory is only
+// allocated as the data arrives.
+const redisArgsPrealloc = 16
+const redisBulkChunk = 64 * 1024
+
+// Ttls over 30 days are sent to targets as unix times, like memcached.
+const redisMonthSecs = 30 * 24 * 60 * 60
+
+type RedisSource struct {
+	// Per-connection fields, set by Run().
+	params Params
+	stats  *Stats
+	bucket string // The bucket of SELECT, "default" for db 0.
+
+	// Cached, to avoid registry lookups on every request.
+	ops map[[3]string]*StatsOp
+}
+
+// Max commands, and max bytes of their args, that a conn reads ahead of
+// its replies when a client pipelines commands.
+const redisPipelineMax = 100
+const redisPipelineMaxBytes = 1024 * 1024
+
+func (self RedisSource) Run(s io.ReadWriter, clientNum uint32, params Params,
+	target Target, stats *Stats) {
+	self.params = params
+	self.stats = stats
+	self.bucket = "default"
+	self.ops = make(map[[3]string]*StatsOp)
+
+	br := bufio.NewReader(s)
+	bw := bufio.NewWriter(s)
+
+	// Like the ascii source, buffered pipelined commands are sent to the
+	// target as one batch, and their replies are flushed together.
+	pipeline := make([]*RedisRequest, 0, redisPipelineMax)
+	pipelineBytes := 0
+
+	for {
+		args, err := RedisReadCommand(br, params.RedisMaxBulk)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("RedisSource error: %s", err)
+				RedisError(bw, "ERR Protocol error: "+err.Error())
+				bw.Flush()
+			}
+			return
+		}
+		if len(args) <= 0 {
+			continue
+		}
+		start := time.Now()
+
+		name := strings.ToLower(string(args[0]))
+		var rreq *RedisRequest
+		if cmd := redisCmds[name]; cmd == nil {
+			rreq = RedisErrorRequest(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+			name = "unknown"
+		} else if (cmd.Arity > 0 && len(args) != cmd.Arity) ||
+			(cmd.Arity < 0 && len(args) < -cmd.Arity) {
+			rreq = RedisErrorRequest(fmt.Sprintf(
+				"ERR wrong number of arguments for '%s' command", name))
+		} else {
+			rreq = cmd.Parse(&self, args)
+		}
+		rreq.args = args
+		rreq.name = name
+		rreq.bucket = self.bucket
+		rreq.start = start
+
+		pipeline = append(pipeline, rreq)
+		for _, arg := range args {
+			pipelineBytes += len(arg)
+		}
+
+		// Commands that the source handles itself, like SELECT, aren't
+		// read ahead of, so a batch's requests are all of one bucket.
+		if len(rreq.Reqs) > 0 &&
+			len(pipeline) < redisPipelineMax &&
+			pipelineBytes < redisPipelineMaxBytes &&
+			asciiLineBuffered(br) {
+			continue
+		}
+
+		ok := self.reply(pipeline, target, clientNum, bw)
+		for i := range pipeline {
+			pipeline[i] = nil
+		}
+		pipeline = pipeline[:0]
+		pipelineBytes = 0
+		if !ok {
+			return
+		}
+	}
+}
+
+// Sends the pipeline's requests to the target, as one batch, then
+// waits for their responses and writes the replies, in order, and
+// flushes them.  Returns false when the conn should be closed.
+func (self *RedisSource) reply(pipeline []*RedisRequest, target Target,
+	clientNum uint32, bw *bufio.Writer) bool {
+	var reqs []Request
+	for _, rreq := range pipeline {
+		for _, mcReq := range rreq.Reqs {
+			req := Request{
+				Bucket:    rreq.bucket,
+				Req:       mcReq,
+				Res:       make(chan *gomemcached.MCResponse, 1),
+				ClientNum: clientNum,
+				Deadline:  self.params.RequestDeadline(rreq.start),
+				Meta:      rreq.Meta,
+			}
+			rreq.requests = append(rreq.requests, req)
+			reqs = append(reqs, req)
+		}
+	}
+	if len(reqs) > 0 {
+		SendRequests(target.PickChannel(clientNum, reqs[0].Bucket), reqs)
+	}
+
+	ok := true
+	for _, rreq := range pipeline {
+		status := "ok"
+		timedOut := false
+		for i, req := range rreq.requests {
+			res := AsciiSourceWait(req)
+			rreq.Responses = append(rreq.Responses, res)
+			HotKeysRecord(rreq.bucket, req.Req.Key, len(req.Req.Body)+len(res.Body))
+			if i == 0 || res.Status != gomemcached.SUCCESS &&
+				res.Status != gomemcached.KEY_ENOENT {
+				status = StatusName(req.Req.Opcode, res.Status)
+			}
+			timedOut = timedOut || res.Status == ETIMEDOUT
+		}
+		if rreq.status != "" {
+			status = rreq.status
+		}
+
+		if ok {
+			ok = rreq.Reply(self, bw, rreq)
+		}
+
+		// As a target might still be using the args of a timed out
+		// request, they're left to the garbage collector.
+		if !timedOut {
+			for _, arg := range rreq.args {
+				BufPut(arg)
+			}
+		}
+
+		o := self.ops[[3]string{rreq.bucket, rreq.name, status}]
+		if o == nil {
+			o = self.stats.Op("tot-source-redis-ops", "bucket", rreq.bucket,
+				"opcode", rreq.name, "status", status)
+			self.ops[[3]string{rreq.bucket, rreq.name, status}] = o
+		}
+		o.Record(time.Since(rreq.start))
+	}
+	bw.Flush()
+	return ok
+}
+
+// Reads a command, which is either a RESP array of bulk strings, of up
+// to maxBulk bytes each, or an inline command, such as "PING", whose
+// args are in pooled buffers.
+func RedisReadCommand(br *bufio.Reader, maxBulk int) ([][]byte, error) {
+	line, isPrefix, err := br.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	if isPrefix {
+		return nil, fmt.Errorf("command line is too long")
+	}
+	if len(line) <= 0 || line[0] != '*' {
+		fields := AsciiFields(line, nil)
+		args := make([][]byte, len(fields))
+		for i, field := range fields {
+			args[i] = AsciiSourceKey(field)
+		}
+		return args, nil
+	}
+
+	n, ok := AsciiParseUint(line[1:], 31)
+	if !ok || n > redisMaxArgs {
+		return nil, fmt.Errorf("invalid multibulk length")
+	}
+	prealloc := n
+	if prealloc > redisArgsPrealloc {
+		prealloc = redisArgsPrealloc
+	}
+	args := make([][]byte, 0, prealloc)
+
+	// On an error, the args that were already read are put back.
+	fail := func(err error) ([][]byte, error) {
+		for _, arg := range args {
+			BufPut(arg)
+		}
+		return nil, err
+	}
+
+	for i := 0; i < int(n); i++ {
+		line, isPrefix, err = br.ReadLine()
+		if err != nil {
+			return fail(err)
+		}
+		if isPrefix || len(line) <= 0 || line[0] != '$' {
+			return fail(fmt.Errorf("expected '$'"))
+		}
+		nbulk, ok := AsciiParseUint(line[1:], 31)
+		if !ok || nbulk > uint64(maxBulk) {
+			return fail(fmt.Errorf("invalid bulk length"))
+		}
+		buf, err := RedisReadBulk(br, int(nbulk))
+		if err != nil {
+			return fail(err)
+		}
+		args = append(args, buf)
+	}
+	return args, nil
+}
+
+// Reads a bulk string of n bytes and its CRLF, into a pooled buffer
+// when it's up to redisBulkChunk bytes, or else a chunk at a time.
+func RedisReadBulk(br *bufio.Reader, n int) ([]byte, error) {
+	var buf []byte
+	if n+2 <= redisBulkChunk {
+		buf = BufGet(n + 2)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			BufPut(buf)
+			return nil, err
+		}
+	} else {
+		for len(buf) < n+2 {
+			m := n + 2 - len(buf)
+			if m > redisBulkChunk {
+				m = redisBulkChunk
+			}
+			if len(buf)+m > cap(buf) {
+				grown := make([]byte, len(buf), 2*cap(buf)+m)
+				copy(grown, buf)
+				buf = grown
+			}
+			buf = buf[:len(buf)+m]
+			if _, err := io.ReadFull(br, buf[len(buf)-m:]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if !bytes.Equal(buf[n:], crnl) {
+		BufPut(buf)
+		return nil, fmt.Errorf("expected CRLF after bulk string")
+	}
+	return buf[:n], nil
+}
+
+type RedisCmd struct {
+	// The number of args, including the command's name, or, when it's
+	// negative, the min number of args.
+	Arity int
+
+	// Parses a command's args into a request.
+	Parse func(source *RedisSource, args [][]byte) *RedisRequest
+}
+
+// A parsed command, whose Reqs are sent to the target, such as one GET
+// per key of an MGET.  A command with no Reqs, such as PING or one with
+// a syntax error, is handled by the source itself.
+type RedisRequest struct {
+	Reqs      []*gomemcached.MCRequest
+	Responses []*gomemcached.MCResponse
+	Meta      *RequestMeta // Sent with each of Reqs, or nil.
+
+	// Writes the command's reply, after the Responses have arrived, in
+	// the order of Reqs.  Returns false to close the conn.
+	Reply func(source *RedisSource, bw *bufio.Writer, rreq *RedisRequest) bool
+
+	args     [][]byte
+	name     string
+	bucket   string
+	status   string
+	start    time.Time
+	requests []Request
+}
+
+// Returns a request that's handled by the source itself, by reply.
+func RedisLocalRequest(reply func(source *RedisSource, bw *bufio.Writer,
+	rreq *RedisRequest) bool) *RedisRequest {
+	return &RedisRequest{Reply: reply, status: "ok"}
+}
+
+// Returns a request that's replied to with an error, such as "ERR
+// syntax error".
+func RedisErrorRequest(msg string) *RedisRequest {
+	return &RedisRequest{
+		Reply: func(source *RedisSource, bw *bufio.Writer,
+			rreq *RedisRequest) bool {
+			RedisError(bw, msg)
+			return true
+		},
+		status: "error",
+	}
+}
+
+var redisCmds = map[string]*RedisCmd{
+	"ping": &RedisCmd{-1, func(source *RedisSource, args [][]byte) *RedisRequest {
+		if len(args) > 2 {
+			return RedisErrorRequest("ERR wrong number of arguments for 'ping' command")
+		}
+		return RedisLocalRequest(func(source *RedisSource, bw *bufio.Writer,
+			rreq *RedisRequest) bool {
+			if len(rreq.args) > 1 {
+				RedisBulk(bw, rreq.args[1])
+			} else {
+				bw.Write(redis_pong)
+			}
+			return true
+		})
+	}},
+	"quit": &RedisCmd{1, func(source *RedisSource, args [][]byte) *RedisRequest {
+		return RedisLocalRequest(func(source *RedisSource, bw *bufio.Writer,
+			rreq *RedisRequest) bool {
+			bw.Write(redis_ok)
+			return false
+		})
+	}},
+	"select": &RedisCmd{2, RedisCmdSelect},
+	"get":    &RedisCmd{2, RedisCmdGet},
+	"mget":   &RedisCmd{-2, RedisCmdGet},
+	"exists": &RedisCmd{-2, RedisCmdGet},
+	"ttl":    &RedisCmd{2, RedisCmdTTL},
+	"set":    &RedisCmd{-3, RedisCmdSet},
+	"mset":   &RedisCmd{-3, RedisCmdSet},
+	"del":    &RedisCmd{-2, RedisCmdDel},
+	"incr":   &RedisCmd{2, RedisCmdArith},
+	"decr":   &RedisCmd{2, RedisCmdArith},
+	"incrby": &RedisCmd{3, RedisCmdArith},
+	"decrby": &RedisCmd{3, RedisCmdArith},
+	"expire": &RedisCmd{3, RedisCmdExpire},
+}
+
+// Handles SELECT, where db 0 is the "default" bucket, and any other db,
+// which may be a name, is the bucket of that name.
+func RedisCmdSelect(source *RedisSource, args [][]byte) *RedisRequest {
+	source.bucket = string(args[1])
+	if source.bucket == "0" {
+		source.bucket = "default"
+	}
+	return RedisLocalRequest(func(source *RedisSource, bw *bufio.Writer,
+		rreq *RedisRequest) bool {
+		bw.Write(redis_ok)
+		return true
+	})
+}
+
+// Handles GET, MGET and EXISTS, which all get their keys.
+func RedisCmdGet(source *RedisSource, args [][]byte) *RedisRequest {
+	rreq := &RedisRequest{}
+	for _, key := range args[1:] {
+		rreq.Reqs = append(rreq.Reqs, &gomemcached.MCRequest{
+			Opcode: gomemcached.GET,
+			Key:    key,
+		})
+	}
+	rreq.Reply = func(source *RedisSource, bw *bufio.Writer,
+		rreq *RedisRequest) bool {
+		hits := 0
+		for _, res := range rreq.Responses {
+			switch res.Status {
+			case gomemcached.SUCCESS:
+				hits++
+			case gomemcached.KEY_ENOENT:
+			default:
+				RedisStatusError(bw, res.Status)
+				return true
+			}
+		}
+		switch rreq.name {
+		case "get":
+			if hits > 0 {
+				RedisBulk(bw, rreq.Responses[0].Body)
+			} else {
+				bw.Write(redis_nil)
+			}
+		case "mget":
+			RedisArray(bw, len(rreq.Responses))
+			for _, res := range rreq.Responses {
+				if res.Status == gomemcached.SUCCESS {
+					RedisBulk(bw, res.Body)
+				} else {
+					bw.Write(redis_nil)
+				}
+			}
+		case "exists":
+			RedisInt(bw, int64(hits))
+		}
+		return true
+	}
+	return rreq
+}
+
+// Handles TTL, which replies with the remaining ttl of an item, or -1
+// if it doesn't expire, or -2 for a missing item.  The ttl is in the
+// item info of the targets that return it (see RequestMeta), and, as
+// other targets don't tell an item's ttl, their existing items get an
+// error, rather than a wrong ttl.
+func RedisCmdTTL(source *RedisSource, args [][]byte) *RedisRequest {
+	return &RedisRequest{
+		Reqs: []*gomemcached.MCRequest{&gomemcached.MCRequest{
+			Opcode: gomemcached.GET,
+			Key:    args[1],
+		}},
+		Meta: &RequestMeta{ItemInfo: true, TTL: -1, Recache: -1},
+		Reply: func(source *RedisSource, bw *bufio.Writer,
+			rreq *RedisRequest) bool {
+			res := rreq.Responses[0]
+			switch res.Status {
+			case gomemcached.SUCCESS:
+				if info, ok := ItemInfoParse(res.Extras); ok {
+					RedisInt(bw, int64(info.TTL))
+				} else {
+					RedisError(bw, "ERR TTL not supported by target")
+				}
+			case gomemcached.KEY_ENOENT:
+				bw.Write(redis_ttl_miss)
+			default:
+				RedisStatusError(bw, res.Status)
+			}
+			return true
+		},
+	}
+}
+
+// Handles SET key value [EX seconds|PX milliseconds] [NX|XX], where NX
+// is an add and XX is a replace, and MSET key value [key value ...].
+func RedisCmdSet(source *RedisSource, args [][]byte) *RedisRequest {
+	opcode := gomemcached.SET
+	var exp uint32
+	if string(bytes.ToLower(args[0])) == "mset" {
+		if len(args)%2 != 1 {
+			return RedisErrorRequest("ERR wrong number of arguments for 'mset' command")
+		}
+	} else {
+		for i := 3; i < len(args); i++ {
+			opt := strings.ToLower(string(args[i]))
+			switch {
+			case opt == "nx" && opcode == gomemcached.SET:
+				opcode = gomemcached.ADD
+			case opt == "xx" && opcode == gomemcached.SET:
+				opcode = gomemcached.REPLACE
+			case (opt == "ex" || opt == "px") && exp == 0 && i+1 < len(args):
+				i++
+				n, err := strconv.ParseInt(string(args[i]), 10, 64)
+				if err != nil {
+					return RedisErrorRequest(redis_not_int)
+				}
+				if opt == "px" {
+					n = (n + 999) / 1000
+				}
+				if n <= 0 {
+					return RedisErrorRequest("ERR invalid expire time in 'set' command")
+				}
+				exp = RedisExpiration(n)
+			default:
+				return RedisErrorRequest(redis_syntax)
+			}
+		}
+		args = args[:3]
+	}
+
+	rreq := &RedisRequest{}
+	for i := 1; i+1 < len(args); i += 2 {
+		extras := make([]byte, 8)
+		binary.BigEndian.PutUint32(extras[4:], exp)
+		rreq.Reqs = append(rreq.Reqs, &gomemcached.MCRequest{
+			Opcode: opcode,
+			Key:    args[i],
+			Extras: extras,
+			Body:   args[i+1],
+		})
+	}
+	rreq.Reply = func(source *RedisSource, bw *bufio.Writer,
+		rreq *RedisRequest) bool {
+		for _, res := range rreq.Responses {
+			switch res.Status {
+			case gomemcached.SUCCESS:
+			case gomemcached.KEY_ENOENT, gomemcached.KEY_EEXISTS,
+				gomemcached.NOT_STORED:
+				// The NX or XX condition wasn't met.
+				bw.Write(redis_nil)
+				return true
+			default:
+				RedisStatusError(bw, res.Status)
+				return true
+			}
+		}
+		bw.Write(redis_ok)
+		return true
+	}
+	return rreq
+}
+
+// Handles DEL key [key ...], replying with the number of deleted keys.
+func RedisCmdDel(source *RedisSource, args [][]byte) *RedisRequest {
+	rreq := &RedisRequest{}
+	for _, key := range args[1:] {
+		rreq.Reqs = append(rreq.Reqs, &gomemcached.MCRequest{
+			Opcode: gomemcached.DELETE,
+			Key:    key,
+		})
+	}
+	rreq.Reply = RedisReplyCount
+	return rreq
+}
+
+// Replies with the number of successful responses, such as DEL's number
+// of deleted keys, where a missing key isn't counted.
+func RedisReplyCount(source *RedisSource, bw *bufio.Writer,
+	rreq *RedisRequest) bool {
+	n := 0
+	for _, res := range rreq.Responses {
+		switch res.Status {
+		case gomemcached.SUCCESS:
+			n++
+		case gomemcached.KEY_ENOENT:
+		default:
+			RedisStatusError(bw, res.Status)
+			return true
+		}
+	}
+	RedisInt(bw, int64(n))
+	return true
+}
+
+// Handles INCR, DECR, INCRBY and DECRBY, where a missing key starts at
+// 0, like redis.  As memcached's counters are unsigned, a DECR stops at
+// 0, instead of going negative, and a negative delta reverses the op.
+func RedisCmdArith(source *RedisSource, args [][]byte) *RedisRequest {
+	name := strings.ToLower(string(args[0]))
+	opcode := gomemcached.INCREMENT
+	if name == "decr" || name == "decrby" {
+		opcode = gomemcached.DECREMENT
+	}
+	delta := int64(1)
+	if len(args) > 2 {
+		var err error
+		if delta, err = strconv.ParseInt(string(args[2]), 10, 64); err != nil {
+			return RedisErrorRequest(redis_not_int)
+		}
+	}
+	if delta < 0 {
+		delta = -delta
+		if opcode == gomemcached.INCREMENT {
+			opcode = gomemcached.DECREMENT
+		} else {
+			opcode = gomemcached.INCREMENT
+		}
+	}
+
+	// A missing key is created with the initial value, which isn't
+	// incremented, so it's the result of incrementing a 0.
+	var initial uint64
+	if opcode == gomemcached.INCREMENT {
+		initial = uint64(delta)
+	}
+	extras := make([]byte, 20)
+	binary.BigEndian.PutUint64(extras, uint64(delta))
+	binary.BigEndian.PutUint64(extras[8:], initial)
+	binary.BigEndian.PutUint32(extras[16:], 0)
+
+	return &RedisRequest{
+		Reqs: []*gomemcached.MCRequest{&gomemcached.MCRequest{
+			Opcode: opcode,
+			Key:    args[1],
+			Extras: extras,
+		}},
+		Reply: func(source *RedisSource, bw *bufio.Writer,
+			rreq *RedisRequest) bool {
+			res := rreq.Responses[0]
+			if res.Status != gomemcached.SUCCESS {
+				RedisStatusError(bw, res.Status)
+				return true
+			}
+			if len(res.Body) != 8 || binary.BigEndian.Uint64(res.Body) > 1<<63-1 {
+				RedisError(bw, redis_not_int)
+				return true
+			}
+			RedisInt(bw, int64(binary.BigEndian.Uint64(res.Body)))
+			return true
+		},
+	}
+}
+
+// Handles EXPIRE key seconds, which is a touch, replying 1 if the key
+// exists, or a delete, like redis, when the seconds aren't positive.
+func RedisCmdExpire(source *RedisSource, args [][]byte) *RedisRequest {
+	n, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return RedisErrorRequest(redis_not_int)
+	}
+	mcReq := &gomemcached.MCRequest{
+		Opcode: gomemcached.DELETE,
+		Key:    args[1],
+	}
+	if n > 0 {
+		mcReq.Opcode = gomemcached.TOUCH
+		mcReq.Extras = make([]byte, 4)
+		binary.BigEndian.PutUint32(mcReq.Extras, RedisExpiration(n))
+	}
+	return &RedisRequest{
+		Reqs:  []*gomemcached.MCRequest{mcReq},
+		Reply: RedisReplyCount,
+	}
+}
+
+// Returns the memcached expiration of a ttl in seconds, which is a unix
+// time when it's over 30 days, as memcached treats those as unix times.
+func RedisExpiration(seconds int64) uint32 {
+	if seconds > redisMonthSecs {
+		return uint32(time.Now().Unix() + seconds)
+	}
+	return uint32(seconds)
+}
+
+// Writes the error reply of a response's status, such as a timeout.
+func RedisStatusError(bw *bufio.Writer, status gomemcached.Status) {
+	switch status {
+	case gomemcached.DELTA_BADVAL:
+		RedisError(bw, redis_not_int)
+	case gomemcached.E2BIG:
+		RedisError(bw, "ERR value too large")
+	case gomemcached.ENOMEM:
+		RedisError(bw, "OOM out of memory")
+	case gomemcached.TMPFAIL:
+		RedisError(bw, "ERR temporary failure")
+	case gomemcached.UNKNOWN_COMMAND:
+		RedisError(bw, "ERR not supported by target")
+	case ETIMEDOUT:
+		RedisError(bw, "ERR timeout")
+	case EBUSY:
+		RedisError(bw, "ERR busy")
+	default:
+		RedisError(bw, "ERR server error")
+	}
+}
+
+func RedisError(bw *bufio.Writer, msg string) {
+	bw.WriteString("-")
+	bw.WriteString(msg)
+	bw.Write(crnl)
+}
+
+func RedisInt(bw *bufio.Writer, n int64) {
+	var scratch [21]byte
+	bw.WriteString(":")
+	bw.Write(strconv.AppendInt(scratch[:0], n, 10))
+	bw.Write(crnl)
+}
+
+func RedisBulk(bw *bufio.Writer, b []byte) {
+	var scratch [20]byte
+	bw.WriteString("$")
+	bw.Write(strconv.AppendUint(scratch[:0], uint64(len(b)), 10))
+	bw.Write(crnl)
+	bw.Write(b)
+	bw.Write(crnl)
+}
+
+func RedisArray(bw *bufio.Writer, n int) {
+	var scratch [20]byte
+	bw.WriteString("*")
+	bw.Write(strconv.AppendUint(scratch[:0], uint64(n), 10))
+	bw.Write(crnl)
+}
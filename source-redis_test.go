@@ -0,0 +1,153 @@
+package grouter
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestRedisReadCommand(t *testing.T) {
+	tests := []struct {
+		in   string
+		args []string // Nil when there's an error.
+	}{
+		{"PING\r\n", []string{"PING"}},
+		{"set  a   b\r\n", []string{"set", "a", "b"}},
+		{"\r\n", []string{}},
+		{"*1\r\n$4\r\nPING\r\n", []string{"PING"}},
+		{"*3\r\n$3\r\nSET\r\n$1\r\na\r\n$0\r\n\r\n", []string{"SET", "a", ""}},
+		{"*2\r\n$3\r\nGET\r\n$6\r\na\r\nb\r\n\r\n", []string{"GET", "a\r\nb\r\n"}},
+		{"*0\r\n", []string{}},
+		{"*x\r\n", nil},
+		{"*-1\r\n", nil},
+		{"*2\r\n$3\r\nGET\r\n", nil},
+		{"*1\r\n+PING\r\n", nil},
+		{"*1\r\n$x\r\n", nil},
+		{"*1\r\n$4\r\nPINGXX", nil},
+		{"*1\r\n$4\r\nPI", nil},
+		{"*1\r\n$1025\r\n", nil},
+		{"*2\r\n$1\r\na\r\n$1\r\nbc\r\n", nil},
+		{"", nil},
+	}
+	for i, test := range tests {
+		br := bufio.NewReader(strings.NewReader(test.in))
+		args, err := RedisReadCommand(br, 1024)
+		if test.args == nil {
+			if err == nil {
+				t.Errorf("test %v: expected an error, got %q", i, args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %v: expected %q, got err: %v", i, test.args, err)
+			continue
+		}
+		if len(args) != len(test.args) {
+			t.Errorf("test %v: expected %q, got %q", i, test.args, args)
+			continue
+		}
+		for j := range args {
+			if string(args[j]) != test.args[j] {
+				t.Errorf("test %v: expected %q, got %q", i, test.args, args)
+			}
+		}
+	}
+}
+
+func TestRedisReadBulk(t *testing.T) {
+	for _, n := range []int{0, 10, redisBulkChunk - 2, redisBulkChunk - 1,
+		3*redisBulkChunk + 5} {
+		in := strings.Repeat("x", n)
+		br := bufio.NewReader(strings.NewReader(in + "\r\n"))
+		buf, err := RedisReadBulk(br, n)
+		if err != nil || string(buf) != in {
+			t.Errorf("bulk of %v: expected its data, got %v bytes, err: %v",
+				n, len(buf), err)
+		}
+
+		br = bufio.NewReader(strings.NewReader(in + "\r"))
+		if _, err = RedisReadBulk(br, n); err == nil {
+			t.Errorf("bulk of %v: expected an error when truncated", n)
+		}
+	}
+
+	// A client's claimed length doesn't allocate more than its data.
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	br := bufio.NewReader(strings.NewReader("*1\r\n$536870912\r\nab"))
+	if _, err := RedisReadCommand(br, 1024*1024*1024); err == nil {
+		t.Errorf("expected an error for a truncated bulk")
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1024*1024 {
+		t.Errorf("expected a truncated bulk to allocate little, got %v", n)
+	}
+}
+
+// A conn whose client sends its commands up front, and whose replies
+// are kept.
+type redisTestConn struct {
+	r *strings.Reader
+	w bytes.Buffer
+}
+
+func (c *redisTestConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *redisTestConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func TestRedisSource(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"PING\r\n", "+PONG\r\n"},
+		{"*2\r\n$4\r\nPING\r\n$2\r\nhi\r\n", "$2\r\nhi\r\n"},
+		{"GET a\r\n", "$-1\r\n"},
+		{"SET a 1\r\nGET a\r\n", "+OK\r\n$1\r\n1\r\n"},
+		{"SET a 1 NX\r\nSET a 2 NX\r\nSET b 2 XX\r\n", "+OK\r\n$-1\r\n$-1\r\n"},
+		{"MSET a 1 b 2\r\nMGET a c b\r\n",
+			"+OK\r\n*3\r\n$1\r\n1\r\n$-1\r\n$1\r\n2\r\n"},
+		{"SET a 1\r\nEXISTS a b a\r\nDEL a b\r\n", "+OK\r\n:2\r\n:1\r\n"},
+		{"INCR n\r\nINCRBY n 10\r\nDECRBY n 20\r\n", ":1\r\n:11\r\n:0\r\n"},
+		{"SET a x\r\nINCR a\r\n",
+			"+OK\r\n-ERR value is not an integer or out of range\r\n"},
+		{"TTL a\r\nSET a 1\r\nTTL a\r\nSET b 1 EX 100\r\nTTL b\r\n",
+			":-2\r\n+OK\r\n:-1\r\n+OK\r\n:100\r\n"},
+		{"SET a 1\r\nEXPIRE a 50\r\nTTL a\r\nEXPIRE c 50\r\n",
+			"+OK\r\n:1\r\n:50\r\n:0\r\n"},
+		{"SELECT 0\r\nFOO\r\n", "+OK\r\n-ERR unknown command 'FOO'\r\n"},
+		{"GET\r\n", "-ERR wrong number of arguments for 'get' command\r\n"},
+		{"SET a 1 EX x\r\n", "-ERR value is not an integer or out of range\r\n"},
+		{"*1\r\n$x\r\n", "-ERR Protocol error: invalid bulk length\r\n"},
+	}
+	for i, test := range tests {
+		stats := NewStats()
+		params := Params{TargetChanSize: 10, RedisMaxBulk: 1024}
+		target, err := MemoryStorageStart("memory", params, stats)
+		if err != nil {
+			t.Fatalf("MemoryStorageStart: %v", err)
+		}
+		conn := &redisTestConn{r: strings.NewReader(test.in)}
+		RedisSource{}.Run(conn, 0, params, target, stats)
+		target.Close()
+		// A second might have ticked between a SET and its TTL.
+		out := strings.NewReplacer(":99\r\n", ":100\r\n",
+			":49\r\n", ":50\r\n").Replace(conn.w.String())
+		if out != test.out {
+			t.Errorf("test %v: %q: expected %q, got %q",
+				i, test.in, test.out, out)
+		}
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dustin/gomemcached"
@@ -36,9 +37,10 @@ const (
 	LARGE_PRIME = uint64(9576890767)
 )
 
-// The source entry function for synthetic workload generation.
+// The source entry function for synthetic workload generation, which
+// returns after the quit channel is closed and in-flight batches finish.
 func WorkLoadRun(sourceSpec string, params Params, target Target,
-	statsChan chan Stats) {
+	stats *Stats, quit chan bool) {
 	cfg := WorkLoadCfgLog(WorkLoadCfgRead(sourceSpec, "./workload.json"))
 
 	bodySize := WorkLoadCfgGetInt(cfg, "body-size", DEFAULT_BODY_SIZE)
@@ -48,11 +50,22 @@ func WorkLoadRun(sourceSpec string, params Params, target Target,
 	}
 	cfg.cfg["body"] = body[0:bodySize]
 
+	// The workload's request-timeout (in seconds) overrides params.
+	params.SourceRequestTimeout = time.Duration(WorkLoadCfgGetFloat64(cfg,
+		"request-timeout", params.SourceRequestTimeout.Seconds()) *
+		float64(time.Second))
+
 	num := WorkLoadCfgGetFloat64(cfg, "concurrency", float64(params.TargetConcurrency))
+	workers := sync.WaitGroup{}
 	for i := 1; i < int(num); i++ {
-		go WorkLoad(cfg, uint32(i), sourceSpec, target, statsChan)
+		workers.Add(1)
+		go func(clientNum uint32) {
+			WorkLoad(cfg, clientNum, sourceSpec, params, target, stats, quit)
+			workers.Done()
+		}(uint32(i))
 	}
-	WorkLoad(cfg, uint32(0), sourceSpec, target, statsChan)
+	WorkLoad(cfg, uint32(0), sourceSpec, params, target, stats, quit)
+	workers.Wait()
 }
 
 // Reads a workload cfg (JSON) from a file and the associated command
@@ -143,14 +156,14 @@ func WorkLoadCfgGetString(cfg WorkLoadCfg, key string, defaultVal string) string
 }
 
 // Main function that sends workload requests and processes responses.
-func WorkLoad(cfg WorkLoadCfg, clientNum uint32, sourceSpec string, target Target,
-	statsChan chan Stats) {
-	report := 100
+func WorkLoad(cfg WorkLoadCfg, clientNum uint32, sourceSpec string,
+	params Params, target Target, stats *Stats, quit chan bool) {
 	bucket := "default"
 	batch := WorkLoadCfgGetInt(cfg, "batch", 1000)
 
-	tot_workload_ops_nsecs := int64(0) // In nanoseconds.
-	tot_workload_ops := 0
+	// Ops stats by opcode and status of the response.
+	tot_workload_ops := make(map[statsOpKey]*StatsOp)
+	tot_workload_timeouts := stats.Counter("tot-workload-timeouts")
 
 	res := make(chan *gomemcached.MCResponse, batch)
 	res_prev := make(map[uint32]*gomemcached.MCResponse) // Key is opaque uint32.
@@ -159,54 +172,61 @@ func WorkLoad(cfg WorkLoadCfg, clientNum uint32, sourceSpec string, target Targe
 	// A separate goroutine generates the next batch concurrently
 	// while a current batch is in-flight.
 	go WorkLoadBatchRun(cfg, clientNum, sourceSpec, bucket, batch,
-		reqs_gen, res, statsChan)
+		reqs_gen, res, stats, quit)
 
 	for reqs := range reqs_gen {
 		reqs_start := time.Now()
-		targetChan := target.PickChannel(clientNum, bucket)
-		targetChan <- reqs
+		deadline := params.RequestDeadline(reqs_start)
+		for i := range reqs {
+			reqs[i].Deadline = deadline
+		}
+		SendRequests(target.PickChannel(clientNum, bucket), reqs)
 		for _, req := range reqs {
 			// The responses might be out of order, where we use the
 			// opaque field to sequence the responses.  We have a
 			// res_prev to stash early responses until needed.
+			// Each op's latency is measured from the start of its
+			// batch until its response arrives.
 			res_opaque := req.Req.Opaque
 			if res_prev[res_opaque] != nil {
+				if res_prev[res_opaque].Status == ETIMEDOUT {
+					tot_workload_timeouts.Add(1)
+				}
 				delete(res_prev, res_opaque)
 			} else {
-				mc_res := <-res
-				if mc_res.Opaque != res_opaque {
-					// TODO: assert(res_prev[res_opaque] == nil)
-					res_prev[res_opaque] = mc_res
+				for {
+					mc_res := <-res
+					k := statsOpKey{bucket, mc_res.Opcode, mc_res.Status}
+					op := tot_workload_ops[k]
+					if op == nil {
+						op = stats.Op("tot-workload-ops", "bucket", bucket,
+							"opcode", OpcodeName(mc_res.Opcode),
+							"status", StatusName(mc_res.Opcode, mc_res.Status))
+						tot_workload_ops[k] = op
+					}
+					op.Record(time.Since(reqs_start))
+					if mc_res.Opaque == res_opaque {
+						if mc_res.Status == ETIMEDOUT {
+							tot_workload_timeouts.Add(1)
+						}
+						break
+					}
+					// TODO: assert(res_prev[mc_res.Opaque] == nil)
+					res_prev[mc_res.Opaque] = mc_res
 				}
 			}
 		}
 		// TODO: assert(len(res_prev) == 0)
-		reqs_end := time.Now()
-
-		tot_workload_ops_nsecs += reqs_end.Sub(reqs_start).Nanoseconds()
-		tot_workload_ops += batch
-		if tot_workload_ops%report == 0 {
-			statsChan <- Stats{
-				Keys: []string{
-					"tot-workload-ops",
-					"tot-workload-ops-usecs",
-				},
-				Vals: []int64{
-					int64(tot_workload_ops),
-					int64(tot_workload_ops_nsecs / 1000),
-				},
-			}
-			tot_workload_ops_nsecs = int64(0)
-			tot_workload_ops = 0
-		}
 	}
 }
 
 // Helper function that generates a batch of workload requests onto a
-// reqs_gen channel.
+// reqs_gen channel, closing reqs_gen when the quit channel is closed.
 func WorkLoadBatchRun(cfg WorkLoadCfg, clientNum uint32, sourceSpec string,
 	bucket string, batch int, reqs_gen chan []Request,
-	res chan *gomemcached.MCResponse, statsChan chan Stats) {
+	res chan *gomemcached.MCResponse, stats *Stats, quit chan bool) {
+	defer close(reqs_gen)
+
 	pre := make(map[string]uint64)
 	cur := make(map[string]uint64)
 	out := make([]gomemcached.MCRequest, batch)
@@ -232,22 +252,15 @@ func WorkLoadBatchRun(cfg WorkLoadCfg, clientNum uint32, sourceSpec string,
 			}
 			opaque++
 		}
-		reqs_gen <- reqs
-
-		if opaque%100 == 0 {
-			keys := make([]string, len(cur))
-			vals := make([]int64, len(cur))
-			i := 0
-			for k, v := range cur {
-				keys[i] = k
-				vals[i] = int64(v - pre[k])
-				i++
-			}
-			statsChan <- Stats{
-				Keys: keys,
-				Vals: vals,
-			}
-			for k, v := range cur {
+		select {
+		case reqs_gen <- reqs:
+		case <-quit:
+			return
+		}
+
+		for k, v := range cur {
+			if v != pre[k] {
+				stats.Counter(k).Add(int64(v - pre[k]))
 				pre[k] = v
 			}
 		}
@@ -1,56 +1,278 @@
 package grouter
 
 import (
+	"fmt"
 	"log"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// When the process started, for uptime stats.
+var StatsStartTime = time.Now()
+
+// A registry of named counters, gauges and histograms, which are
+// updated with atomics, so hot paths like source conns and target
+// workers never wait on each other or on a stats goroutine to update
+// stats.  Lookups by name take a lock, so callers should hold onto
+// the stats that they update frequently.
+//
+// A Stats is a view of the registry that prefixes the names of the
+// stats that it creates, such as with the name of a source or target.
 type Stats struct {
-	Keys []string
-	Vals []int64
+	prefix string
+	r      *statsRegistry
+}
+
+type statsRegistry struct {
+	m          sync.RWMutex // Protects the maps, not the stats.
+	counters   map[string]*StatsCounter
+	gauges     map[string]*StatsGauge
+	histograms map[string]*StatsHistogram
+}
+
+// A monotonic count, such as the number of ops, named like tot-xxx.
+type StatsCounter struct {
+	v int64
+}
+
+func (c *StatsCounter) Add(n int64) {
+	atomic.AddInt64(&c.v, n)
+}
+
+func (c *StatsCounter) Get() int64 {
+	return atomic.LoadInt64(&c.v)
+}
+
+// A current value that can go up and down, such as curr-conns.
+type StatsGauge struct {
+	v int64
+}
+
+func (g *StatsGauge) Add(n int64) {
+	atomic.AddInt64(&g.v, n)
+}
+
+func (g *StatsGauge) Set(n int64) {
+	atomic.StoreInt64(&g.v, n)
+}
+
+func (g *StatsGauge) Get() int64 {
+	return atomic.LoadInt64(&g.v)
+}
+
+// The count, total latency and latency histogram of an op, following
+// the tot-xxx and tot-xxx-usecs naming convention.
+type StatsOp struct {
+	Count *StatsCounter
+	Usecs *StatsCounter
+	Hist  *StatsHistogram
+}
+
+func (o *StatsOp) Record(d time.Duration) {
+	usecs := d.Nanoseconds() / 1000
+	o.Count.Add(1)
+	o.Usecs.Add(usecs)
+	o.Hist.Record(usecs)
+}
+
+func NewStats() *Stats {
+	return &Stats{r: &statsRegistry{
+		counters:   make(map[string]*StatsCounter),
+		gauges:     make(map[string]*StatsGauge),
+		histograms: make(map[string]*StatsHistogram),
+	}}
+}
+
+// Returns a view of the same registry that adds another prefix.
+func (s *Stats) Prefix(prefix string) *Stats {
+	return &Stats{prefix: s.prefix + prefix, r: s.r}
+}
+
+// Returns the counter for a name and labels (see StatsKey), creating
+// it if needed.
+func (s *Stats) Counter(name string, labels ...string) *StatsCounter {
+	key := s.prefix + StatsKey(name, labels...)
+	s.r.m.RLock()
+	c := s.r.counters[key]
+	s.r.m.RUnlock()
+	if c == nil {
+		s.r.m.Lock()
+		if c = s.r.counters[key]; c == nil {
+			c = &StatsCounter{}
+			s.r.counters[key] = c
+		}
+		s.r.m.Unlock()
+	}
+	return c
+}
+
+func (s *Stats) Gauge(name string, labels ...string) *StatsGauge {
+	key := s.prefix + StatsKey(name, labels...)
+	s.r.m.RLock()
+	g := s.r.gauges[key]
+	s.r.m.RUnlock()
+	if g == nil {
+		s.r.m.Lock()
+		if g = s.r.gauges[key]; g == nil {
+			g = &StatsGauge{}
+			s.r.gauges[key] = g
+		}
+		s.r.m.Unlock()
+	}
+	return g
+}
+
+func (s *Stats) Histogram(name string, labels ...string) *StatsHistogram {
+	key := s.prefix + StatsKey(name, labels...)
+	s.r.m.RLock()
+	h := s.r.histograms[key]
+	s.r.m.RUnlock()
+	if h == nil {
+		s.r.m.Lock()
+		if h = s.r.histograms[key]; h == nil {
+			h = &StatsHistogram{}
+			s.r.histograms[key] = h
+		}
+		s.r.m.Unlock()
+	}
+	return h
 }
 
-func StartStatsReporter(chanSize int) chan Stats {
-	statsChan := make(chan Stats, chanSize)
+// Returns the tot-xxx counter, tot-xxx-usecs counter and tot-xxx-usecs
+// histogram of an op.
+func (s *Stats) Op(name string, labels ...string) *StatsOp {
+	return &StatsOp{
+		Count: s.Counter(name, labels...),
+		Usecs: s.Counter(name+"-usecs", labels...),
+		Hist:  s.Histogram(name+"-usecs", labels...),
+	}
+}
+
+// Returns the current values of all the counters and gauges in the
+// registry, keyed by their full names, regardless of prefix.
+func (s *Stats) Snapshot() map[string]int64 {
+	s.r.m.RLock()
+	defer s.r.m.RUnlock()
+	rv := make(map[string]int64, len(s.r.counters)+len(s.r.gauges))
+	for k, c := range s.r.counters {
+		rv[k] = c.Get()
+	}
+	for k, g := range s.r.gauges {
+		rv[k] = g.Get()
+	}
+	return rv
+}
 
+// Returns copies of all the histograms in the registry.
+func (s *Stats) Histograms() map[string]*Histogram {
+	s.r.m.RLock()
+	defer s.r.m.RUnlock()
+	rv := make(map[string]*Histogram, len(s.r.histograms))
+	for k, h := range s.r.histograms {
+		rv[k] = h.Snapshot()
+	}
+	return rv
+}
+
+// Periodically logs the stats of a registry (see StatsReport).
+func StartStatsReporter(stats *Stats) {
 	go func() {
 		reportSecs := 2 * time.Second
 		reportChan := time.Tick(reportSecs)
 		reportNum := 0
-		curr := make(map[string]int64)
 		prev := make(map[string]int64)
-		for {
-			select {
-			case stats := <-statsChan:
-				for i := range stats.Keys {
-					curr[stats.Keys[i]] += stats.Vals[i]
-				}
-			case <-reportChan:
-				full := reportNum%10 == 0
-				if StatsReport(curr, prev, reportSecs, full) {
-					if full {
-						log.Printf("-------------")
-					} else {
-						log.Printf("----")
-					}
-				}
-				for k, v := range curr {
-					prev[k] = v
+		prevHists := make(map[string]*Histogram)
+		for _ = range reportChan {
+			curr := stats.Snapshot()
+			currHists := stats.Histograms()
+			full := reportNum%10 == 0
+			if StatsReport(curr, prev, currHists, prevHists,
+				reportSecs, full) {
+				if full {
+					log.Printf("-------------")
+				} else {
+					log.Printf("----")
 				}
-				reportNum++
 			}
+			prev = curr
+			prevHists = currHists
+			reportNum++
 		}
 	}()
+}
 
-	return statsChan
+// Returns a stat key with labels, such as "tot-ops{opcode=get}" for
+// StatsKey("tot-ops", "opcode", "get"), which allows stats exporters
+// to break down stats by label.  The labels are name/value pairs.
+func StatsKey(name string, labels ...string) string {
+	if len(labels) < 2 {
+		return name
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+"="+statsLabelReplacer.Replace(labels[i+1]))
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Replaces the chars that would confuse StatsSplitKey().
+var statsLabelReplacer = strings.NewReplacer(
+	"/", "_", "{", "_", "}", "_", ",", "_", "=", "_")
+
+// Splits a stat key into its prefixes (see PrefixStats), name and
+// labels (see StatsKey), such as "src0/", "tot-ops" and "opcode=get"
+// for "src0/tot-ops{opcode=get}".
+func StatsSplitKey(key string) (prefix string, name string, labels string) {
+	name = key
+	if i := strings.Index(key, "{"); i >= 0 && strings.HasSuffix(key, "}") {
+		name, labels = key[:i], key[i+1:len(key)-1]
+	}
+	i := strings.LastIndex(name, "/")
+	return name[:i+1], name[i+1:], labels
+}
+
+// Returns the labels of a stat key, such as map[opcode:get] for the
+// "opcode=get" labels from StatsSplitKey().
+func StatsLabels(labels string) map[string]string {
+	rv := make(map[string]string)
+	if labels == "" {
+		return rv
+	}
+	for _, pair := range strings.Split(labels, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) == 2 {
+			rv[kv[0]] = kv[1]
+		}
+	}
+	return rv
+}
+
+// Returns a stat key without its prefixes or labels, such as
+// "tot-ops" for "src0/tot-ops{opcode=get}".
+func StatsName(key string) string {
+	_, name, _ := StatsSplitKey(key)
+	return name
+}
+
+// Returns the key of the latency stat that's paired with a stat,
+// such as "src0/tot-ops-usecs{opcode=get}" for "src0/tot-ops{opcode=get}".
+func StatsUsecsKey(key string) string {
+	prefix, name, labels := StatsSplitKey(key)
+	if labels != "" {
+		return prefix + name + "-usecs{" + labels + "}"
+	}
+	return prefix + name + "-usecs"
 }
 
 func StatsReport(curr map[string]int64, prev map[string]int64,
+	currHists map[string]*Histogram, prevHists map[string]*Histogram,
 	reportSecs time.Duration, full bool) bool {
 	// Reports rates on paired stats that follow a naming convention
-	// like xxx and xxx-usecs.  For example, tot-ops and tot-ops-usecs.
+	// like xxx and xxx-usecs.  For example, tot-ops and tot-ops-usecs,
+	// along with any percentiles from a tot-ops-usecs histogram.
 	emitted := false
 
 	i := 0
@@ -63,23 +285,30 @@ func StatsReport(curr map[string]int64, prev map[string]int64,
 
 	for _, k := range keys {
 		v := curr[k]
-		if strings.HasSuffix(k, "-usecs") {
+		if strings.HasSuffix(StatsName(k), "-usecs") {
 			continue
 		}
-		if strings.HasPrefix(k, "tot-") {
+		if strings.HasPrefix(StatsName(k), "tot-") {
 			v_diff := v - prev[k]
 			k_per_sec := float64(v_diff) / reportSecs.Seconds()
 			if k_per_sec > 0 {
+				k_usecs := StatsUsecsKey(k)
 				if full {
-					log.Printf("%v: %v, per sec: %f", k, v, k_per_sec)
+					log.Printf("%v: %v, per sec: %f%v", k, v, k_per_sec,
+						StatsHistogramLog(currHists[k_usecs]))
 				} else {
-					k_usecs := k + "-usecs"
 					d_usecs := float64(curr[k_usecs] - prev[k_usecs])
+					var h *Histogram
+					if currHists[k_usecs] != nil {
+						h = currHists[k_usecs].Sub(prevHists[k_usecs])
+					}
 					if d_usecs > 0 {
-						log.Printf("%v per sec: %f, avg latency: %f",
-							k, k_per_sec, (d_usecs/1000000.0)/float64(v_diff))
+						log.Printf("%v per sec: %f, avg latency: %f%v",
+							k, k_per_sec, (d_usecs/1000000.0)/float64(v_diff),
+							StatsHistogramLog(h))
 					} else {
-						log.Printf("%v per sec: %f", k, k_per_sec)
+						log.Printf("%v per sec: %f%v", k, k_per_sec,
+							StatsHistogramLog(h))
 					}
 				}
 				emitted = true
@@ -93,3 +322,17 @@ func StatsReport(curr map[string]int64, prev map[string]int64,
 	}
 	return emitted
 }
+
+// Returns the percentiles and max of a histogram of microseconds as
+// durations for logging, or "" if there's no histogram.
+func StatsHistogramLog(h *Histogram) string {
+	if h == nil || h.Count <= 0 {
+		return ""
+	}
+	rv := ""
+	for _, p := range HistPercentiles {
+		rv += fmt.Sprintf(", p%v: %v", p,
+			time.Duration(h.Percentile(p))*time.Microsecond)
+	}
+	return rv + fmt.Sprintf(", max: %v", time.Duration(h.Max)*time.Microsecond)
+}
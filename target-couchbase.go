@@ -1,8 +1,11 @@
 package grouter
 
 import (
-	"log"
+	"fmt"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/couchbaselabs/go-couchbase"
 	"github.com/dustin/gomemcached"
@@ -12,38 +15,58 @@ import (
 type CouchbaseTarget struct {
 	spec          string
 	incomingChans []chan []Request
+	workers       *sync.WaitGroup
 }
 
 func (s CouchbaseTarget) PickChannel(clientNum uint32, bucket string) chan []Request {
 	return s.incomingChans[clientNum%uint32(len(s.incomingChans))]
 }
 
+func (s CouchbaseTarget) QueueLens() []int {
+	return ChanLens(s.incomingChans)
+}
+
+func (s CouchbaseTarget) Close() {
+	for _, c := range s.incomingChans {
+		close(c)
+	}
+	s.workers.Wait()
+}
+
 func CouchbaseTargetStart(spec string, params Params,
-	statsChan chan Stats) Target {
+	stats *Stats) (Target, error) {
 	spec = strings.Replace(spec, "couchbase:", "http:", 1)
 
 	s := CouchbaseTarget{
 		spec:          spec,
 		incomingChans: make([]chan []Request, params.TargetConcurrency),
+		workers:       &sync.WaitGroup{},
 	}
 
 	for i := range s.incomingChans {
-		s.incomingChans[i] = make(chan []Request, params.TargetChanSize)
-		CouchbaseTargetStartIncoming(s, s.incomingChans[i])
+		incoming := make(chan []Request, params.TargetChanSize)
+		err := CouchbaseTargetStartIncoming(s, incoming, stats)
+		if err != nil {
+			s.incomingChans = s.incomingChans[:i] // Close the started ones.
+			s.Close()
+			return nil, err
+		}
+		s.incomingChans[i] = incoming
 	}
 
-	return s
+	return s, nil
 }
 
-func CouchbaseTargetStartIncoming(s CouchbaseTarget, incoming chan []Request) {
+func CouchbaseTargetStartIncoming(s CouchbaseTarget, incoming chan []Request,
+	stats *Stats) error {
 	client, err := couchbase.Connect(s.spec)
 	if err != nil {
-		log.Fatalf("error: couchbase connect failed: %s; err: %v", s.spec, err)
+		return fmt.Errorf("error: couchbase connect failed: %s; err: %v", s.spec, err)
 	}
 
 	pool, err := client.GetPool("default")
 	if err != nil {
-		log.Fatalf("error: no default pool; err: %v", err)
+		return fmt.Errorf("error: no default pool; err: %v", err)
 	}
 
 	// TODO: Need to handle bucket disappearing/reappearing/rebalancing.
@@ -60,6 +83,24 @@ func CouchbaseTargetStartIncoming(s CouchbaseTarget, incoming chan []Request) {
 
 	processRequests := func(reqs []Request) {
 		// All the requests have same bucket and server index.
+		now := time.Now()
+		live := make([]Request, 0, len(reqs))
+		for _, req := range reqs {
+			if req.Expired(now) {
+				RespondTimeout(req)
+				continue
+			}
+			if IsQuietOpcode(req.Req.Opcode) {
+				// A response is received for every request, so
+				// quiet requests, which might get none, are sent
+				// as non-quiet.
+				r := *req.Req
+				r.Opcode = UnquietOpcode(r.Opcode)
+				req.Req = &r
+			}
+			live = append(live, req)
+		}
+		reqs = live
 		if len(reqs) < 1 {
 			return
 		}
@@ -87,20 +128,23 @@ func CouchbaseTargetStartIncoming(s CouchbaseTarget, incoming chan []Request) {
 						Opaque: req.Req.Opaque,
 					}
 				}
-				req.Res <- res
+				req.Respond(res)
 			}
 		} else {
 			for _, req := range reqs {
-				req.Res <- &gomemcached.MCResponse{
+				req.Respond(&gomemcached.MCResponse{
 					Opcode: req.Req.Opcode,
 					Status: gomemcached.EINVAL,
 					Opaque: req.Req.Opaque,
-				}
+				})
 			}
 		}
 	}
 
+	s.workers.Add(1)
 	go func() {
+		defer s.workers.Done()
+
 		getServerIndex := func(bucketName string, key []byte) int {
 			b := getBucket(bucketName)
 			if b != nil {
@@ -110,7 +154,12 @@ func CouchbaseTargetStartIncoming(s CouchbaseTarget, incoming chan []Request) {
 			return -1
 		}
 
-		for reqs := range incoming {
+		ts := NewTargetStats(stats, "tot-target-couchbase")
+
+		processBatch := func(reqs []Request) {
+			if len(reqs) < 1 {
+				return
+			}
 			SortRequests(reqs, getServerIndex) // Sort requests by server index.
 
 			startSvr := -1
@@ -132,5 +181,79 @@ func CouchbaseTargetStartIncoming(s CouchbaseTarget, incoming chan []Request) {
 			}
 			processRequests(reqs[startReq:len(reqs)])
 		}
+
+		for reqs := range incoming {
+			reqs = ts.Begin(reqs)
+
+			// As a batch is reordered by server, a flush splits it, so
+			// that the flush comes after the requests before it and
+			// before the requests after it.
+			start := 0
+			for i, req := range reqs {
+				if UnquietOpcode(req.Req.Opcode) == gomemcached.FLUSH {
+					processBatch(reqs[start:i])
+					CouchbaseTargetFlush(getBucket(req.Bucket), req)
+					start = i + 1
+				}
+			}
+			processBatch(reqs[start:])
+		}
+
+		for _, bucket := range buckets {
+			bucket.Close()
+		}
 	}()
+
+	return nil
+}
+
+// Sends a flush request to every server of a bucket, responding with
+// the first failure, if any.  As go-couchbase only reaches a server via
+// a key, a key is found for each server by hashing candidate keys.
+func CouchbaseTargetFlush(bucket *couchbase.Bucket, req Request) {
+	if req.Expired(time.Now()) {
+		RespondTimeout(req)
+		return
+	}
+	res := &gomemcached.MCResponse{
+		Opcode: req.Req.Opcode,
+		Status: gomemcached.SUCCESS,
+		Opaque: req.Req.Opaque,
+	}
+	if bucket == nil {
+		res.Status = gomemcached.EINVAL
+		req.Respond(res)
+		return
+	}
+
+	flush := *req.Req
+	flush.Opcode = gomemcached.FLUSH
+
+	vbm := bucket.VBucketServerMap
+	keys := make(map[int]string) // By server index.
+	for i := 0; len(keys) < len(vbm.ServerList) && i < 100*len(vbm.VBucketMap); i++ {
+		key := strconv.Itoa(i)
+		svr := vbm.VBucketMap[bucket.VBHash(key)][0]
+		if _, ok := keys[svr]; !ok && svr >= 0 {
+			keys[svr] = key
+		}
+	}
+	for _, key := range keys {
+		err := bucket.Do(key, func(c *memcached.Client, v uint16) error {
+			flush.VBucket = v
+			r, err := c.Send(&flush)
+			if r != nil && r.Status != gomemcached.SUCCESS &&
+				res.Status == gomemcached.SUCCESS {
+				res.Status = r.Status
+			}
+			if MemcachedBinaryConnErr(err) {
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			res.Status = gomemcached.EINVAL
+		}
+	}
+	req.Respond(res)
 }
@@ -10,62 +10,352 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/dustin/gomemcached"
 )
 
 var (
-	prefix_get     = []byte("get ")
+	value_tok = []byte("VALUE")
+	end_tok   = []byte("END")
+
+	prefix_gets    = []byte("gets ")
+	prefix_gat     = []byte("gats ")
 	prefix_set     = []byte("set ")
+	prefix_cas     = []byte("cas ")
 	prefix_add     = []byte("add ")
 	prefix_replace = []byte("replace ")
 	prefix_prepend = []byte("prepend ")
 	prefix_append  = []byte("append ")
+	prefix_delete  = []byte("delete ")
+	prefix_incr    = []byte("incr ")
+	prefix_decr    = []byte("decr ")
+	prefix_touch   = []byte("touch ")
+	prefix_flush   = []byte("flush_all ")
+	cmd_version    = []byte("version\r\n")
+
+	prefix_meta_get    = []byte("mg ")
+	prefix_meta_set    = []byte("ms ")
+	prefix_meta_delete = []byte("md ")
+	prefix_meta_arith  = []byte("ma ")
+	meta_va_tok        = []byte("VA")
 )
 
+// The ms modes of the storage commands, which are sent as meta
+// commands when they have a cas, as their classic commands don't.
+var asciiTargetMetaModes = map[gomemcached.CommandCode]string{
+	gomemcached.ADD:     " ME",
+	gomemcached.REPLACE: " MR",
+	gomemcached.APPEND:  " MA",
+	gomemcached.PREPEND: " MP",
+}
+
+// Sends a request, by its non-quiet opcode, to the memcached server and
+// reads its reply.  Quiet requests are sent without noreply, so that
+// they're responded to like the others.
 type AsciiTargetHandler struct {
 	Write func(*bufio.Reader, *bufio.Writer, Request) error
 	Read  func(*bufio.Reader, *bufio.Writer, Request) error
 }
 
 var AsciiTargetHandlers = map[gomemcached.CommandCode]AsciiTargetHandler{
+	// Gets are sent as gets, so that responses have their cas, or as
+	// an mg when the request has a RequestMeta.
 	gomemcached.GET: AsciiTargetHandler{
 		Write: func(br *bufio.Reader, bw *bufio.Writer, req Request) error {
-			bw.Write(prefix_get)
+			if req.Meta != nil {
+				AsciiTargetMetaGetWrite(bw, req)
+				return nil
+			}
+			bw.Write(prefix_gets)
 			bw.Write(req.Req.Key)
 			bw.Write(crnl)
 			return nil
 		},
-		Read: func(br *bufio.Reader, bw *bufio.Writer, req Request) error {
-			numValues, endParts, err := AsciiTargetReadLines(br, req)
-			if err != nil {
-				return err
-			}
-			if endParts[0] == "END" {
-				if numValues <= 0 {
-					req.Res <- &gomemcached.MCResponse{
-						Opcode: req.Req.Opcode,
-						Status: gomemcached.KEY_ENOENT,
-						Opaque: req.Req.Opaque,
-						Key:    req.Req.Key,
-					}
-				}
-			} else {
-				req.Res <- &gomemcached.MCResponse{
-					Opcode: req.Req.Opcode,
-					Status: gomemcached.EINVAL,
-					Opaque: req.Req.Opaque,
-					Key:    req.Req.Key,
-				}
+		Read: AsciiTargetGetRead,
+	},
+	gomemcached.GAT: AsciiTargetHandler{
+		Write: func(br *bufio.Reader, bw *bufio.Writer, req Request) error {
+			if req.Meta != nil {
+				AsciiTargetMetaGetWrite(bw, req)
+				return nil
 			}
+			var scratch [20]byte
+			bw.Write(prefix_gat)
+			bw.Write(strconv.AppendUint(scratch[:0],
+				uint64(binary.BigEndian.Uint32(req.Req.Extras)), 10))
+			bw.Write(space)
+			bw.Write(req.Req.Key)
+			bw.Write(crnl)
 			return nil
 		},
+		Read: AsciiTargetGetRead,
 	},
 	gomemcached.SET:     AsciiTargetMutationHandler(prefix_set),
 	gomemcached.ADD:     AsciiTargetMutationHandler(prefix_add),
 	gomemcached.REPLACE: AsciiTargetMutationHandler(prefix_replace),
 	gomemcached.PREPEND: AsciiTargetMutationHandler(prefix_prepend),
 	gomemcached.APPEND:  AsciiTargetMutationHandler(prefix_append),
+	gomemcached.DELETE: AsciiTargetLineHandler(
+		func(bw *bufio.Writer, req Request) {
+			invalidate := req.Meta != nil && req.Meta.Invalidate
+			if req.Req.Cas != 0 || invalidate {
+				var scratch [20]byte
+				bw.Write(prefix_meta_delete)
+				bw.Write(req.Req.Key)
+				if invalidate {
+					bw.WriteString(" I")
+					if req.Meta.TTL >= 0 {
+						bw.WriteString(" T")
+						bw.Write(strconv.AppendInt(scratch[:0], req.Meta.TTL, 10))
+					}
+				}
+				if req.Req.Cas != 0 {
+					bw.WriteString(" C")
+					bw.Write(strconv.AppendUint(scratch[:0], req.Req.Cas, 10))
+				}
+				bw.Write(crnl)
+				return
+			}
+			bw.Write(prefix_delete)
+			bw.Write(req.Req.Key)
+			bw.Write(crnl)
+		}),
+	gomemcached.INCREMENT: AsciiTargetArithHandler(prefix_incr),
+	gomemcached.DECREMENT: AsciiTargetArithHandler(prefix_decr),
+	gomemcached.TOUCH: AsciiTargetLineHandler(
+		func(bw *bufio.Writer, req Request) {
+			var scratch [20]byte
+			bw.Write(prefix_touch)
+			bw.Write(req.Req.Key)
+			bw.Write(space)
+			bw.Write(strconv.AppendUint(scratch[:0],
+				uint64(binary.BigEndian.Uint32(req.Req.Extras)), 10))
+			bw.Write(crnl)
+		}),
+	gomemcached.FLUSH: AsciiTargetLineHandler(
+		func(bw *bufio.Writer, req Request) {
+			var delay uint64
+			if len(req.Req.Extras) >= 4 {
+				delay = uint64(binary.BigEndian.Uint32(req.Req.Extras))
+			}
+			var scratch [20]byte
+			bw.Write(prefix_flush)
+			bw.Write(strconv.AppendUint(scratch[:0], delay, 10))
+			bw.Write(crnl)
+		}),
+	gomemcached.VERSION: AsciiTargetHandler{
+		Write: func(br *bufio.Reader, bw *bufio.Writer, req Request) error {
+			bw.Write(cmd_version)
+			return nil
+		},
+		Read: func(br *bufio.Reader, bw *bufio.Writer, req Request) error {
+			parts, err := AsciiTargetReadLine(br)
+			if err != nil {
+				return err
+			}
+			if len(parts) == 2 && string(parts[0]) == "VERSION" {
+				AsciiTargetRespond(req, gomemcached.SUCCESS,
+					append([]byte(nil), parts[1]...))
+			} else {
+				AsciiTargetRespond(req, AsciiTargetStatus(parts), nil)
+			}
+			return nil
+		},
+	},
+	// The ascii protocol has no noop, but as the replies to a conn's
+	// commands are in order, a noop is done once it's reached.
+	gomemcached.NOOP: AsciiTargetHandler{
+		Write: func(br *bufio.Reader, bw *bufio.Writer, req Request) error {
+			return nil
+		},
+		Read: func(br *bufio.Reader, bw *bufio.Writer, req Request) error {
+			AsciiTargetRespond(req, gomemcached.SUCCESS, nil)
+			return nil
+		},
+	},
+}
+
+// An error of a handler's Read after it already responded to its
+// request, such as a get whose value was read before its END line
+// timed out, so the conn is reset, but the request isn't responded to
+// again.
+type asciiTargetRespondedError struct {
+	error
+}
+
+func AsciiTargetRespond(req Request, status gomemcached.Status, body []byte) {
+	req.Respond(&gomemcached.MCResponse{
+		Opcode: req.Req.Opcode,
+		Status: status,
+		Opaque: req.Req.Opaque,
+		Key:    req.Req.Key,
+		Body:   body,
+	})
+}
+
+// Returns the status of a reply line's fields, such as KEY_EEXISTS for
+// EXISTS, following the replies of memcached, including the codes of
+// its meta commands.  Replies that aren't understood are an EINVAL.
+func AsciiTargetStatus(parts [][]byte) gomemcached.Status {
+	if len(parts) <= 0 {
+		return gomemcached.EINVAL
+	}
+	switch string(parts[0]) {
+	case "STORED", "DELETED", "TOUCHED", "OK", "HD":
+		return gomemcached.SUCCESS
+	case "NOT_STORED", "NS":
+		return gomemcached.NOT_STORED
+	case "EXISTS", "EX":
+		return gomemcached.KEY_EEXISTS
+	case "NOT_FOUND", "NF", "EN":
+		return gomemcached.KEY_ENOENT
+	case "ERROR":
+		return gomemcached.UNKNOWN_COMMAND
+	case "CLIENT_ERROR":
+		// Such as "CLIENT_ERROR cannot increment or decrement
+		// non-numeric value".
+		if len(parts) > 1 && string(parts[1]) == "cannot" {
+			return gomemcached.DELTA_BADVAL
+		}
+	case "SERVER_ERROR":
+		// Such as "SERVER_ERROR out of memory storing object" or
+		// "SERVER_ERROR object too large for cache".
+		if len(parts) > 1 && string(parts[1]) == "out" {
+			return gomemcached.ENOMEM
+		}
+		if len(parts) > 1 && string(parts[1]) == "object" {
+			return gomemcached.E2BIG
+		}
+	}
+	return gomemcached.EINVAL
+}
+
+// Reads a reply line, whose fields are only valid until the next read
+// of br.
+func AsciiTargetReadLine(br *bufio.Reader) ([][]byte, error) {
+	line, isPrefix, err := br.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	if isPrefix {
+		return nil, fmt.Errorf("error: line is too long")
+	}
+	return AsciiFields(line, nil), nil
+}
+
+// Reads the reply to a get or gat, whose values were responded to by
+// AsciiTargetReadLines, responding to a miss or an error.
+func AsciiTargetGetRead(br *bufio.Reader, bw *bufio.Writer, req Request) error {
+	if req.Meta != nil {
+		return AsciiTargetMetaGetRead(br, req)
+	}
+	numValues, endParts, err := AsciiTargetReadLines(br, req)
+	if err != nil {
+		if numValues > 0 {
+			return asciiTargetRespondedError{err}
+		}
+		return err
+	}
+	if len(endParts) > 0 && bytes.Equal(endParts[0], end_tok) {
+		if numValues <= 0 {
+			AsciiTargetRespond(req, gomemcached.KEY_ENOENT, nil)
+		}
+	} else if numValues <= 0 {
+		AsciiTargetRespond(req, AsciiTargetStatus(endParts), nil)
+	}
+	return nil
+}
+
+// A handler for a command whose reply is a single status line, such as
+// DELETED or NOT_FOUND, where write writes the command.
+func AsciiTargetLineHandler(write func(*bufio.Writer, Request)) AsciiTargetHandler {
+	return AsciiTargetHandler{
+		Write: func(br *bufio.Reader, bw *bufio.Writer, req Request) error {
+			write(bw, req)
+			return nil
+		},
+		Read: func(br *bufio.Reader, bw *bufio.Writer, req Request) error {
+			parts, err := AsciiTargetReadLine(br)
+			if err != nil {
+				return err
+			}
+			AsciiTargetRespond(req, AsciiTargetStatus(parts), nil)
+			return nil
+		},
+	}
+}
+
+// A handler for incr or decr, whose reply is the new value, which is
+// responded to as an 8 byte body, like the binary protocol.  When a
+// missing key is to be created with the initial value, or there's a
+// cas, which classic incr and decr don't support, it's sent as an ma.
+func AsciiTargetArithHandler(cmd []byte) AsciiTargetHandler {
+	return AsciiTargetHandler{
+		Write: func(br *bufio.Reader, bw *bufio.Writer, req Request) error {
+			var scratch [20]byte
+			if binary.BigEndian.Uint32(req.Req.Extras[16:]) != 0xffffffff ||
+				req.Req.Cas != 0 {
+				AsciiTargetMetaArithWrite(bw, req, bytes.Equal(cmd, prefix_decr))
+				return nil
+			}
+			bw.Write(cmd)
+			bw.Write(req.Req.Key)
+			bw.Write(space)
+			bw.Write(strconv.AppendUint(scratch[:0],
+				binary.BigEndian.Uint64(req.Req.Extras), 10))
+			bw.Write(crnl)
+			return nil
+		},
+		Read: func(br *bufio.Reader, bw *bufio.Writer, req Request) error {
+			parts, err := AsciiTargetReadLine(br)
+			if err != nil {
+				return err
+			}
+			// The value of an ma is on the line after its VA line.
+			if len(parts) > 0 && bytes.Equal(parts[0], meta_va_tok) {
+				if parts, err = AsciiTargetReadLine(br); err != nil {
+					return err
+				}
+			}
+			if len(parts) == 1 {
+				if val, ok := AsciiParseUint(parts[0], 64); ok {
+					body := make([]byte, 8)
+					binary.BigEndian.PutUint64(body, val)
+					AsciiTargetRespond(req, gomemcached.SUCCESS, body)
+					return nil
+				}
+			}
+			AsciiTargetRespond(req, AsciiTargetStatus(parts), nil)
+			return nil
+		},
+	}
+}
+
+// Writes an incr or decr as an ma, which returns the new value (v).
+func AsciiTargetMetaArithWrite(bw *bufio.Writer, req Request, decr bool) {
+	var scratch [20]byte
+	bw.Write(prefix_meta_arith)
+	bw.Write(req.Req.Key)
+	bw.WriteString(" v D")
+	bw.Write(strconv.AppendUint(scratch[:0],
+		binary.BigEndian.Uint64(req.Req.Extras), 10))
+	if decr {
+		bw.WriteString(" MD")
+	}
+	if exp := binary.BigEndian.Uint32(req.Req.Extras[16:]); exp != 0xffffffff {
+		bw.WriteString(" N")
+		bw.Write(strconv.AppendUint(scratch[:0], uint64(exp), 10))
+		bw.WriteString(" J")
+		bw.Write(strconv.AppendUint(scratch[:0],
+			binary.BigEndian.Uint64(req.Req.Extras[8:]), 10))
+	}
+	if req.Req.Cas != 0 {
+		bw.WriteString(" C")
+		bw.Write(strconv.AppendUint(scratch[:0], req.Req.Cas, 10))
+	}
+	bw.Write(crnl)
 }
 
 func AsciiTargetMutationHandler(cmd []byte) AsciiTargetHandler {
@@ -84,14 +374,53 @@ func AsciiTargetMutationWrite(br *bufio.Reader, bw *bufio.Writer,
 	flg := uint64(binary.BigEndian.Uint32(req.Req.Extras))
 	exp := uint64(binary.BigEndian.Uint32(req.Req.Extras[4:]))
 
+	var scratch [20]byte
+
+	// Other storage commands with a cas, and invalidating sets, are an
+	// ms, with their mode.
+	mode, ok := asciiTargetMetaModes[UnquietOpcode(req.Req.Opcode)]
+	invalidate := req.Meta != nil && req.Meta.Invalidate
+	if (ok && req.Req.Cas != 0) || invalidate {
+		bw.Write(prefix_meta_set)
+		bw.Write(req.Req.Key)
+		bw.Write(space)
+		bw.Write(strconv.AppendUint(scratch[:0], uint64(len(req.Req.Body)), 10))
+		bw.WriteString(mode)
+		bw.WriteString(" F")
+		bw.Write(strconv.AppendUint(scratch[:0], flg, 10))
+		bw.WriteString(" T")
+		bw.Write(strconv.AppendUint(scratch[:0], exp, 10))
+		if req.Req.Cas != 0 {
+			bw.WriteString(" C")
+			bw.Write(strconv.AppendUint(scratch[:0], req.Req.Cas, 10))
+		}
+		if invalidate {
+			bw.WriteString(" I")
+		}
+		bw.Write(crnl)
+		bw.Write(req.Req.Body)
+		bw.Write(crnl)
+		return nil
+	}
+
+	// A set with a cas is an ascii cas command.
+	isCas := req.Req.Cas != 0 && bytes.Equal(cmd, prefix_set)
+	if isCas {
+		cmd = prefix_cas
+	}
+
 	bw.Write(cmd)
 	bw.Write(req.Req.Key)
 	bw.Write(space)
-	bw.Write([]byte(strconv.FormatUint(flg, 10)))
+	bw.Write(strconv.AppendUint(scratch[:0], flg, 10))
 	bw.Write(space)
-	bw.Write([]byte(strconv.FormatUint(exp, 10)))
+	bw.Write(strconv.AppendUint(scratch[:0], exp, 10))
 	bw.Write(space)
-	bw.Write([]byte(strconv.FormatUint(uint64(len(req.Req.Body)), 10)))
+	bw.Write(strconv.AppendUint(scratch[:0], uint64(len(req.Req.Body)), 10))
+	if isCas {
+		bw.Write(space)
+		bw.Write(strconv.AppendUint(scratch[:0], req.Req.Cas, 10))
+	}
 	bw.Write(crnl)
 	bw.Write(req.Req.Body)
 	bw.Write(crnl)
@@ -101,41 +430,21 @@ func AsciiTargetMutationWrite(br *bufio.Reader, bw *bufio.Writer,
 
 func AsciiTargetMutationRead(br *bufio.Reader, bw *bufio.Writer,
 	req Request, cmd []byte) error {
-	line, isPrefix, err := br.ReadLine()
+	parts, err := AsciiTargetReadLine(br)
 	if err != nil {
 		return err
 	}
-	if isPrefix {
-		return fmt.Errorf("error: line is too long")
-	}
-	if string(line) == "STORED" {
-		req.Res <- &gomemcached.MCResponse{
-			Opcode: req.Req.Opcode,
-			Status: gomemcached.SUCCESS,
-			Opaque: req.Req.Opaque,
-			Key:    req.Req.Key,
-		}
-	} else if string(line) == "NOT_STORED" {
-		req.Res <- &gomemcached.MCResponse{
-			Opcode: req.Req.Opcode,
-			Status: gomemcached.NOT_STORED,
-			Opaque: req.Req.Opaque,
-			Key:    req.Req.Key,
-		}
-	} else {
-		req.Res <- &gomemcached.MCResponse{
-			Opcode: req.Req.Opcode,
-			Status: gomemcached.EINVAL,
-			Opaque: req.Req.Opaque,
-			Key:    req.Req.Key,
-		}
-	}
+	AsciiTargetRespond(req, AsciiTargetStatus(parts), nil)
 	return nil
 }
 
-func AsciiTargetReadLines(br *bufio.Reader, req Request) (int, []string, error) {
+// Reads VALUE lines and their values, responding to the request with
+// each value, until a line that's not a VALUE line, whose fields are
+// returned and are only valid until the next read of br.
+func AsciiTargetReadLines(br *bufio.Reader, req Request) (int, [][]byte, error) {
 	numValues := 0
 
+	var fields [8][]byte
 	for {
 		line, isPrefix, err := br.ReadLine()
 		if err != nil {
@@ -145,43 +454,51 @@ func AsciiTargetReadLines(br *bufio.Reader, req Request) (int, []string, error)
 			return numValues, nil, fmt.Errorf("error: line is too long")
 		}
 
-		parts := strings.Split(string(line), " ")
-		if parts[0] == "VALUE" {
-			flg, err := strconv.Atoi(parts[2])
-			if err != nil {
-				return numValues, parts, err
+		parts := AsciiFields(line, fields[:0])
+		if len(parts) > 0 && bytes.Equal(parts[0], value_tok) {
+			if len(parts) < 4 {
+				return numValues, parts, fmt.Errorf("error: bad VALUE line")
+			}
+			flg, ok := AsciiParseUint(parts[2], 32)
+			if !ok {
+				return numValues, parts, fmt.Errorf("error: bad VALUE flags")
+			}
+			nval64, ok := AsciiParseUint(parts[3], 31)
+			if !ok {
+				return numValues, parts, fmt.Errorf("error: bad VALUE length")
 			}
+			nval := int(nval64)
 
-			nval, err := strconv.Atoi(parts[3])
-			if err != nil {
-				return numValues, parts, err
+			// The key is usually the request's key, which saves a
+			// copy, as the line is only valid until the next read.
+			key := req.Req.Key
+			if !bytes.Equal(parts[1], key) {
+				key = append([]byte(nil), parts[1]...)
 			}
 
-			buf := make([]byte, nval+2)
-			nbuf, err := io.ReadFull(br, buf)
+			val, err := AsciiTargetReadValue(br, nval)
 			if err != nil {
 				return numValues, parts, err
 			}
-			if nbuf != nval+2 {
-				err = fmt.Errorf("error: nbuf mismatch: %d != %d", nbuf, nval+2)
-				return numValues, parts, err
-			}
-			if !bytes.Equal(buf[nbuf-2:], crnl) {
-				err = fmt.Errorf("error: was expecting crlf")
-				return numValues, parts, err
-			}
 
 			extras := make([]byte, 4)
 			binary.BigEndian.PutUint32(extras, uint32(flg))
 
-			req.Res <- &gomemcached.MCResponse{
+			// The VALUE lines of gets and gats have a cas.
+			var cas uint64
+			if len(parts) >= 5 {
+				cas, _ = AsciiParseUint(parts[4], 64)
+			}
+
+			req.Respond(&gomemcached.MCResponse{
 				Opcode: req.Req.Opcode,
 				Status: gomemcached.SUCCESS,
 				Opaque: req.Req.Opaque,
+				Cas:    cas,
 				Extras: extras,
-				Key:    []byte(parts[1]),
-				Body:   buf[:nval],
-			}
+				Key:    key,
+				Body:   val,
+			})
 
 			numValues++
 		} else {
@@ -192,80 +509,228 @@ func AsciiTargetReadLines(br *bufio.Reader, req Request) (int, []string, error)
 	return numValues, nil, fmt.Errorf("error: unreachable was reached")
 }
 
+// Reads a value of nval bytes and its crlf.  The value's buffer becomes
+// a response's body, which the source writes to its client after we're
+// done, so it's not pooled.
+func AsciiTargetReadValue(br *bufio.Reader, nval int) ([]byte, error) {
+	buf := make([]byte, nval+2)
+	nbuf, err := io.ReadFull(br, buf)
+	if err != nil {
+		return nil, err
+	}
+	if nbuf != nval+2 {
+		return nil, fmt.Errorf("error: nbuf mismatch: %d != %d", nbuf, nval+2)
+	}
+	if !bytes.Equal(buf[nbuf-2:], crnl) {
+		return nil, fmt.Errorf("error: was expecting crlf")
+	}
+	return buf[:nval], nil
+}
+
+// Writes a get or gat with a RequestMeta as an mg, which returns the
+// item's info (t, h and l) along with its value, flags and cas, and
+// its stale-while-revalidate flags (W, X and Z).
+func AsciiTargetMetaGetWrite(bw *bufio.Writer, req Request) {
+	var scratch [20]byte
+	bw.Write(prefix_meta_get)
+	bw.Write(req.Req.Key)
+	bw.WriteString(" v f c t h l")
+	if UnquietOpcode(req.Req.Opcode) == gomemcached.GAT {
+		bw.WriteString(" T")
+		bw.Write(strconv.AppendUint(scratch[:0],
+			uint64(binary.BigEndian.Uint32(req.Req.Extras)), 10))
+	}
+	if req.Meta.Recache >= 0 {
+		bw.WriteString(" R")
+		bw.Write(strconv.AppendInt(scratch[:0], req.Meta.Recache, 10))
+	}
+	bw.Write(crnl)
+}
+
+// Reads the reply to an mg, responding with the item's info in the
+// response's extras (see ItemInfoExtras).
+func AsciiTargetMetaGetRead(br *bufio.Reader, req Request) error {
+	parts, err := AsciiTargetReadLine(br)
+	if err != nil {
+		return err
+	}
+	if len(parts) < 2 || !bytes.Equal(parts[0], meta_va_tok) {
+		AsciiTargetRespond(req, AsciiTargetStatus(parts), nil)
+		return nil
+	}
+	nval, ok := AsciiParseUint(parts[1], 31)
+	if !ok {
+		return fmt.Errorf("error: bad VA length")
+	}
+	// The flags are parsed before the value is read, as they're only
+	// valid until the next read of br.
+	var flg, cas uint64
+	info := ItemInfo{TTL: -1}
+	for _, part := range parts[2:] {
+		if len(part) <= 0 {
+			continue
+		}
+		token := part[1:]
+		switch part[0] {
+		case 'f':
+			flg, _ = AsciiParseUint(token, 32)
+		case 'c':
+			cas, _ = AsciiParseUint(token, 64)
+		case 't':
+			if ttl, err := strconv.ParseInt(string(token), 10, 32); err == nil {
+				info.TTL = int32(ttl)
+			}
+		case 'h':
+			info.Fetched = string(token) == "1"
+		case 'l':
+			n, _ := AsciiParseUint(token, 32)
+			info.LastAccess = uint32(n)
+		case 'W':
+			info.Win = true
+		case 'X':
+			info.Stale = true
+		case 'Z':
+			info.WinSent = true
+		}
+	}
+	val, err := AsciiTargetReadValue(br, int(nval))
+	if err != nil {
+		return err
+	}
+	req.Respond(&gomemcached.MCResponse{
+		Opcode: req.Req.Opcode,
+		Status: gomemcached.SUCCESS,
+		Opaque: req.Req.Opaque,
+		Cas:    cas,
+		Extras: ItemInfoExtras(uint32(flg), info),
+		Key:    req.Req.Key,
+		Body:   val,
+	})
+	return nil
+}
+
 type MemcachedAsciiTarget struct {
 	spec          string
 	incomingChans []chan []Request
+	workers       *sync.WaitGroup
 }
 
 func (s MemcachedAsciiTarget) PickChannel(clientNum uint32, bucket string) chan []Request {
 	return s.incomingChans[clientNum%uint32(len(s.incomingChans))]
 }
 
+func (s MemcachedAsciiTarget) QueueLens() []int {
+	return ChanLens(s.incomingChans)
+}
+
+func (s MemcachedAsciiTarget) Close() {
+	for _, c := range s.incomingChans {
+		close(c)
+	}
+	s.workers.Wait()
+}
+
 func MemcachedAsciiTargetStart(spec string, params Params,
-	statsChan chan Stats) Target {
+	stats *Stats) (Target, error) {
 	spec = strings.Replace(spec, "memcached-ascii:", "", 1)
 
 	s := MemcachedAsciiTarget{
 		spec:          spec,
 		incomingChans: make([]chan []Request, params.TargetConcurrency),
+		workers:       &sync.WaitGroup{},
 	}
 
 	for i := range s.incomingChans {
-		s.incomingChans[i] = make(chan []Request, params.TargetChanSize)
 		incomingBatched := make(chan []Request, params.TargetChanSize)
-		go func() {
-			BatchRequests(params.TargetChanSize,
-				s.incomingChans[i], incomingBatched, statsChan)
-		}()
-		MemcachedAsciiTargetStartIncoming(s, incomingBatched)
+		policy := NewBatchPolicy(params)
+		err := MemcachedAsciiTargetStartIncoming(s, incomingBatched, policy,
+			stats)
+		if err != nil {
+			s.incomingChans = s.incomingChans[:i] // Close the started ones.
+			s.Close()
+			return nil, err
+		}
+		s.incomingChans[i] = make(chan []Request, params.TargetChanSize)
+		go BatchRequests(policy, s.incomingChans[i], incomingBatched, stats)
 	}
 
-	return s
+	return s, nil
 }
 
-func MemcachedAsciiTargetStartIncoming(s MemcachedAsciiTarget, incoming chan []Request) {
+func MemcachedAsciiTargetStartIncoming(s MemcachedAsciiTarget, incoming chan []Request,
+	policy *BatchPolicy, stats *Stats) error {
 	conn, err := net.Dial("tcp", s.spec)
 	if err != nil {
-		log.Fatalf("error: memcached-ascii connect failed: %s; err: %v", s.spec, err)
+		return fmt.Errorf("error: memcached-ascii connect failed: %s; err: %v", s.spec, err)
 	}
 
+	s.workers.Add(1)
 	go func() {
+		defer s.workers.Done()
+
 		br := bufio.NewReader(conn)
 		bw := bufio.NewWriter(conn)
 
+		ts := NewTargetStats(stats, "tot-target-memcached-ascii")
+
 		for reqs := range incoming {
-			reset := false
-			for _, req := range reqs {
-				if h, ok := AsciiTargetHandlers[req.Req.Opcode]; ok && !reset {
-					err := h.Write(br, bw, req)
-					if err != nil {
-						reset = true
-					}
+			reqs = ts.Begin(reqs)
+
+			// A stalled server fails the round trip at the batch's
+			// latest deadline, instead of hanging the worker.
+			conn.SetDeadline(LatestDeadline(reqs))
+
+			var resetErr error
+			now := time.Now()
+			expired := make([]bool, len(reqs))
+			for i, req := range reqs {
+				if req.Expired(now) {
+					RespondTimeout(req)
+					expired[i] = true
+					continue
+				}
+				if h, ok := AsciiTargetHandlers[UnquietOpcode(req.Req.Opcode)]; ok && resetErr == nil {
+					resetErr = h.Write(br, bw, req)
 				}
 			}
-			bw.Flush()
-			for _, req := range reqs {
-				if h, ok := AsciiTargetHandlers[req.Req.Opcode]; ok && !reset {
-					err := h.Read(br, bw, req)
-					if err != nil {
-						req.Res <- &gomemcached.MCResponse{
-							Opcode: req.Req.Opcode,
-							Status: gomemcached.EINVAL,
-							Opaque: req.Req.Opaque,
-						}
-						reset = true
-					}
-				} else {
-					req.Res <- &gomemcached.MCResponse{
+			if resetErr == nil {
+				resetErr = bw.Flush()
+			}
+			for i, req := range reqs {
+				if expired[i] {
+					continue
+				}
+				h, ok := AsciiTargetHandlers[UnquietOpcode(req.Req.Opcode)]
+				if !ok {
+					req.Respond(&gomemcached.MCResponse{
 						Opcode: req.Req.Opcode,
 						Status: gomemcached.UNKNOWN_COMMAND,
 						Opaque: req.Req.Opaque,
+					})
+					continue
+				}
+				if resetErr == nil {
+					if resetErr = h.Read(br, bw, req); resetErr == nil {
+						continue
 					}
+					if re, ok := resetErr.(asciiTargetRespondedError); ok {
+						resetErr = re.error
+						continue
+					}
+				}
+				status := gomemcached.EINVAL
+				if ne, ok := resetErr.(net.Error); ok && ne.Timeout() {
+					status = ETIMEDOUT
 				}
+				req.Respond(&gomemcached.MCResponse{
+					Opcode: req.Req.Opcode,
+					Status: status,
+					Opaque: req.Req.Opaque,
+				})
 			}
 
-			if reset {
-				log.Printf("warn: memcached-ascii closing conn; saw error: %v", err)
+			if resetErr != nil {
+				log.Printf("warn: memcached-ascii closing conn; saw error: %v", resetErr)
 				conn.Close()
 				conn = Reconnect(s.spec, func(spec string) (interface{}, error) {
 					return net.Dial("tcp", spec)
@@ -273,6 +738,10 @@ func MemcachedAsciiTargetStartIncoming(s MemcachedAsciiTarget, incoming chan []R
 				br = bufio.NewReader(conn)
 				bw = bufio.NewWriter(conn)
 			}
+			policy.Observe(time.Since(ts.start))
 		}
+		conn.Close()
 	}()
+
+	return nil
 }
@@ -0,0 +1,72 @@
+package grouter
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+func TestMemcachedAsciiTargetGetTimeout(t *testing.T) {
+	// A server that replies to a get with its value, and then stalls
+	// before the END line.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					if _, err := br.ReadString('\n'); err != nil {
+						return
+					}
+					conn.Write([]byte("VALUE a 0 1 1\r\nx\r\n"))
+				}
+			}(conn)
+		}
+	}()
+
+	params := Params{TargetChanSize: 1, TargetConcurrency: 1}
+	target, err := MemcachedAsciiTargetStart("memcached-ascii:"+l.Addr().String(),
+		params, NewStats())
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer target.Close()
+
+	req := Request{
+		Bucket: "default",
+		Req: &gomemcached.MCRequest{
+			Opcode: gomemcached.GET,
+			Key:    []byte("a"),
+			Opaque: 123,
+		},
+		Res:      make(chan *gomemcached.MCResponse, 2),
+		Deadline: time.Now().Add(100 * time.Millisecond),
+	}
+	target.PickChannel(0, "default") <- []Request{req}
+
+	res := <-req.Res
+	if res.Status != gomemcached.SUCCESS || string(res.Body) != "x" {
+		t.Errorf("expected the value x, got %v %q", res.Status, res.Body)
+	}
+
+	// The read of the END line times out, which resets the conn, but
+	// the get was already responded to.
+	time.Sleep(300 * time.Millisecond)
+	select {
+	case res := <-req.Res:
+		t.Errorf("expected one response, got another: %v", res.Status)
+	default:
+	}
+}
@@ -1,8 +1,12 @@
 package grouter
 
 import (
+	"fmt"
 	"log"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dustin/gomemcached"
 	"github.com/dustin/gomemcached/client"
@@ -11,61 +15,213 @@ import (
 type MemcachedBinaryTarget struct {
 	spec          string
 	incomingChans []chan []Request
+	workers       *sync.WaitGroup
 }
 
 func (s MemcachedBinaryTarget) PickChannel(clientNum uint32, bucket string) chan []Request {
 	return s.incomingChans[clientNum%uint32(len(s.incomingChans))]
 }
 
+func (s MemcachedBinaryTarget) QueueLens() []int {
+	return ChanLens(s.incomingChans)
+}
+
+func (s MemcachedBinaryTarget) Close() {
+	for _, c := range s.incomingChans {
+		close(c)
+	}
+	s.workers.Wait()
+}
+
 func MemcachedBinaryTargetStart(spec string, params Params,
-	statsChan chan Stats) Target {
+	stats *Stats) (Target, error) {
 	spec = strings.Replace(spec, "memcached-binary:", "", 1)
 
 	s := MemcachedBinaryTarget{
 		spec:          spec,
 		incomingChans: make([]chan []Request, params.TargetConcurrency),
+		workers:       &sync.WaitGroup{},
 	}
 
 	for i := range s.incomingChans {
-		s.incomingChans[i] = make(chan []Request, params.TargetChanSize)
 		incomingBatched := make(chan []Request, params.TargetChanSize)
-		go func() {
-			BatchRequests(params.TargetChanSize,
-				s.incomingChans[i], incomingBatched, statsChan)
-		}()
-		MemcachedBinaryTargetStartIncoming(s, incomingBatched)
+		policy := NewBatchPolicy(params)
+		err := MemcachedBinaryTargetStartIncoming(s, incomingBatched, policy,
+			stats)
+		if err != nil {
+			s.incomingChans = s.incomingChans[:i] // Close the started ones.
+			s.Close()
+			return nil, err
+		}
+		s.incomingChans[i] = make(chan []Request, params.TargetChanSize)
+		go BatchRequests(policy, s.incomingChans[i], incomingBatched, stats)
 	}
 
-	return s
+	return s, nil
 }
 
-func MemcachedBinaryTargetStartIncoming(s MemcachedBinaryTarget, incoming chan []Request) {
+func MemcachedBinaryTargetStartIncoming(s MemcachedBinaryTarget, incoming chan []Request,
+	policy *BatchPolicy, stats *Stats) error {
 	client, err := memcached.Connect("tcp", s.spec)
 	if err != nil {
-		log.Fatalf("error: memcached-binary connect failed: %s; err: %v", s.spec, err)
+		return fmt.Errorf("error: memcached-binary connect failed: %s; err: %v", s.spec, err)
 	}
 
+	s.workers.Add(1)
 	go func() {
+		defer s.workers.Done()
+
+		ts := NewTargetStats(stats, "tot-target-memcached-binary")
+
 		for reqs := range incoming {
-			for _, req := range reqs {
-				log.Printf("sending.....: %s; err: %v", s.spec, err)
-				res, err := client.Send(req.Req)
-				log.Printf("sending.done: %s; err: %v", s.spec, err)
-				if err != nil {
-					req.Res <- &gomemcached.MCResponse{
-						Opcode: req.Req.Opcode,
-						Status: gomemcached.EINVAL,
-						Opaque: req.Req.Opaque,
-					}
-					log.Printf("warn: memcached-binary closing conn; saw error: %v", err)
-					client.Close()
-					client = Reconnect(s.spec, func(spec string) (interface{}, error) {
-						return memcached.Connect("tcp", spec)
-					}).(*memcached.Client)
-				} else {
-					req.Res <- res
+			reqs = ts.Begin(reqs)
+			err := MemcachedBinaryTargetSend(client, reqs)
+			if err != nil {
+				log.Printf("warn: memcached-binary closing conn; saw error: %v", err)
+				client.Close()
+				client = Reconnect(s.spec, func(spec string) (interface{}, error) {
+					return memcached.Connect("tcp", spec)
+				}).(*memcached.Client)
+			}
+			policy.Observe(time.Since(ts.start))
+		}
+		client.Close()
+	}()
+
+	return nil
+}
+
+// Sends a batch of requests to the memcached server and responds to
+// them.  Quiet requests, which the server only responds to on errors,
+// are followed by a NOOP, whose response means that any of them that
+// weren't responded to succeeded, as does the response of any later
+// non-quiet request.  Requests are sent with their index in the batch
+// as their opaque, so that responses can be matched up with requests.
+// On a conn error, the requests without a response yet get an EINVAL.
+//
+// As the client doesn't expose its conn's deadlines, the client is
+// closed if the batch's latest deadline passes first, so that a stalled
+// server can't hang the worker, and the requests get an ETIMEDOUT.  As
+// the deadline might pass just after the last response, an error is
+// returned whenever the client was closed, so the caller reconnects.
+func MemcachedBinaryTargetSend(client *memcached.Client, reqs []Request) error {
+	var expired int32
+	var timer *time.Timer
+	if deadline := LatestDeadline(reqs); !deadline.IsZero() {
+		timer = time.AfterFunc(deadline.Sub(time.Now()), func() {
+			atomic.StoreInt32(&expired, 1)
+			client.Close()
+		})
+	}
+
+	done := make([]bool, len(reqs))
+	respond := func(i int, res *gomemcached.MCResponse) {
+		res.Opaque = reqs[i].Req.Opaque
+		reqs[i].Respond(res)
+		done[i] = true
+	}
+
+	var quiet []int // Indexes of the quiet requests awaiting a fence.
+	fenced := func() {
+		for _, i := range quiet {
+			if !done[i] {
+				respond(i, &gomemcached.MCResponse{
+					Opcode: reqs[i].Req.Opcode,
+					Status: gomemcached.SUCCESS,
+					Key:    reqs[i].Req.Key,
+				})
+			}
+		}
+		quiet = quiet[:0]
+	}
+
+	// Receives responses until the one with the given opaque, which
+	// is returned, responding to any failed quiet requests on the way.
+	receive := func(opaque uint32) (*gomemcached.MCResponse, error) {
+		for {
+			res, err := client.Receive()
+			if res == nil || MemcachedBinaryConnErr(err) {
+				if err == nil {
+					err = fmt.Errorf("error: memcached-binary missing response")
 				}
+				return nil, err
 			}
+			if res.Opaque == opaque {
+				return res, nil
+			}
+			if int(res.Opaque) < len(reqs) && !done[res.Opaque] {
+				respond(int(res.Opaque), res)
+			}
+		}
+	}
+
+	err := func() error {
+		for i, req := range reqs {
+			if req.Expired(time.Now()) {
+				RespondTimeout(req)
+				done[i] = true
+				continue
+			}
+			r := *req.Req
+			r.Opaque = uint32(i)
+			if err := client.Transmit(&r); err != nil {
+				return err
+			}
+			if IsQuietOpcode(r.Opcode) {
+				quiet = append(quiet, i)
+				continue
+			}
+			res, err := receive(r.Opaque)
+			if err != nil {
+				return err
+			}
+			respond(i, res)
+			fenced()
+		}
+		if len(quiet) > 0 {
+			noop := &gomemcached.MCRequest{
+				Opcode: gomemcached.NOOP,
+				Opaque: uint32(len(reqs)),
+			}
+			if err := client.Transmit(noop); err != nil {
+				return err
+			}
+			if _, err := receive(noop.Opaque); err != nil {
+				return err
+			}
+			fenced()
 		}
+		return nil
 	}()
+
+	if timer != nil && !timer.Stop() && err == nil {
+		err = fmt.Errorf("error: memcached-binary deadline passed after the batch")
+	}
+
+	if err != nil {
+		status := gomemcached.EINVAL
+		if atomic.LoadInt32(&expired) != 0 {
+			status = ETIMEDOUT
+		}
+		for i, req := range reqs {
+			if !done[i] {
+				respond(i, &gomemcached.MCResponse{
+					Opcode: req.Req.Opcode,
+					Status: status,
+					Key:    req.Req.Key,
+				})
+			}
+		}
+	}
+	return err
+}
+
+// Returns true if err is from the conn, rather than being a response
+// with a non-success status, which the client also returns as an error.
+func MemcachedBinaryConnErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	_, ok := err.(*gomemcached.MCResponse)
+	return !ok
 }
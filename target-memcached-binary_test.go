@@ -0,0 +1,186 @@
+package grouter
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dustin/gomemcached"
+	"github.com/dustin/gomemcached/client"
+)
+
+// Starts a fake memcached server, which fails the requests for the keys
+// in fail with their status, and, like memcached, responds to the other
+// requests, except for quiet ones.  The opcodes of a conn's requests
+// are sent to the returned channel when the conn closes.
+func memcachedBinaryTestServer(t *testing.T,
+	fail map[string]gomemcached.Status) (net.Listener, chan []gomemcached.CommandCode) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	received := make(chan []gomemcached.CommandCode, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var opcodes []gomemcached.CommandCode
+		defer func() { received <- opcodes }()
+
+		hdr := make([]byte, 24)
+		for {
+			if _, err := io.ReadFull(conn, hdr); err != nil {
+				return
+			}
+			body := make([]byte, binary.BigEndian.Uint32(hdr[8:]))
+			if _, err := io.ReadFull(conn, body); err != nil {
+				return
+			}
+			opcode := gomemcached.CommandCode(hdr[1])
+			opcodes = append(opcodes, opcode)
+			nextras := int(hdr[4])
+			key := string(body[nextras : nextras+int(binary.BigEndian.Uint16(hdr[2:]))])
+
+			status, failed := fail[key]
+			if !failed {
+				status = gomemcached.SUCCESS
+				if IsQuietOpcode(opcode) {
+					continue
+				}
+			}
+			res := make([]byte, 24)
+			res[0] = 0x81
+			res[1] = byte(opcode)
+			binary.BigEndian.PutUint16(res[6:], uint16(status))
+			copy(res[12:16], hdr[12:16]) // The opaque.
+			if _, err := conn.Write(res); err != nil {
+				return
+			}
+		}
+	}()
+	return l, received
+}
+
+func TestMemcachedBinaryTargetSend(t *testing.T) {
+	fail := map[string]gomemcached.Status{
+		"exists":  gomemcached.KEY_EEXISTS,
+		"missing": gomemcached.KEY_ENOENT,
+	}
+
+	type req struct {
+		opcode  gomemcached.CommandCode
+		key     string
+		expired bool
+		status  gomemcached.Status // Of the expected response.
+	}
+	tests := []struct {
+		reqs []req
+		sent []gomemcached.CommandCode // As received by the server.
+	}{
+		// Quiet requests are fenced by a NOOP.
+		{[]req{
+			{gomemcached.SETQ, "a", false, gomemcached.SUCCESS},
+			{gomemcached.SETQ, "b", false, gomemcached.SUCCESS},
+		}, []gomemcached.CommandCode{
+			gomemcached.SETQ, gomemcached.SETQ, gomemcached.NOOP,
+		}},
+		{[]req{
+			{gomemcached.ADDQ, "exists", false, gomemcached.KEY_EEXISTS},
+			{gomemcached.SETQ, "b", false, gomemcached.SUCCESS},
+			{gomemcached.DELETEQ, "missing", false, gomemcached.KEY_ENOENT},
+		}, []gomemcached.CommandCode{
+			gomemcached.ADDQ, gomemcached.SETQ, gomemcached.DELETEQ,
+			gomemcached.NOOP,
+		}},
+		// A later non-quiet request's response is the fence.
+		{[]req{
+			{gomemcached.SETQ, "a", false, gomemcached.SUCCESS},
+			{gomemcached.DELETEQ, "missing", false, gomemcached.KEY_ENOENT},
+			{gomemcached.GET, "a", false, gomemcached.SUCCESS},
+		}, []gomemcached.CommandCode{
+			gomemcached.SETQ, gomemcached.DELETEQ, gomemcached.GET,
+		}},
+		{[]req{
+			{gomemcached.SETQ, "a", false, gomemcached.SUCCESS},
+			{gomemcached.GET, "missing", false, gomemcached.KEY_ENOENT},
+			{gomemcached.SETQ, "b", false, gomemcached.SUCCESS},
+		}, []gomemcached.CommandCode{
+			gomemcached.SETQ, gomemcached.GET, gomemcached.SETQ,
+			gomemcached.NOOP,
+		}},
+		// Without quiet requests, there's no NOOP.
+		{[]req{
+			{gomemcached.SET, "a", false, gomemcached.SUCCESS},
+			{gomemcached.GET, "missing", false, gomemcached.KEY_ENOENT},
+		}, []gomemcached.CommandCode{
+			gomemcached.SET, gomemcached.GET,
+		}},
+		// Expired requests aren't sent.
+		{[]req{
+			{gomemcached.SETQ, "a", true, ETIMEDOUT},
+			{gomemcached.GET, "a", false, gomemcached.SUCCESS},
+		}, []gomemcached.CommandCode{
+			gomemcached.GET,
+		}},
+	}
+	for i, test := range tests {
+		l, received := memcachedBinaryTestServer(t, fail)
+		client, err := memcached.Connect("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("test %v: connect: %v", i, err)
+		}
+
+		reqs := make([]Request, len(test.reqs))
+		for j, r := range test.reqs {
+			reqs[j] = Request{
+				Req: &gomemcached.MCRequest{
+					Opcode: r.opcode,
+					Key:    []byte(r.key),
+					Opaque: uint32(100 + j),
+				},
+				Res: make(chan *gomemcached.MCResponse, 1),
+			}
+			if r.expired {
+				reqs[j].Deadline = time.Now().Add(-time.Second)
+			}
+		}
+		if err := MemcachedBinaryTargetSend(client, reqs); err != nil {
+			t.Errorf("test %v: unexpected err: %v", i, err)
+		}
+		client.Close()
+		l.Close()
+
+		for j, req := range reqs {
+			select {
+			case res := <-req.Res:
+				if res.Status != test.reqs[j].status {
+					t.Errorf("test %v, req %v: expected status %v, got %v",
+						i, j, test.reqs[j].status, res.Status)
+				}
+				if res.Opaque != uint32(100+j) {
+					t.Errorf("test %v, req %v: expected opaque %v, got %v",
+						i, j, 100+j, res.Opaque)
+				}
+			default:
+				t.Errorf("test %v, req %v: no response", i, j)
+			}
+		}
+
+		sent := <-received
+		if len(sent) != len(test.sent) {
+			t.Errorf("test %v: expected sent %v, got %v", i, test.sent, sent)
+			continue
+		}
+		for j := range sent {
+			if sent[j] != test.sent[j] {
+				t.Errorf("test %v: expected sent %v, got %v", i, test.sent, sent)
+				break
+			}
+		}
+	}
+}
@@ -2,93 +2,369 @@ package grouter
 
 import (
 	"encoding/binary"
+	"strconv"
+	"time"
 
 	"github.com/dustin/gomemcached"
 )
 
 type MemoryStorage struct {
-	data     map[string]gomemcached.MCItem
+	data     map[string]memoryItem
 	cas      uint64
+	flushAt  time.Time // When a delayed flush_all empties data.
 	incoming chan []Request
+	done     chan bool
 }
 
+// An item, whose Expiration is a unix time, or 0 if it doesn't expire,
+// with the state that memcached's meta commands return.
+type memoryItem struct {
+	gomemcached.MCItem
+	access  time.Time // When the item was last accessed.
+	fetched bool
+	stale   bool // Invalidated, by a delete or a set (see RequestMeta).
+	winSent bool // A get already won the item's recache.
+}
+
+// Handles a request, by its non-quiet opcode, as quiet requests are
+// responded to just like the others.
 type MemoryStorageHandler func(s *MemoryStorage, req Request)
 
 var MemoryStorageHandlers = map[gomemcached.CommandCode]MemoryStorageHandler{
-	gomemcached.GET: func(s *MemoryStorage, req Request) {
-		ret := &gomemcached.MCResponse{
-			Opcode: req.Req.Opcode,
-			Opaque: req.Req.Opaque,
-			Key:    req.Req.Key,
+	gomemcached.GET:       MemoryStorageGet,
+	gomemcached.GAT:       MemoryStorageGet,
+	gomemcached.SET:       MemoryStorageMutation,
+	gomemcached.ADD:       MemoryStorageMutation,
+	gomemcached.REPLACE:   MemoryStorageMutation,
+	gomemcached.APPEND:    MemoryStorageMutation,
+	gomemcached.PREPEND:   MemoryStorageMutation,
+	gomemcached.DELETE:    MemoryStorageDelete,
+	gomemcached.INCREMENT: MemoryStorageArith,
+	gomemcached.DECREMENT: MemoryStorageArith,
+	gomemcached.TOUCH: func(s *MemoryStorage, req Request) {
+		now := time.Now()
+		item, ok := s.item(string(req.Req.Key), now)
+		if !ok {
+			MemoryStorageRespond(req, gomemcached.KEY_ENOENT, 0)
+			return
+		}
+		item.Expiration = MemoryStorageExpiration(
+			binary.BigEndian.Uint32(req.Req.Extras), now)
+		s.data[string(req.Req.Key)] = item
+		MemoryStorageRespond(req, gomemcached.SUCCESS, item.Cas)
+	},
+	gomemcached.FLUSH: func(s *MemoryStorage, req Request) {
+		var delay uint32
+		if len(req.Req.Extras) >= 4 {
+			delay = binary.BigEndian.Uint32(req.Req.Extras)
 		}
-		if item, ok := s.data[string(req.Req.Key)]; ok {
-			ret.Status = gomemcached.SUCCESS
-			ret.Extras = make([]byte, 4)
-			binary.BigEndian.PutUint32(ret.Extras, item.Flags)
-			ret.Cas = item.Cas
-			ret.Body = item.Data
+		s.flushAt = time.Time{}
+		if delay == 0 {
+			s.flush()
+		} else if delay > 30*24*60*60 {
+			// Like expirations, longer than 30 days is a unix time.
+			s.flushAt = time.Unix(int64(delay), 0)
 		} else {
-			ret.Status = gomemcached.KEY_ENOENT
+			s.flushAt = time.Now().Add(time.Duration(delay) * time.Second)
 		}
-		req.Res <- ret
+		MemoryStorageRespond(req, gomemcached.SUCCESS, 0)
 	},
-	gomemcached.SET: func(s *MemoryStorage, req Request) {
-		s.cas += 1
-		s.data[string(req.Req.Key)] = gomemcached.MCItem{
-			Flags:      binary.BigEndian.Uint32(req.Req.Extras),
-			Expiration: binary.BigEndian.Uint32(req.Req.Extras[4:]),
-			Cas:        s.cas,
-			Data:       req.Req.Body,
+}
+
+func (s *MemoryStorage) flush() {
+	for k := range s.data {
+		delete(s.data, k)
+	}
+}
+
+// Returns the item of a key, which is removed if it has expired.
+func (s *MemoryStorage) item(key string, now time.Time) (memoryItem, bool) {
+	item, ok := s.data[key]
+	if ok && item.Expiration != 0 && int64(item.Expiration) <= now.Unix() {
+		delete(s.data, key)
+		return memoryItem{}, false
+	}
+	return item, ok
+}
+
+// Returns an expiration as a unix time, where, like memcached, an
+// expiration of up to 30 days is relative to now, and 0 never expires.
+func MemoryStorageExpiration(exp uint32, now time.Time) uint32 {
+	if exp == 0 || exp > 30*24*60*60 {
+		return exp
+	}
+	return uint32(now.Unix()) + exp
+}
+
+// Handles get and gat, where a gat also changes the item's expiration.
+// With a RequestMeta, the response has the item's ItemInfo, where, like
+// memcached, the first get of a stale item, or of an item whose ttl is
+// below the request's recache threshold, wins the item's recache, and
+// later gets are told that it was already won.
+func MemoryStorageGet(s *MemoryStorage, req Request) {
+	ret := &gomemcached.MCResponse{
+		Opcode: req.Req.Opcode,
+		Opaque: req.Req.Opaque,
+		Key:    req.Req.Key,
+	}
+	now := time.Now()
+	item, ok := s.item(string(req.Req.Key), now)
+	if !ok {
+		ret.Status = gomemcached.KEY_ENOENT
+		req.Respond(ret)
+		return
+	}
+	if req.Req.Opcode == gomemcached.GAT {
+		item.Expiration = MemoryStorageExpiration(
+			binary.BigEndian.Uint32(req.Req.Extras), now)
+	}
+	if req.Meta != nil {
+		info := ItemInfo{
+			TTL:        -1,
+			LastAccess: uint32(now.Sub(item.access) / time.Second),
+			Fetched:    item.fetched,
+			Stale:      item.stale,
 		}
-		req.Res <- &gomemcached.MCResponse{
-			Opcode: req.Req.Opcode,
-			Status: gomemcached.SUCCESS,
-			Opaque: req.Req.Opaque,
-			Cas:    s.cas,
-			Key:    req.Req.Key,
+		if item.Expiration != 0 {
+			info.TTL = int32(int64(item.Expiration) - now.Unix())
 		}
-	},
-	gomemcached.DELETE: func(s *MemoryStorage, req Request) {
-		ret := &gomemcached.MCResponse{
-			Opcode: req.Req.Opcode,
-			Opaque: req.Req.Opaque,
-			Key:    req.Req.Key,
+		if item.stale || (req.Meta.Recache >= 0 && info.TTL >= 0 &&
+			int64(info.TTL) < req.Meta.Recache) {
+			info.WinSent = item.winSent
+			info.Win = !item.winSent
+			item.winSent = true
 		}
-		if _, ok := s.data[string(req.Req.Key)]; ok {
-			delete(s.data, string(req.Req.Key))
-			ret.Status = gomemcached.SUCCESS
-		} else {
-			ret.Status = gomemcached.KEY_ENOENT
+		ret.Extras = ItemInfoExtras(item.Flags, info)
+	} else {
+		ret.Extras = make([]byte, 4)
+		binary.BigEndian.PutUint32(ret.Extras, item.Flags)
+	}
+	item.access = now
+	item.fetched = true
+	s.data[string(req.Req.Key)] = item
+
+	ret.Status = gomemcached.SUCCESS
+	ret.Cas = item.Cas
+	ret.Body = item.Data
+	req.Respond(ret)
+}
+
+// Handles delete, where, with a RequestMeta that invalidates, the item
+// is marked stale instead, with a new cas and, optionally, a new ttl.
+func MemoryStorageDelete(s *MemoryStorage, req Request) {
+	now := time.Now()
+	key := string(req.Req.Key)
+	item, ok := s.item(key, now)
+	status := MemoryStorageCheck(item.MCItem, ok, req.Req.Cas)
+	if status != gomemcached.SUCCESS {
+		MemoryStorageRespond(req, status, 0)
+		return
+	}
+	if req.Meta == nil || !req.Meta.Invalidate {
+		delete(s.data, key)
+		MemoryStorageRespond(req, status, 0)
+		return
+	}
+	if req.Meta.TTL >= 0 {
+		item.Expiration = MemoryStorageExpiration(uint32(req.Meta.TTL), now)
+	}
+	item.stale = true
+	item.winSent = false
+	s.cas += 1
+	item.Cas = s.cas
+	s.data[key] = item
+	MemoryStorageRespond(req, status, item.Cas)
+}
+
+// Returns the status of a request for an item that must exist and, if
+// the request has a cas, must have that cas.
+func MemoryStorageCheck(item gomemcached.MCItem, ok bool,
+	cas uint64) gomemcached.Status {
+	if !ok {
+		return gomemcached.KEY_ENOENT
+	}
+	if cas != 0 && cas != item.Cas {
+		return gomemcached.KEY_EEXISTS
+	}
+	return gomemcached.SUCCESS
+}
+
+func MemoryStorageRespond(req Request, status gomemcached.Status, cas uint64) {
+	req.Respond(&gomemcached.MCResponse{
+		Opcode: req.Req.Opcode,
+		Status: status,
+		Opaque: req.Req.Opaque,
+		Cas:    cas,
+		Key:    req.Req.Key,
+	})
+}
+
+// Handles the storage opcodes, following memcached: an add fails if the
+// item exists, while a replace, or a set with a cas, fails if it's
+// missing, and an append or prepend changes an existing item's data,
+// keeping its flags and expiration.  Every change bumps the item's cas.
+// With a RequestMeta that invalidates, a set whose cas is older than
+// the item's is stored as a stale item, instead of failing.
+func MemoryStorageMutation(s *MemoryStorage, req Request) {
+	opcode := UnquietOpcode(req.Req.Opcode)
+	key := string(req.Req.Key)
+	now := time.Now()
+	item, ok := s.item(key, now)
+	stale := false
+
+	status := gomemcached.SUCCESS
+	switch opcode {
+	case gomemcached.ADD:
+		if ok {
+			status = gomemcached.KEY_EEXISTS
 		}
-		req.Res <- ret
-	},
+	case gomemcached.APPEND, gomemcached.PREPEND:
+		status = MemoryStorageCheck(item.MCItem, ok, req.Req.Cas)
+		if status == gomemcached.KEY_ENOENT {
+			status = gomemcached.NOT_STORED
+		}
+	case gomemcached.REPLACE:
+		status = MemoryStorageCheck(item.MCItem, ok, req.Req.Cas)
+	default:
+		if req.Req.Cas != 0 {
+			status = MemoryStorageCheck(item.MCItem, ok, req.Req.Cas)
+			if status == gomemcached.KEY_EEXISTS && req.Req.Cas < item.Cas &&
+				req.Meta != nil && req.Meta.Invalidate {
+				status = gomemcached.SUCCESS
+				stale = true
+			}
+		}
+	}
+	if status != gomemcached.SUCCESS {
+		MemoryStorageRespond(req, status, 0)
+		return
+	}
+
+	// The request's body might be pooled, so it's copied.
+	switch opcode {
+	case gomemcached.APPEND:
+		data := make([]byte, 0, len(item.Data)+len(req.Req.Body))
+		item.Data = append(append(data, item.Data...), req.Req.Body...)
+	case gomemcached.PREPEND:
+		data := make([]byte, 0, len(item.Data)+len(req.Req.Body))
+		item.Data = append(append(data, req.Req.Body...), item.Data...)
+	default:
+		item = memoryItem{stale: stale}
+		item.Flags = binary.BigEndian.Uint32(req.Req.Extras)
+		item.Expiration = MemoryStorageExpiration(
+			binary.BigEndian.Uint32(req.Req.Extras[4:]), now)
+		item.Data = append([]byte(nil), req.Req.Body...)
+	}
+	item.access = now
+	s.cas += 1
+	item.Cas = s.cas
+	s.data[key] = item
+
+	MemoryStorageRespond(req, gomemcached.SUCCESS, item.Cas)
+}
+
+// Handles incr and decr, whose extras are the delta, the initial value
+// and the expiration of an item that's created when it's missing,
+// unless the expiration is 0xffffffff.  Like memcached, an incr wraps
+// around at 64 bits and a decr stops at 0.
+func MemoryStorageArith(s *MemoryStorage, req Request) {
+	delta := binary.BigEndian.Uint64(req.Req.Extras)
+	initial := binary.BigEndian.Uint64(req.Req.Extras[8:])
+	exp := binary.BigEndian.Uint32(req.Req.Extras[16:])
+
+	key := string(req.Req.Key)
+	now := time.Now()
+	item, ok := s.item(key, now)
+	status := MemoryStorageCheck(item.MCItem, ok, req.Req.Cas)
+
+	var val uint64
+	if status == gomemcached.KEY_ENOENT && exp != 0xffffffff {
+		status = gomemcached.SUCCESS
+		val = initial
+		item.Expiration = MemoryStorageExpiration(exp, now)
+	} else if status == gomemcached.SUCCESS {
+		n, err := strconv.ParseUint(string(item.Data), 10, 64)
+		if err != nil {
+			MemoryStorageRespond(req, gomemcached.DELTA_BADVAL, 0)
+			return
+		}
+		if UnquietOpcode(req.Req.Opcode) == gomemcached.INCREMENT {
+			val = n + delta
+		} else if n > delta {
+			val = n - delta
+		}
+	}
+	if status != gomemcached.SUCCESS {
+		MemoryStorageRespond(req, status, 0)
+		return
+	}
+
+	item.Data = strconv.AppendUint(nil, val, 10)
+	item.access = now
+	s.cas += 1
+	item.Cas = s.cas
+	s.data[key] = item
+
+	body := make([]byte, 8)
+	binary.BigEndian.PutUint64(body, val)
+	req.Respond(&gomemcached.MCResponse{
+		Opcode: req.Req.Opcode,
+		Status: gomemcached.SUCCESS,
+		Opaque: req.Req.Opaque,
+		Cas:    item.Cas,
+		Key:    req.Req.Key,
+		Body:   body,
+	})
 }
 
 func (s MemoryStorage) PickChannel(clientNum uint32, bucket string) chan []Request {
 	return s.incoming
 }
 
-func MemoryStorageStart(spec string, params Params, statsChan chan Stats) Target {
+func (s MemoryStorage) QueueLens() []int {
+	return []int{len(s.incoming)}
+}
+
+func (s MemoryStorage) Close() {
+	close(s.incoming)
+	<-s.done
+}
+
+func MemoryStorageStart(spec string, params Params,
+	stats *Stats) (Target, error) {
 	s := MemoryStorage{
-		data:     make(map[string]gomemcached.MCItem),
+		data:     make(map[string]memoryItem),
 		incoming: make(chan []Request, params.TargetChanSize),
+		done:     make(chan bool),
 	}
 
 	go func() {
+		defer close(s.done)
+
+		ts := NewTargetStats(stats, "tot-target-memory")
+
 		for reqs := range s.incoming {
+			reqs = ts.Begin(reqs)
+			now := time.Now()
+			if !s.flushAt.IsZero() && !now.Before(s.flushAt) {
+				s.flush()
+				s.flushAt = time.Time{}
+			}
 			for _, req := range reqs {
-				if h, ok := MemoryStorageHandlers[req.Req.Opcode]; ok {
+				if req.Expired(now) {
+					RespondTimeout(req)
+				} else if h, ok := MemoryStorageHandlers[UnquietOpcode(req.Req.Opcode)]; ok {
 					h(&s, req)
 				} else {
-					req.Res <- &gomemcached.MCResponse{
+					req.Respond(&gomemcached.MCResponse{
 						Opcode: req.Req.Opcode,
 						Status: gomemcached.UNKNOWN_COMMAND,
 						Opaque: req.Req.Opaque,
-					}
+					})
 				}
 			}
 		}
 	}()
 
-	return s
+	return s, nil
 }
@@ -0,0 +1,213 @@
+package grouter
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/dustin/gomemcached"
+)
+
+// A request to the memory target and its expected response, where a
+// nil body isn't checked.
+type memoryTestStep struct {
+	opcode gomemcached.CommandCode
+	key    string
+	val    string
+	cas    uint64
+	exp    uint32 // The expiration of a mutation, gat or touch.
+	status gomemcached.Status
+	body   []byte
+}
+
+func memoryTestExtras(opcode gomemcached.CommandCode, exp uint32) []byte {
+	switch UnquietOpcode(opcode) {
+	case gomemcached.SET, gomemcached.ADD, gomemcached.REPLACE:
+		extras := make([]byte, 8)
+		binary.BigEndian.PutUint32(extras[4:], exp)
+		return extras
+	case gomemcached.INCREMENT, gomemcached.DECREMENT:
+		// A delta of 10, an initial value of 5, and an expiration,
+		// where 0xffffffff means a missing item isn't created.
+		extras := make([]byte, 20)
+		binary.BigEndian.PutUint64(extras, 10)
+		binary.BigEndian.PutUint64(extras[8:], 5)
+		binary.BigEndian.PutUint32(extras[16:], exp)
+		return extras
+	case gomemcached.GAT, gomemcached.TOUCH:
+		extras := make([]byte, 4)
+		binary.BigEndian.PutUint32(extras, exp)
+		return extras
+	}
+	return nil
+}
+
+func memoryTestDo(s *MemoryStorage, step memoryTestStep,
+	meta *RequestMeta) *gomemcached.MCResponse {
+	req := Request{
+		Req: &gomemcached.MCRequest{
+			Opcode: step.opcode,
+			Key:    []byte(step.key),
+			Cas:    step.cas,
+			Extras: memoryTestExtras(step.opcode, step.exp),
+			Body:   []byte(step.val),
+		},
+		Res:  make(chan *gomemcached.MCResponse, 1),
+		Meta: meta,
+	}
+	MemoryStorageHandlers[UnquietOpcode(step.opcode)](s, req)
+	return <-req.Res
+}
+
+func memoryTestCounter(n uint64) []byte {
+	body := make([]byte, 8)
+	binary.BigEndian.PutUint64(body, n)
+	return body
+}
+
+func TestMemoryStorageSemantics(t *testing.T) {
+	// An expiration over 30 days is a unix time, so this one's past.
+	past := uint32(30*24*60*60 + 1)
+	noVivify := uint32(0xffffffff)
+
+	tests := []struct {
+		name  string
+		steps []memoryTestStep
+	}{
+		{"add", []memoryTestStep{
+			{gomemcached.ADD, "a", "1", 0, 0, gomemcached.SUCCESS, nil},
+			{gomemcached.ADD, "a", "2", 0, 0, gomemcached.KEY_EEXISTS, nil},
+			{gomemcached.GET, "a", "", 0, 0, gomemcached.SUCCESS, []byte("1")},
+		}},
+		{"replace", []memoryTestStep{
+			{gomemcached.REPLACE, "a", "1", 0, 0, gomemcached.KEY_ENOENT, nil},
+			{gomemcached.SET, "a", "1", 0, 0, gomemcached.SUCCESS, nil},
+			{gomemcached.REPLACE, "a", "2", 0, 0, gomemcached.SUCCESS, nil},
+			{gomemcached.REPLACE, "a", "3", 1, 0, gomemcached.KEY_EEXISTS, nil},
+			{gomemcached.REPLACE, "a", "3", 2, 0, gomemcached.SUCCESS, nil},
+			{gomemcached.GET, "a", "", 0, 0, gomemcached.SUCCESS, []byte("3")},
+		}},
+		{"append and prepend", []memoryTestStep{
+			{gomemcached.APPEND, "a", "x", 0, 0, gomemcached.NOT_STORED, nil},
+			{gomemcached.PREPEND, "a", "x", 0, 0, gomemcached.NOT_STORED, nil},
+			{gomemcached.SET, "a", "b", 0, 0, gomemcached.SUCCESS, nil},
+			{gomemcached.APPEND, "a", "c", 0, 0, gomemcached.SUCCESS, nil},
+			{gomemcached.PREPENDQ, "a", "a", 0, 0, gomemcached.SUCCESS, nil},
+			{gomemcached.APPEND, "a", "d", 1, 0, gomemcached.KEY_EEXISTS, nil},
+			{gomemcached.GET, "a", "", 0, 0, gomemcached.SUCCESS, []byte("abc")},
+		}},
+		{"cas", []memoryTestStep{
+			{gomemcached.SET, "a", "1", 1, 0, gomemcached.KEY_ENOENT, nil},
+			{gomemcached.SET, "a", "1", 0, 0, gomemcached.SUCCESS, nil},
+			{gomemcached.SET, "a", "2", 2, 0, gomemcached.KEY_EEXISTS, nil},
+			{gomemcached.SET, "a", "2", 1, 0, gomemcached.SUCCESS, nil},
+			{gomemcached.DELETE, "a", "", 1, 0, gomemcached.KEY_EEXISTS, nil},
+			{gomemcached.DELETE, "a", "", 2, 0, gomemcached.SUCCESS, nil},
+			{gomemcached.DELETE, "a", "", 0, 0, gomemcached.KEY_ENOENT, nil},
+		}},
+		{"incr and decr", []memoryTestStep{
+			{gomemcached.INCREMENT, "n", "", 0, noVivify, gomemcached.KEY_ENOENT, nil},
+			{gomemcached.INCREMENT, "n", "", 0, 0, gomemcached.SUCCESS,
+				memoryTestCounter(5)},
+			{gomemcached.INCREMENT, "n", "", 0, 0, gomemcached.SUCCESS,
+				memoryTestCounter(15)},
+			{gomemcached.DECREMENT, "n", "", 0, 0, gomemcached.SUCCESS,
+				memoryTestCounter(5)},
+			{gomemcached.DECREMENT, "n", "", 0, 0, gomemcached.SUCCESS,
+				memoryTestCounter(0)},
+			{gomemcached.SET, "a", "x", 0, 0, gomemcached.SUCCESS, nil},
+			{gomemcached.INCREMENT, "a", "", 0, 0, gomemcached.DELTA_BADVAL, nil},
+		}},
+		{"expiration", []memoryTestStep{
+			{gomemcached.SET, "a", "1", 0, past, gomemcached.SUCCESS, nil},
+			{gomemcached.GET, "a", "", 0, 0, gomemcached.KEY_ENOENT, nil},
+			{gomemcached.SET, "a", "1", 0, 100, gomemcached.SUCCESS, nil},
+			{gomemcached.TOUCH, "a", "", 0, past, gomemcached.SUCCESS, nil},
+			{gomemcached.ADD, "a", "2", 0, 0, gomemcached.SUCCESS, nil},
+			{gomemcached.GAT, "a", "", 0, past, gomemcached.SUCCESS, []byte("2")},
+			{gomemcached.GET, "a", "", 0, 0, gomemcached.KEY_ENOENT, nil},
+			{gomemcached.TOUCH, "a", "", 0, 0, gomemcached.KEY_ENOENT, nil},
+		}},
+	}
+	for _, test := range tests {
+		s := &MemoryStorage{data: make(map[string]memoryItem)}
+		for i, step := range test.steps {
+			res := memoryTestDo(s, step, nil)
+			if res.Status != step.status {
+				t.Errorf("%v, step %v: expected status %v, got %v",
+					test.name, i, step.status, res.Status)
+			}
+			if step.body != nil && string(res.Body) != string(step.body) {
+				t.Errorf("%v, step %v: expected body %q, got %q",
+					test.name, i, step.body, res.Body)
+			}
+		}
+	}
+}
+
+func TestMemoryStorageItemInfo(t *testing.T) {
+	s := &MemoryStorage{data: make(map[string]memoryItem)}
+	get := memoryTestStep{opcode: gomemcached.GET, key: "a"}
+	meta := &RequestMeta{ItemInfo: true, TTL: -1, Recache: -1}
+
+	memoryTestDo(s, memoryTestStep{opcode: gomemcached.SET, key: "a",
+		val: "1", exp: 100}, nil)
+	memoryTestDo(s, memoryTestStep{opcode: gomemcached.SET, key: "b",
+		val: "1"}, nil)
+
+	tests := []struct {
+		step memoryTestStep
+		meta *RequestMeta
+		exp  ItemInfo
+	}{
+		{get, meta, ItemInfo{TTL: 100}},
+		{get, meta, ItemInfo{TTL: 100, Fetched: true}},
+		{memoryTestStep{opcode: gomemcached.GET, key: "b"}, meta,
+			ItemInfo{TTL: -1}},
+		// A ttl below the recache threshold wins the recache once.
+		{get, &RequestMeta{ItemInfo: true, TTL: -1, Recache: 200},
+			ItemInfo{TTL: 100, Fetched: true, Win: true}},
+		{get, &RequestMeta{ItemInfo: true, TTL: -1, Recache: 200},
+			ItemInfo{TTL: 100, Fetched: true, WinSent: true}},
+		// An invalidated item is stale, and its first get wins.
+		{memoryTestStep{opcode: gomemcached.DELETE, key: "a"},
+			&RequestMeta{Invalidate: true, TTL: 30, Recache: -1}, ItemInfo{}},
+		{get, meta, ItemInfo{TTL: 30, Fetched: true, Stale: true, Win: true}},
+		{get, meta, ItemInfo{TTL: 30, Fetched: true, Stale: true, WinSent: true}},
+		// A set with an older cas, which invalidates, stores it stale.
+		{memoryTestStep{opcode: gomemcached.SET, key: "a", val: "2", cas: 1},
+			&RequestMeta{Invalidate: true, TTL: -1, Recache: -1}, ItemInfo{}},
+		{get, meta, ItemInfo{TTL: -1, Stale: true, Win: true}},
+		// A plain set isn't stale.
+		{memoryTestStep{opcode: gomemcached.SET, key: "a", val: "3"}, nil,
+			ItemInfo{}},
+		{get, meta, ItemInfo{TTL: -1}},
+	}
+	for i, test := range tests {
+		res := memoryTestDo(s, test.step, test.meta)
+		if res.Status != gomemcached.SUCCESS {
+			t.Errorf("test %v: expected success, got %v", i, res.Status)
+			continue
+		}
+		if UnquietOpcode(test.step.opcode) != gomemcached.GET {
+			continue
+		}
+		info, ok := ItemInfoParse(res.Extras)
+		if !ok {
+			t.Errorf("test %v: expected item info, got extras %v", i, res.Extras)
+			continue
+		}
+		// A second might have ticked since the item's ttl was set.
+		if info.TTL > 0 && info.TTL == test.exp.TTL-1 {
+			info.TTL = test.exp.TTL
+		}
+		info.LastAccess = 0
+		if info != test.exp {
+			t.Errorf("test %v: expected %+v, got %+v", i, test.exp, info)
+		}
+	}
+
+	// Without a RequestMeta, a get's extras are just the flags.
+	if res := memoryTestDo(s, get, nil); len(res.Extras) != 4 {
+		t.Errorf("expected 4 bytes of extras, got %v", res.Extras)
+	}
+}
@@ -0,0 +1,156 @@
+package grouter
+
+import (
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+// Names of opcodes for stats labels, matching the ascii commands.
+var OpcodeNames = map[gomemcached.CommandCode]string{
+	gomemcached.GET:        "get",
+	gomemcached.SET:        "set",
+	gomemcached.ADD:        "add",
+	gomemcached.REPLACE:    "replace",
+	gomemcached.DELETE:     "delete",
+	gomemcached.INCREMENT:  "incr",
+	gomemcached.DECREMENT:  "decr",
+	gomemcached.QUIT:       "quit",
+	gomemcached.FLUSH:      "flush_all",
+	gomemcached.GETQ:       "getq",
+	gomemcached.NOOP:       "noop",
+	gomemcached.VERSION:    "version",
+	gomemcached.GETK:       "getk",
+	gomemcached.GETKQ:      "getkq",
+	gomemcached.APPEND:     "append",
+	gomemcached.PREPEND:    "prepend",
+	gomemcached.STAT:       "stats",
+	gomemcached.SETQ:       "setq",
+	gomemcached.ADDQ:       "addq",
+	gomemcached.REPLACEQ:   "replaceq",
+	gomemcached.DELETEQ:    "deleteq",
+	gomemcached.INCREMENTQ: "incrq",
+	gomemcached.DECREMENTQ: "decrq",
+	gomemcached.APPENDQ:    "appendq",
+	gomemcached.PREPENDQ:   "prependq",
+	gomemcached.TOUCH:      "touch",
+	gomemcached.GAT:        "gat",
+	gomemcached.FLUSHQ:     "flush_allq",
+	gomemcached.VERBOSITY:  "verbosity",
+}
+
+func OpcodeName(opcode gomemcached.CommandCode) string {
+	if name, ok := OpcodeNames[opcode]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Returns the name of a response status for stats labels, where the
+// hit/miss of a get is distinguished from the success/not_found of
+// other ops.
+func StatusName(opcode gomemcached.CommandCode, status gomemcached.Status) string {
+	get := opcode == gomemcached.GET || opcode == gomemcached.GETQ ||
+		opcode == gomemcached.GETK || opcode == gomemcached.GETKQ ||
+		opcode == gomemcached.GAT
+	switch status {
+	case gomemcached.SUCCESS:
+		if get {
+			return "hit"
+		}
+		return "success"
+	case gomemcached.KEY_ENOENT:
+		if get {
+			return "miss"
+		}
+		return "not_found"
+	case gomemcached.KEY_EEXISTS:
+		return "exists"
+	case gomemcached.NOT_STORED:
+		return "not_stored"
+	case ETIMEDOUT:
+		return "timeout"
+	case EBUSY:
+		return "busy"
+	}
+	return "error"
+}
+
+// A target worker's stats of ops, broken down by bucket, opcode and
+// status.  The request and response bytes of ops are counted with
+// keys like tot-target-memory-req-bytes, and the ops and their
+// latencies with keys like tot-target-memory-ops.  A TargetStats is
+// only used by its own worker goroutine, so it needs no locking.
+type TargetStats struct {
+	stats *Stats
+	name  string // Such as "tot-target-memory".
+	start time.Time
+	ops   map[statsOpKey]*targetOpStats
+	reqs  []Request // The worker's copy of the current batch.
+}
+
+// Identifies the stats of an op by its bucket, opcode and status.
+type statsOpKey struct {
+	bucket string
+	opcode gomemcached.CommandCode
+	status gomemcached.Status
+}
+
+type targetOpStats struct {
+	op       *StatsOp
+	reqBytes *StatsCounter
+	resBytes *StatsCounter
+}
+
+func NewTargetStats(stats *Stats, name string) *TargetStats {
+	return &TargetStats{
+		stats: stats,
+		name:  name,
+		ops:   make(map[statsOpKey]*targetOpStats),
+	}
+}
+
+// Starts timing a batch of requests, whose responses are recorded when
+// they're sent with Request.Respond().  This also ends the spans of
+// traced requests that were waiting in the target's queue or, if
+// BatchRequests already ended that span, waiting to be batched.
+//
+// The sender might still be reading its slice of requests, so Begin
+// returns the worker's own copy, which the worker should use instead,
+// until its next call to Begin.
+func (ts *TargetStats) Begin(reqs []Request) []Request {
+	ts.start = time.Now()
+	ts.reqs = append(ts.reqs[:0], reqs...)
+	for i := range ts.reqs {
+		ts.reqs[i].targetStats = ts
+		if ts.reqs[i].Trace != nil {
+			if ts.reqs[i].Trace.Last() == "target.queue" {
+				ts.reqs[i].Trace.Span("target.batch", ts.start)
+			} else {
+				ts.reqs[i].Trace.Span("target.queue", ts.start)
+			}
+		}
+	}
+	return ts.reqs
+}
+
+func (ts *TargetStats) record(req Request, res *gomemcached.MCResponse) {
+	k := statsOpKey{req.Bucket, req.Req.Opcode, res.Status}
+	o := ts.ops[k]
+	if o == nil {
+		labels := []string{
+			"bucket", req.Bucket,
+			"opcode", OpcodeName(req.Req.Opcode),
+			"status", StatusName(req.Req.Opcode, res.Status),
+		}
+		o = &targetOpStats{
+			op:       ts.stats.Op(ts.name+"-ops", labels...),
+			reqBytes: ts.stats.Counter(ts.name+"-req-bytes", labels...),
+			resBytes: ts.stats.Counter(ts.name+"-res-bytes", labels...),
+		}
+		ts.ops[k] = o
+	}
+	o.op.Record(time.Since(ts.start))
+	o.reqBytes.Add(int64(len(req.Req.Key) + len(req.Req.Extras) + len(req.Req.Body)))
+	o.resBytes.Add(int64(len(res.Key) + len(res.Extras) + len(res.Body)))
+}
@@ -0,0 +1,236 @@
+package grouter
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A target that forwards requests to an underlying target, which can
+// be atomically swapped for a new target (such as on a config reload)
+// without disturbing the sources that are sending requests.
+//
+// When the underlying target's queue is full, the overload policy
+// decides what happens to the requests being forwarded...
+//
+//	block       - wait for room, which backs up into the sources.
+//	reject      - respond to the requests with an EBUSY status.
+//	shed-oldest - respond to the oldest queued requests with an EBUSY
+//	              status, making room for the newer requests.
+//
+// Shedding is best-effort, as the target's worker is concurrently
+// taking batches off the same queue, so the shed batch is the oldest
+// one that's still queued at that moment, which might be a newer batch
+// than the one the worker had just taken.
+//
+// The overload stats are labeled by worker, the index of the forwarder,
+// which sends to the target worker that its clients map to.
+type SwapTarget struct {
+	incomingChans []chan []Request
+	workerStats   []*swapTargetStats
+	done          chan bool // Closed by Close(), to stop the forwarders.
+
+	m        sync.RWMutex // Protects the fields below.
+	curr     Target
+	inflight *sync.WaitGroup // Forwarders that are sending to curr.
+	swapped  chan bool       // Closed when curr is swapped out.
+	chanSize int             // Of the curr target's queues.
+	overload string          // One of TargetOverloadPolicies.
+	closed   bool
+
+	workers sync.WaitGroup // Forwarders and closers of swapped out targets.
+}
+
+type swapTargetStats struct {
+	tot_enqueue_wait *StatsOp // Time spent waiting for room in a queue.
+	tot_rejected     *StatsCounter
+	tot_shed         *StatsCounter
+}
+
+func (s *SwapTarget) PickChannel(clientNum uint32, bucket string) chan []Request {
+	return s.incomingChans[clientNum%uint32(len(s.incomingChans))]
+}
+
+// Returns the queue lengths of the current target, which are all of the
+// queued requests, as the forwarding channels are unbuffered.
+func (s *SwapTarget) QueueLens() []int {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.curr.QueueLens()
+}
+
+// Returns the capacity of each of the current target's queues.
+func (s *SwapTarget) QueueCap() int {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.chanSize
+}
+
+// Stops the forwarders, once they've forwarded any requests that were
+// being sent to them, and then closes the current target after any
+// swapped out targets have finished draining.  The forwarding channels
+// are left open, as a conn that was given up on during shutdown might
+// still send to them, and its requests are then rejected.
+func (s *SwapTarget) Close() {
+	s.m.Lock()
+	s.closed = true
+	s.m.Unlock()
+	close(s.done)
+	s.workers.Wait()
+	s.curr.Close()
+}
+
+// Atomically replaces the current target, so that new requests go to
+// the next target, while the previous target is drained and closed in
+// the background, once the forwarders are done sending to it.  Requests
+// that a forwarder is blocked on sending to the previous target are
+// sent to the next target instead.  A client's requests that were
+// queued before the swap might be processed after its requests that
+// are sent after the swap, as they're handled by different targets.
+// The next target's params provide its queue size and overload policy.
+func (s *SwapTarget) Swap(next Target, params Params) {
+	s.m.Lock()
+	if s.closed {
+		s.m.Unlock()
+		next.Close()
+		return
+	}
+	prev, prevInflight := s.curr, s.inflight
+	close(s.swapped)
+	s.curr = next
+	s.inflight = &sync.WaitGroup{}
+	s.swapped = make(chan bool)
+	s.chanSize = params.TargetChanSize
+	s.overload = params.TargetOverload
+	s.workers.Add(1)
+	s.m.Unlock()
+
+	go func() {
+		defer s.workers.Done()
+
+		prevInflight.Wait()
+		prev.Close()
+		log.Printf("SwapTarget: closed previous target")
+	}()
+}
+
+var TargetOverloadPolicies = []string{"block", "reject", "shed-oldest"}
+
+func SwapTargetStart(target Target, params Params, stats *Stats) *SwapTarget {
+	s := &SwapTarget{
+		incomingChans: make([]chan []Request, params.TargetConcurrency),
+		workerStats:   make([]*swapTargetStats, params.TargetConcurrency),
+		chanSize:      params.TargetChanSize,
+		overload:      params.TargetOverload,
+		curr:          target,
+		inflight:      &sync.WaitGroup{},
+		swapped:       make(chan bool),
+		done:          make(chan bool),
+	}
+
+	for i := range s.incomingChans {
+		worker := strconv.Itoa(i)
+		s.workerStats[i] = &swapTargetStats{
+			tot_enqueue_wait: stats.Op("tot-target-enqueue-wait", "worker", worker),
+			tot_rejected:     stats.Counter("tot-target-rejected", "worker", worker),
+			tot_shed:         stats.Counter("tot-target-shed", "worker", worker),
+		}
+		// Unbuffered, so that the target's queues are the only queues,
+		// which QueueLens() and the overload policy are about.
+		s.incomingChans[i] = make(chan []Request)
+		s.workers.Add(1)
+		go func(incoming chan []Request, ws *swapTargetStats) {
+			s.forward(incoming, ws)
+			s.workers.Done()
+
+			for reqs := range incoming { // Never closed, see Close().
+				ws.tot_rejected.Add(int64(len(reqs)))
+				for _, req := range reqs {
+					RespondBusy(req)
+				}
+			}
+		}(s.incomingChans[i], s.workerStats[i])
+	}
+
+	return s
+}
+
+// Forwards the requests from a forwarding channel to the current target
+// until Close(), and then forwards any requests that are still being
+// sent to it.
+func (s *SwapTarget) forward(incoming chan []Request, ws *swapTargetStats) {
+	for {
+		var reqs []Request
+		select {
+		case reqs = <-incoming:
+		case <-s.done:
+			select {
+			case reqs = <-incoming:
+			default:
+				return
+			}
+		}
+
+		// The send isn't under the lock, as it might block on a stuck
+		// target, but it's counted as inflight, so that Swap() doesn't
+		// close the target first.  A send that's blocked when the
+		// target is swapped out is retried with the next target.
+		for sent := len(reqs) <= 0; !sent; {
+			s.m.RLock()
+			curr, inflight, swapped, overload :=
+				s.curr, s.inflight, s.swapped, s.overload
+			inflight.Add(1)
+			s.m.RUnlock()
+
+			sent = ws.send(curr.PickChannel(reqs[0].ClientNum, reqs[0].Bucket),
+				reqs, overload, swapped)
+			inflight.Done()
+		}
+	}
+}
+
+// Sends requests to a target's channel, following the overload policy
+// when the channel is full.  Returns false, without sending, if the
+// target is swapped out while waiting for room.
+func (s *swapTargetStats) send(c chan []Request, reqs []Request, overload string,
+	swapped chan bool) bool {
+	start := time.Now()
+	for {
+		select {
+		case c <- reqs:
+			s.tot_enqueue_wait.Record(time.Since(start))
+			return true
+		default:
+		}
+
+		switch {
+		case overload == "reject":
+			s.tot_rejected.Add(int64(len(reqs)))
+			for _, req := range reqs {
+				RespondBusy(req)
+			}
+			return true
+		case overload == "shed-oldest" && cap(c) > 0:
+			// The target's worker might take the oldest requests
+			// first, in which case we shed the next oldest, if any,
+			// or just try sending again.
+			select {
+			case oldest := <-c:
+				s.tot_shed.Add(int64(len(oldest)))
+				for _, req := range oldest {
+					RespondBusy(req)
+				}
+			default:
+			}
+		default:
+			select {
+			case c <- reqs:
+				s.tot_enqueue_wait.Record(time.Since(start))
+				return true
+			case <-swapped:
+				return false
+			}
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package grouter
+
+import (
+	"testing"
+
+	"github.com/dustin/gomemcached"
+)
+
+func swapTestGet(s *SwapTarget, key string) *gomemcached.MCResponse {
+	req := Request{
+		Bucket: "default",
+		Req: &gomemcached.MCRequest{
+			Opcode: gomemcached.GET,
+			Key:    []byte(key),
+		},
+		Res: make(chan *gomemcached.MCResponse, 1),
+	}
+	s.PickChannel(0, "default") <- []Request{req}
+	return <-req.Res
+}
+
+func TestSwapTargetClose(t *testing.T) {
+	params := Params{TargetChanSize: 1, TargetConcurrency: 2,
+		TargetOverload: "block"}
+	stats := NewStats()
+	target, _ := MemoryStorageStart("memory", params, stats)
+	s := SwapTargetStart(target, params, stats)
+
+	// Requests are only queued in the target's queues, which QueueLens()
+	// and QueueCap() report on.
+	if n := cap(s.PickChannel(0, "default")); n != 0 {
+		t.Errorf("expected unbuffered forwarding channels, got cap %v", n)
+	}
+
+	if res := swapTestGet(s, "a"); res.Status != gomemcached.KEY_ENOENT {
+		t.Errorf("expected KEY_ENOENT before close, got %v", res.Status)
+	}
+
+	next, _ := MemoryStorageStart("memory", params, stats)
+	s.Swap(next, params)
+	if res := swapTestGet(s, "a"); res.Status != gomemcached.KEY_ENOENT {
+		t.Errorf("expected KEY_ENOENT after swap, got %v", res.Status)
+	}
+
+	// A conn that was given up on during shutdown might still send
+	// requests after Close(), which are rejected instead of panicking.
+	s.Close()
+	if res := swapTestGet(s, "a"); res.Status != EBUSY {
+		t.Errorf("expected EBUSY after close, got %v", res.Status)
+	}
+}
@@ -0,0 +1,363 @@
+package grouter
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The trace of a request, which is carried by the Request from its
+// source, through the target's queue and batching, to the backend and
+// back.  Each stage ends a span that started where the previous stage
+// left off, so the spans add up to the request's whole time...
+//
+//	source.parse   - reading and parsing the command, until it's queued.
+//	target.queue   - waiting in the target's channel.
+//	target.batch   - waiting in BatchRequests for a batch to be sent.
+//	target.backend - the target's processing, such as a round trip.
+//	source.write   - writing the response to the client.
+//
+// A trace is touched by the source, batching and target goroutines, and
+// a timed out request's trace may still be touched by its target after
+// the source is done, so it's locked.
+type Trace struct {
+	m      sync.Mutex
+	id     string
+	spanId string // Of the root span, which is the parent of the others.
+	start  time.Time
+	mark   time.Time // Where the next span starts.
+	end    time.Time
+	last   string // Name of the last span.
+	spans  []traceSpan
+	attrs  map[string]string
+}
+
+type traceSpan struct {
+	id    string
+	name  string
+	start time.Time
+	end   time.Time
+}
+
+func NewTrace(start time.Time) *Trace {
+	return &Trace{
+		id:     traceRandId(16),
+		spanId: traceRandId(8),
+		start:  start,
+		mark:   start,
+		attrs:  make(map[string]string),
+	}
+}
+
+func traceRandId(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Ends a span of the trace at now, which started at the end of the
+// previous span.  Like the other Trace methods, it's a no-op on a nil
+// trace, so that untraced requests need no checks.
+func (t *Trace) Span(name string, now time.Time) {
+	if t == nil {
+		return
+	}
+	t.m.Lock()
+	t.spans = append(t.spans, traceSpan{traceRandId(8), name, t.mark, now})
+	t.mark = now
+	t.last = name
+	t.m.Unlock()
+}
+
+// Returns the name of the last span, or "" when there's none.
+func (t *Trace) Last() string {
+	if t == nil {
+		return ""
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.last
+}
+
+// Sets an attribute of the trace's root span, such as its opcode.
+func (t *Trace) Attr(key, val string) {
+	if t == nil {
+		return
+	}
+	t.m.Lock()
+	t.attrs[key] = val
+	t.m.Unlock()
+}
+
+// An exporter of sampled traces in the OpenTelemetry protocol's JSON
+// encoding (OTLP/JSON), either as lines appended to a file, like the
+// collector's file exporter, or POST'ed to a collector's OTLP/HTTP
+// endpoint, such as http://localhost:4318/v1/traces.  Like the access
+// log, traces are queued and exported by a separate goroutine, in
+// batches, and dropped and counted when the goroutine falls behind.
+type TraceExporter struct {
+	dest   string
+	sample float64
+
+	m      sync.RWMutex // Protects closed, which is set when traces is closed.
+	closed bool
+	traces chan *Trace
+	done   chan bool
+
+	tot_exported      *StatsCounter
+	tot_dropped       *StatsCounter
+	tot_export_errors *StatsCounter
+}
+
+// Max traces per export, and max wait before a partial batch is exported.
+const traceBatchSize = 100
+const traceBatchWait = time.Second
+
+// Trace exporters are shared by destination, such as by all the conns
+// of a source.
+var traceExporters = struct {
+	m         sync.Mutex
+	exporters map[string]*TraceExporter
+}{exporters: make(map[string]*TraceExporter)}
+
+// Returns the trace exporter for the params' TraceExport destination,
+// opening it on first use, or nil when the params have no destination.
+func TraceExporterOpen(params Params, stats *Stats) (*TraceExporter, error) {
+	if params.TraceExport == "" {
+		return nil, nil
+	}
+
+	traceExporters.m.Lock()
+	defer traceExporters.m.Unlock()
+
+	if x := traceExporters.exporters[params.TraceExport]; x != nil {
+		return x, nil
+	}
+
+	x := &TraceExporter{
+		dest:              params.TraceExport,
+		sample:            params.TraceSample,
+		traces:            make(chan *Trace, 1000),
+		done:              make(chan bool),
+		tot_exported:      stats.Counter("tot-trace-exported"),
+		tot_dropped:       stats.Counter("tot-trace-dropped"),
+		tot_export_errors: stats.Counter("tot-trace-export-errors"),
+	}
+
+	export, closer := x.post, func() {}
+	if !TraceExportIsHTTP(x.dest) {
+		f, err := os.OpenFile(x.dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("could not open trace export: %v; err: %v",
+				x.dest, err)
+		}
+		w := bufio.NewWriter(f)
+		export = func(b []byte) error {
+			w.Write(b)
+			w.Write([]byte("\n"))
+			return w.Flush()
+		}
+		closer = func() { f.Close() }
+	}
+	go x.run(export, closer)
+
+	traceExporters.exporters[params.TraceExport] = x
+	return x, nil
+}
+
+// Exports any queued traces and closes all the trace exporters, such as
+// on shutdown, after the sources are done.
+func TraceExportersClose() {
+	traceExporters.m.Lock()
+	defer traceExporters.m.Unlock()
+
+	for dest, x := range traceExporters.exporters {
+		x.m.Lock()
+		x.closed = true
+		close(x.traces)
+		x.m.Unlock()
+		<-x.done
+		delete(traceExporters.exporters, dest)
+	}
+}
+
+func TraceExportIsHTTP(dest string) bool {
+	return strings.HasPrefix(dest, "http://") ||
+		strings.HasPrefix(dest, "https://")
+}
+
+// Returns a new trace that starts at start, if it's sampled, or nil.
+func (x *TraceExporter) Start(start time.Time) *Trace {
+	if x == nil || x.sample <= 0 ||
+		(x.sample < 1.0 && mathrand.Float64() >= x.sample) {
+		return nil
+	}
+	return NewTrace(start)
+}
+
+// Ends a trace at end and queues it for export, or drops it when the
+// queue is full or the exporter is closed, such as when a conn that was
+// given up on during shutdown ends its request's trace.
+func (x *TraceExporter) End(t *Trace, end time.Time) {
+	if x == nil || t == nil {
+		return
+	}
+	t.m.Lock()
+	t.end = end
+	t.m.Unlock()
+
+	x.m.RLock()
+	if !x.closed {
+		select {
+		case x.traces <- t:
+			x.m.RUnlock()
+			return
+		default:
+		}
+	}
+	x.m.RUnlock()
+	x.tot_dropped.Add(1)
+}
+
+func (x *TraceExporter) run(export func([]byte) error, closer func()) {
+	defer close(x.done)
+	defer closer()
+
+	var batch []*Trace
+	flush := func() {
+		if len(batch) <= 0 {
+			return
+		}
+		b, err := json.Marshal(TraceOTLP(batch))
+		if err == nil {
+			err = export(b)
+		}
+		if err != nil {
+			x.tot_export_errors.Add(1)
+			log.Printf("warn: trace export failed: %v; err: %v", x.dest, err)
+		} else {
+			x.tot_exported.Add(int64(len(batch)))
+		}
+		batch = nil
+	}
+
+	timer := time.NewTimer(traceBatchWait)
+	defer timer.Stop()
+	for {
+		select {
+		case t, ok := <-x.traces:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, t)
+			if len(batch) >= traceBatchSize {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+			timer.Reset(traceBatchWait)
+		}
+	}
+}
+
+var traceHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+func (x *TraceExporter) post(b []byte) error {
+	res, err := traceHTTPClient.Post(x.dest, "application/json",
+		bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status: %v", res.Status)
+	}
+	return nil
+}
+
+// Returns traces as an OTLP/JSON ExportTraceServiceRequest, where each
+// trace has a root "grouter.OPCODE" server span, and its stages are the
+// root span's children.
+func TraceOTLP(traces []*Trace) map[string]interface{} {
+	spans := []interface{}{}
+	for _, t := range traces {
+		t.m.Lock()
+		attrs := []interface{}{}
+		for _, k := range sortedTraceKeys(t.attrs) {
+			attrs = append(attrs, traceOTLPAttr(k, t.attrs[k]))
+		}
+		spans = append(spans, map[string]interface{}{
+			"traceId":           t.id,
+			"spanId":            t.spanId,
+			"name":              "grouter." + t.attrs["opcode"],
+			"kind":              2, // SPAN_KIND_SERVER.
+			"startTimeUnixNano": traceOTLPTime(t.start),
+			"endTimeUnixNano":   traceOTLPTime(t.end),
+			"attributes":        attrs,
+		})
+		for _, s := range t.spans {
+			spans = append(spans, map[string]interface{}{
+				"traceId":           t.id,
+				"spanId":            s.id,
+				"parentSpanId":      t.spanId,
+				"name":              s.name,
+				"kind":              1, // SPAN_KIND_INTERNAL.
+				"startTimeUnixNano": traceOTLPTime(s.start),
+				"endTimeUnixNano":   traceOTLPTime(s.end),
+			})
+		}
+		t.m.Unlock()
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []interface{}{
+						traceOTLPAttr("service.name", "grouter"),
+						traceOTLPAttr("service.version", Version),
+					},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "grouter"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+}
+
+// OTLP/JSON encodes 64-bit ints as strings.
+func traceOTLPTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func traceOTLPAttr(key, val string) map[string]interface{} {
+	return map[string]interface{}{
+		"key":   key,
+		"value": map[string]interface{}{"stringValue": val},
+	}
+}
+
+func sortedTraceKeys(m map[string]string) []string {
+	rv := make([]string, 0, len(m))
+	for k := range m {
+		rv = append(rv, k)
+	}
+	sort.Strings(rv)
+	return rv
+}
@@ -0,0 +1,38 @@
+package grouter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTraceExporterEndAfterClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grouter")
+	if err != nil {
+		t.Fatalf("tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	stats := NewStats()
+	x, err := TraceExporterOpen(Params{
+		TraceExport: filepath.Join(dir, "traces.json"),
+		TraceSample: 1.0,
+	}, stats)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	x.End(x.Start(time.Now()), time.Now())
+	TraceExportersClose()
+
+	// A conn that was given up on during shutdown might still end its
+	// request's trace, which is dropped.
+	x.End(x.Start(time.Now()), time.Now())
+	if n := x.tot_exported.Get(); n != 1 {
+		t.Errorf("expected 1 exported trace, got %v", n)
+	}
+	if n := x.tot_dropped.Get(); n != 1 {
+		t.Errorf("expected 1 dropped trace, got %v", n)
+	}
+}